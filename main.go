@@ -7,11 +7,15 @@ import (
 
 	"github.com/jessevdk/go-flags"
 
+	"context"
 	"log"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type operation struct {
@@ -28,6 +32,49 @@ var (
 		// Boolean for whether this should act as a server or client
 		Client bool `short:"c" long:"client" description:"Acts as a client when specified"`
 		Reset  bool `short:"r" long:"reset" description:"Reset persistent log for server  (eg. rm -r log/)"`
+
+		Engine string `short:"e" long:"engine" default:"map" description:"Storage engine for server (map or lsm)"`
+		Memory int64  `short:"m" long:"memory" default:"0" description:"Memory budget in megabytes for the map engine, cold keys are served from disk (0 for unbounded)"`
+
+		MaxFrame     uint32 `long:"max-frame" default:"1048576" description:"Largest message in bytes sent or accepted on the wire, larger values are sent in chunks"`
+		GRPCPort     uint16 `long:"grpc-port" default:"0" description:"Also serve the gRPC service on this port (0 to disable)"`
+		HTTPPort     uint16 `long:"http-port" default:"0" description:"Also serve the REST gateway on this port (0 to disable)"`
+		RedisPort    uint16 `long:"redis-port" default:"0" description:"Also speak the Redis protocol on this port (0 to disable)"`
+		MetricsPort  uint16 `long:"metrics-port" default:"0" description:"Serve Prometheus metrics on /metrics at this port (0 to disable)"`
+		MemcachePort uint16 `long:"memcache-port" default:"0" description:"Also speak the memcached text protocol on this port (0 to disable)"`
+
+		TLS     bool   `long:"tls" description:"Connect to the server over TLS, implied by the other tls flags (client)"`
+		TLSCert string `long:"tls-cert" description:"Certificate file, served on every port (server) or presented for mutual TLS (client)"`
+		TLSKey  string `long:"tls-key" description:"Private key file for --tls-cert"`
+		TLSCA   string `long:"tls-ca" description:"CA file that client certificates must be signed by (server) or that the server is verified against (client)"`
+
+		ACL      string `long:"acl" description:"JSON file of principals and the key prefixes they may read or write, clients must authenticate (server)"`
+		User     string `short:"u" long:"user" description:"Username to authenticate as (client)"`
+		Password string `long:"password" env:"KEYVALUE_PASSWORD" description:"Password for --user (client)"`
+		Token    string `long:"token" env:"KEYVALUE_TOKEN" description:"Token to authenticate with instead of a username and password (client)"`
+
+		EncryptionKeyFile string `long:"encryption-key-file" description:"File of base64 AES keys to encrypt the persistence files with, the first is current and the rest are old keys (server)"`
+		EncryptionKey     string `long:"encryption-key" env:"KEYVALUE_ENCRYPTION_KEY" description:"Base64 AES keys like --encryption-key-file, separated by commas (server)"`
+		EncryptionMigrate bool   `long:"encryption-migrate" description:"Also read unencrypted persistence files, to start encrypting an existing store (server)"`
+		Compress          bool   `long:"compress" description:"Deflate large values in the persistence files (server) or on the wire (client)"`
+
+		MaxConnections int     `long:"max-connections" default:"0" description:"Refuse connections past this many on the binary, Redis and memcached ports (0 for no limit, server)"`
+		MaxInFlight    int     `long:"max-in-flight" default:"0" description:"Answer requests past this many at once with a busy status (0 for no limit, server)"`
+		RateLimit      float64 `long:"rate-limit" default:"0" description:"Requests a second allowed from each client address or user, the rest are answered busy (0 for no limit, server)"`
+		RateBurst      int     `long:"rate-burst" default:"0" description:"Requests a client may send at once on top of --rate-limit (defaults to the rate, server)"`
+
+		ShutdownTimeout time.Duration `long:"shutdown-timeout" default:"10s" description:"On SIGINT or SIGTERM wait this long for clients before closing their connections, queued sets are always persisted (server)"`
+
+		Timeout time.Duration `long:"timeout" default:"0" description:"Give up on each get or set after this long, e.g. 500ms (0 to wait forever)"`
+		Retry   bool          `long:"retry" description:"Reconnect when the connection drops and send requests in flight again (client)"`
+		Pool    int           `long:"pool" default:"1" description:"Most connections the client opens to the server, more are dialed while all are busy (client)"`
+
+		Leader         string        `long:"leader" description:"Address of the leader this server is a replica of, writes are redirected there (server)"`
+		LeaderToken    string        `long:"leader-token" env:"KEYVALUE_LEADER_TOKEN" description:"Token a replica syncs with when its leader has an ACL (server)"`
+		SyncInterval   time.Duration `long:"sync-interval" default:"1s" description:"How often a replica pulls a snapshot from its leader (server)"`
+		ReadStaleness  time.Duration `long:"read-staleness" default:"0" description:"Read from a replica at most this far behind its leader, e.g. 5s (client)"`
+		ReadYourWrites bool          `long:"read-your-writes" description:"Make every get see the writes the client has already seen, its own included (client)"`
+		NearCache      int           `long:"near-cache" default:"0" description:"Keep this many recent get answers in the client, kept fresh by the server (client)"`
 	}
 	args       []string
 	operations = make(chan operation, len(os.Args))
@@ -49,7 +96,7 @@ func init() {
 	var err error
 	args, err = flags.Parse(&opts)
 	if err != nil {
-		log.Fatalf("Error parsing options: &v\n", err)
+		log.Fatalf("Error parsing options: %v\n", err)
 	}
 
 	if len(args) < 1 {
@@ -59,6 +106,9 @@ func init() {
 			log.Fatalln("Need to specify port for server to open")
 		}
 	}
+	if !opts.Client && opts.Engine == server.EngineLSM && opts.Memory > 0 {
+		log.Fatalln("Memory budget '-m' is only supported by the map engine, not '-e lsm'")
+	}
 
 	if opts.Client {
 		close(operations)
@@ -72,33 +122,110 @@ func init() {
 }
 
 func main() {
-	var service keyvalue.Service
+	var service keyvalue.ContextService
 	if opts.Client {
-		_, service = client.Init(args[0])
+		// Several servers of the same deployment may be given separated by commas
+		servers := strings.Split(args[0], ",")
+		config := client.Config{
+			Server:       servers[0],
+			Servers:      servers[1:],
+			MaxFrameSize: opts.MaxFrame,
+			TLS:          opts.TLS,
+			CAFile:       opts.TLSCA,
+			CertFile:     opts.TLSCert,
+			KeyFile:      opts.TLSKey,
+			Username:     opts.User,
+			Password:     opts.Password,
+			Token:        opts.Token,
+			Compress:     opts.Compress,
+			PoolSize:     opts.Pool,
+
+			ReadStaleness:  opts.ReadStaleness,
+			NearCache:      opts.NearCache,
+			ReadYourWrites: opts.ReadYourWrites,
+		}
+		if opts.Retry {
+			config.Retry = client.RetryInFlight
+		}
+		_, service = client.InitConfig(config)
 	} else {
+		config := server.Config{
+			Engine:       opts.Engine,
+			MemoryBudget: opts.Memory << 20,
+			MaxFrameSize: opts.MaxFrame,
+			GRPCPort:     opts.GRPCPort,
+			HTTPPort:     opts.HTTPPort,
+			RedisPort:    opts.RedisPort,
+			MemcachePort: opts.MemcachePort,
+			MetricsPort:  opts.MetricsPort,
+			CertFile:     opts.TLSCert,
+			KeyFile:      opts.TLSKey,
+			ClientCAFile: opts.TLSCA,
+			ACLFile:      opts.ACL,
+			Leader:       opts.Leader,
+			LeaderToken:  opts.LeaderToken,
+			SyncInterval: opts.SyncInterval,
+
+			EncryptionKeyFile: opts.EncryptionKeyFile,
+			EncryptionKey:     opts.EncryptionKey,
+			EncryptionMigrate: opts.EncryptionMigrate,
+			Compress:          opts.Compress,
+
+			MaxConnections: opts.MaxConnections,
+			MaxInFlight:    opts.MaxInFlight,
+			RateLimit:      opts.RateLimit,
+			RateBurst:      opts.RateBurst,
+		}
+		var s *server.Server
 		port, err := strconv.Atoi(args[0])
 		if err == nil {
-			_, service = server.Init(uint16(port))
+			config.Port = uint16(port)
+			_, s = server.InitConfig(config)
 		} else {
 			split := strings.Split(args[0], ":")
 			port, err := strconv.Atoi(split[len(split)-1])
 			if err == nil {
-				_, service = server.Init(uint16(port))
+				config.Port = uint16(port)
+				_, s = server.InitConfig(config)
 			} else {
 				log.Fatalf("Could not parse port from '%s': %v", args[0], err)
 			}
 		}
+		if s == nil {
+			log.Fatalln("Server could not start")
+		}
+		service = s
+		go shutdownOnSignal(s, opts.ShutdownTimeout)
 	}
 
 	defer service.Close()
 
 	for oper := range operations {
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if opts.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), opts.Timeout)
+		}
 		if oper.value == "" {
-			result, value := service.Get(oper.key)
+			result, value := service.GetContext(ctx, oper.key)
 			log.Printf("Called Get(key=%s) Received(result=%d, value=%s)\n", oper.key, result, value)
 		} else {
-			result, old := service.Set(oper.key, oper.value)
+			result, old := service.SetContext(ctx, oper.key, oper.value)
 			log.Printf("Called Set(key=%s, value=%s) Received(result=%d, value=%s)\n", oper.key, oper.value, result, old)
 		}
+		cancel()
+	}
+}
+
+// Shuts the server down cleanly on SIGINT or SIGTERM, exiting once everything is persisted
+func shutdownOnSignal(s *server.Server, timeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	log.Printf("Received %v, shutting down\n", <-signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Fatalf("Shutdown failed, the last sets may not be persisted: %v\n", err)
 	}
+	os.Exit(0)
 }
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"log"
+)
+
+// The outcome of a request sent without waiting for its response. The async
+// calls write their request before returning, so a caller can have thousands in
+// flight on one connection and collect the answers afterwards
+type Future struct {
+	done   chan struct{}
+	result int
+	value  []byte
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+func (f *Future) complete(result int, value []byte) {
+	f.result, f.value = result, value
+	close(f.done)
+}
+
+// Closed once the response is in
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Blocks until the response is in and returns what Get or Set would have
+func (f *Future) Wait() (int, string) {
+	result, value := f.WaitBytes()
+	return result, string(value)
+}
+
+func (f *Future) WaitBytes() (int, []byte) {
+	<-f.done
+	return f.result, f.value
+}
+
+func (c *Client) GetAsync(key string) *Future {
+	return c.GetAsyncContext(context.Background(), key)
+}
+
+func (c *Client) SetAsync(key string, value string) *Future {
+	return c.SetAsyncContext(context.Background(), key, value)
+}
+
+func (c *Client) GetAsyncContext(ctx context.Context, key string) *Future {
+	f := newFuture()
+	if result, value, hit := c.cached(key); hit {
+		// The cache keeps its own, the caller may change this one
+		f.complete(result, append([]byte(nil), value...))
+		return f
+	}
+	if c.replicas != nil {
+		// The replica may send us on to the leader, so only that first ask could go out now
+		go func() {
+			f.complete(c.GetBytesContext(ctx, []byte(key)))
+		}()
+		return f
+	}
+
+	id, call, err := c.sendGet(ctx, []byte(key), 0)
+	go func() {
+		var value bytes.Buffer
+		result, written := -1, false
+		if err == nil {
+			result, written, err = c.receiveGet(ctx, id, call, &value)
+		}
+		if result, err = c.retryGet(ctx, []byte(key), &value, result, written, err); err != nil {
+			log.Printf("Error receiving value: %v\n", err)
+			f.complete(-1, nil)
+			return
+		}
+		f.complete(result, value.Bytes())
+	}()
+	return f
+}
+
+// Large values are all written before this returns, only the answer is waited for later
+func (c *Client) SetAsyncContext(ctx context.Context, key string, value string) *Future {
+	f := newFuture()
+	id := c.nextId()
+	call, err := c.sendSet(ctx, id, []byte(key), chunks([]byte(value)))
+	go func() {
+		result, old := -1, []byte(nil)
+		if err == nil {
+			result, old, err = c.receiveSet(ctx, id, call)
+		}
+		f.complete(c.retrySet(ctx, id, []byte(key), []byte(value), result, old, err))
+	}()
+	return f
+}
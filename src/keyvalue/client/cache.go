@@ -0,0 +1,105 @@
+package client
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Answers to recent gets, kept coherent by the invalidations servers push once a
+// key read on a connection is written, see protobuf.FeatureInvalidate. Entries are
+// filled in by run as responses arrive, so an invalidation sent after a response
+// is always applied after it. Every entry also expires after a lease so a missed
+// invalidation can't keep a stale value around for long, and entries read on a
+// connection go with it since nobody tracks them for us any more.
+type nearCache struct {
+	lock    sync.Mutex
+	size    int
+	lease   time.Duration
+	entries map[string]*list.Element
+	recent  *list.List // Of *cacheEntry, most recently used first
+}
+
+type cacheEntry struct {
+	key      string
+	result   int
+	value    []byte
+	expires  time.Time
+	sequence uint64      // Last write the server had applied when it was read
+	conn     *connection // Read on this one
+}
+
+func newNearCache(size int, lease time.Duration) *nearCache {
+	return &nearCache{
+		size:    size,
+		lease:   lease,
+		entries: make(map[string]*list.Element),
+		recent:  list.New(),
+	}
+}
+
+// Entries read before the server applied write since are missed, see ReadYourWrites
+func (n *nearCache) get(key string, since uint64) (int, []byte, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	element, present := n.entries[key]
+	if !present {
+		return -1, nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		n.remove(element)
+		return -1, nil, false
+	}
+	if entry.sequence < since {
+		// Kept for now, the answer to the get it falls through to replaces it
+		return -1, nil, false
+	}
+	n.recent.MoveToFront(element)
+	return entry.result, entry.value, true
+}
+
+// Answers to gets racing on different connections may arrive in either order,
+// the one read later by the server wins
+func (n *nearCache) put(key string, result int, value []byte, sequence uint64, conn *connection) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if element, present := n.entries[key]; present {
+		if element.Value.(*cacheEntry).sequence > sequence {
+			return
+		}
+		n.remove(element)
+	}
+	entry := &cacheEntry{key: key, result: result, value: value, expires: time.Now().Add(n.lease), sequence: sequence, conn: conn}
+	n.entries[key] = n.recent.PushFront(entry)
+	if n.recent.Len() > n.size {
+		n.remove(n.recent.Back())
+	}
+}
+
+func (n *nearCache) invalidate(key string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if element, present := n.entries[key]; present {
+		n.remove(element)
+	}
+}
+
+// Drops everything read on conn
+func (n *nearCache) forget(conn *connection) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for element := n.recent.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*cacheEntry).conn == conn {
+			n.remove(element)
+		}
+		element = next
+	}
+}
+
+// Under lock
+func (n *nearCache) remove(element *list.Element) {
+	delete(n.entries, element.Value.(*cacheEntry).key)
+	n.recent.Remove(element)
+}
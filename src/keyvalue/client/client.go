@@ -3,169 +3,1211 @@ package client
 import (
 	"keyvalue/protobuf"
 
-	//"crypto/sha256"
-	"encoding/binary"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"log"
-	"math/rand"
+	mathrand "math/rand"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"code.google.com/p/goprotobuf/proto"
 )
 
 const MaxUInt16 uint = uint(^uint16(0))
 
+// A replica answered with the address of its leader instead
+type redirectError struct {
+	leader  string
+	message string
+}
+
+func (e *redirectError) Error() string {
+	return fmt.Sprintf("redirected to leader '%s': %s", e.leader, e.message)
+}
+
+var (
+	errConnectionLost = errors.New("connection lost before the whole response arrived")
+	errNotConnected   = errors.New("not connected to the server")
+	errSetUncertain   = errors.New("connection lost before the set was answered, it may or may not have been applied")
+	errBusy           = errors.New("server busy, try again later")
+)
+
+// Features the client offers servers in the handshake
+var Features = []string{protobuf.FeatureAbort}
+
+// What happens to requests in flight when the connection drops
+type RetryPolicy int
+
+const (
+	FailInFlight  RetryPolicy = iota // They return -1
+	RetryInFlight                    // They're sent again once reconnected, sets only to servers that deduplicate them
+)
+
+type Config struct {
+	Server       string   // Address in the form host:port
+	Servers      []string // More addresses of the same deployment to fail over to, tried after Server
+	MaxFrameSize uint32   // Largest message sent or accepted, defaults to protobuf.DefaultMaxFrameSize
+	TLS          bool     // Connect over TLS, implied by any of the files below
+	CAFile       string   // Verify the server against this CA instead of the system roots
+	CertFile     string   // Certificate and key presented to servers requiring mutual TLS
+	KeyFile      string
+	Username     string // Authenticate with a username and password or a token, for servers with an ACL
+	Password     string
+	Token        string
+	Compress     bool // Ask the server to deflate large values on the wire, see protobuf.FeatureDeflate
+
+	Reconnect  bool          // Dial again when the connection drops, implied by RetryInFlight
+	Retry      RetryPolicy   // Requests in flight when the connection drops fail by default
+	MaxRetries int           // Times a request is sent again with RetryInFlight, defaults to 3
+	MinBackoff time.Duration // Wait before dialing again, doubled after every failure, defaults to 50ms
+	MaxBackoff time.Duration // Longest wait between dials, defaults to 5s
+
+	DialTimeout time.Duration // Longest to wait for a connection and then for the server's hello, defaults to 10s
+
+	PoolSize       int           // Most connections open at once, another is dialed while all are busy. Defaults to 1
+	IdleTimeout    time.Duration // Connections beyond the first unused this long are closed, defaults to a minute
+	HealthInterval time.Duration // Ping every connection this often and drop those that don't answer in time, 0 never does
+
+	ReadStaleness time.Duration // Send gets to a replica while it is at most this far behind its leader, 0 sends them to the leader
+
+	ReadYourWrites bool // Gets wait until the server has applied every write we've seen, ours included. Turns off ReadStaleness
+
+	NearCache  int           // Keep the answers to this many recent gets, see cache.go. 0 disables the cache
+	CacheLease time.Duration // Longest an answer is kept without hearing it changed, defaults to 10s
+}
+
 type Client struct {
-	Host     string
-	Port     uint16
-	conn     net.Conn
-	connLock sync.Mutex // Don't let multiple go routines write to the connection at once
-	pending  map[string]chan protobuf.Response
+	lastId uint64 // Updated atomically so must stay 64-bit aligned
+	seen   uint64 // Highest sequence in any response, also atomic. See ReadYourWrites
+
+	Host         string // Of the first server given
+	Port         uint16
+	MaxFrameSize uint32
+	config       Config
+	endpoints    []string                // Every server we know of, replicas' leaders are added as they're found
+	target       int                     // Endpoint dialed first, the leader as far as we know, under pendingLock
+	readOnly     bool                    // Happy to be connected to a replica, only true of replicas
+	replicas     *Client                 // Gets within ReadStaleness go here first, nil without it
+	cache        *nearCache              // Nil without NearCache
+	tlsConfig    *tls.Config             // Nil without TLS
+	offered      []string                // Features offered in every handshake
+	credentials  *protobuf.Credentials   // Sent in every handshake, nil for anonymous
+	session      string                  // Names us to servers deduplicating sets across connections
+	conns        []*connection           // Open connections, empty while disconnected, under pendingLock
+	dialing      bool                    // Another connection is being dialed for the pool, under pendingLock
+	reconnecting bool                    // Under pendingLock
+	pending      map[string]*pendingCall // Requests waiting for their response on any connection, by id
+	pendingLock  sync.Mutex
+	up           chan struct{} // Closed while connected, replaced when the last connection drops
+	done         chan struct{} // Closed by Close
+	shutdown     bool          // Set by Close, under pendingLock
+}
+
+// One connection to the server and what was agreed on it in the handshake
+type connection struct {
+	conn      net.Conn
+	endpoint  string          // Address dialed
+	leader    string          // Set if the server said it is a replica of this leader
+	frameSize uint32          // Largest frame we may send, the smaller of ours and the server's
+	features  map[string]bool // Negotiated in the handshake
+	writeLock sync.Mutex      // Don't let multiple go routines write to the connection at once
+	inflight  int             // Requests waiting for their response on it, under pendingLock
+	lastUsed  time.Time       // Last picked for a request, under pendingLock
+	dropped   bool            // Taken out of the pool, under pendingLock
+}
+
+// A request waiting for its response
+type pendingCall struct {
+	conn      *connection // The request was sent on this one
+	responses chan protobuf.Response
+	abandoned chan struct{} // Closed when the caller stops waiting, see forget
+	cacheKey  string        // Set for gets whose answer goes in the near cache
+	chunks    int           // Responses seen so far, only touched by run
 }
 
 func Init(server string) (int, *Client) {
+	return InitConfig(Config{Server: server})
+}
+
+func InitConfig(config Config) (int, *Client) {
+	client := newClient(config)
+	if client == nil {
+		return -1, nil
+	}
+	if !client.start() {
+		client.Close()
+		return -1, nil
+	}
+
+	if config.ReadStaleness > 0 && !config.ReadYourWrites {
+		// Only gets go to replicas and they're never retried there, the leader is the fallback
+		replicaConfig := config
+		replicaConfig.ReadStaleness = 0
+		replicaConfig.Retry = FailInFlight
+		replicaConfig.Reconnect = true
+		replicaConfig.NearCache = 0
+		replicas := newClient(replicaConfig)
+		replicas.readOnly = true
+		if !replicas.start() {
+			log.Println("No replica to read from yet, gets go to the leader meanwhile")
+			replicas.pendingLock.Lock()
+			replicas.startReconnect()
+			replicas.pendingLock.Unlock()
+		}
+		client.replicas = replicas
+	}
+
+	return 0, client
+}
+
+// Host and port of a server address, false if it isn't one
+func splitEndpoint(server string) (string, uint16, bool) {
 	split := strings.Split(server, ":")
 	if len(split) != 2 {
 		log.Printf("Server given '%s' must be in format 'host:port'\n", server)
-		return -1, nil
+		return "", 0, false
 	}
 	host := split[0]
 
 	port, err := strconv.Atoi(split[1])
 	if err != nil {
 		log.Printf("Port given '%s' is not a number: %v\n", split[1], err)
-		return -1, nil
+		return "", 0, false
 	}
 
 	if uint(port) > MaxUInt16 {
-		log.Printf("Port given '%u' is too large\n", split[1])
-		return -1, nil
+		log.Printf("Port given '%s' is too large\n", split[1])
+		return "", 0, false
 	}
+	return host, uint16(port), true
+}
 
-	conn, err := net.Dial("tcp", server)
+// A client set up from config but not connected yet, nil if config is bad
+func newClient(config Config) *Client {
+	client := &Client{
+		MaxFrameSize: config.MaxFrameSize,
+		config:       config,
+		pending:      make(map[string]*pendingCall),
+		up:           make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	for _, server := range append([]string{config.Server}, config.Servers...) {
+		if server == "" || client.endpoint(server) != -1 {
+			continue
+		}
+		if _, _, ok := splitEndpoint(server); !ok {
+			return nil
+		}
+		client.endpoints = append(client.endpoints, server)
+	}
+	if len(client.endpoints) == 0 {
+		log.Println("No server given")
+		return nil
+	}
+	client.Host, client.Port, _ = splitEndpoint(client.endpoints[0])
+
+	if client.MaxFrameSize == 0 {
+		client.MaxFrameSize = protobuf.DefaultMaxFrameSize
+	}
+	if config.Retry == RetryInFlight || len(client.endpoints) > 1 {
+		// Failing over means dialing another server
+		client.config.Reconnect = true
+	}
+	if client.config.MaxRetries == 0 {
+		client.config.MaxRetries = 3
+	}
+	if client.config.MinBackoff == 0 {
+		client.config.MinBackoff = 50 * time.Millisecond
+	}
+	if client.config.MaxBackoff == 0 {
+		client.config.MaxBackoff = 5 * time.Second
+	}
+	if client.config.DialTimeout == 0 {
+		client.config.DialTimeout = 10 * time.Second
+	}
+	if client.config.PoolSize < 1 {
+		client.config.PoolSize = 1
+	}
+	if client.config.IdleTimeout == 0 {
+		client.config.IdleTimeout = time.Minute
+	}
+	if client.config.CacheLease == 0 {
+		client.config.CacheLease = 10 * time.Second
+	}
+
+	if config.TLS || config.CAFile != "" || config.CertFile != "" || config.KeyFile != "" {
+		var err error
+		if client.tlsConfig, err = loadTLS(client.Host, config); err != nil {
+			log.Printf("Could not load TLS configuration: %v\n", err)
+			return nil
+		}
+	}
+	if config.Username != "" || config.Password != "" || config.Token != "" {
+		client.credentials = &protobuf.Credentials{
+			Username: proto.String(config.Username),
+			Password: proto.String(config.Password),
+			Token:    proto.String(config.Token),
+		}
+	}
+	client.offered = append([]string{}, Features...)
+	if config.Compress {
+		client.offered = append(client.offered, protobuf.FeatureDeflate)
+	}
+	if config.NearCache > 0 {
+		client.cache = newNearCache(config.NearCache, client.config.CacheLease)
+		client.offered = append(client.offered, protobuf.FeatureInvalidate)
+	}
+	if config.Retry == RetryInFlight {
+		// Sets can only be retried if the server knows us again on the new connection
+		session := make([]byte, 16)
+		if _, err := rand.Read(session); err != nil {
+			log.Printf("Could not generate session: %v\n", err)
+			return nil
+		}
+		client.session = hex.EncodeToString(session)
+		client.offered = append(client.offered, protobuf.FeatureDedupe)
+	}
+	return client
+}
+
+// Makes the first connection, false if no server would have it
+func (c *Client) start() bool {
+	if c.config.PoolSize > 1 || c.config.HealthInterval > 0 {
+		go c.maintain()
+	}
+	conn := c.connect()
+	if conn == nil {
+		return false
+	}
+	c.connected(conn)
+	return true
+}
+
+// Index of the endpoint, -1 if we don't know it. Under pendingLock once connected
+func (c *Client) endpoint(server string) int {
+	for i, endpoint := range c.endpoints {
+		if endpoint == server {
+			return i
+		}
+	}
+	return -1
+}
+
+// Makes server the endpoint dialed first, under pendingLock
+func (c *Client) setTarget(server string) {
+	c.target = c.endpoint(server)
+	if c.target == -1 {
+		c.target = len(c.endpoints)
+		c.endpoints = append(c.endpoints, server)
+	}
+}
+
+// Dials the endpoints in turn starting from the target until one shakes hands,
+// and goes on to the leader when that turns out to be a replica. Replicas are
+// only settled for when reading from them, and then they're preferred to leaders.
+// Returns nil if nobody answers
+func (c *Client) connect() *connection {
+	c.pendingLock.Lock()
+	endpoints := append([]string{}, c.endpoints...)
+	target := c.target
+	c.pendingLock.Unlock()
+
+	var fallback *connection
+	for i := range endpoints {
+		conn := c.dial(endpoints[(target+i)%len(endpoints)])
+		if conn == nil {
+			continue
+		}
+		if c.readOnly && conn.leader == "" && i < len(endpoints)-1 {
+			// Keep looking for a replica
+			if fallback == nil {
+				fallback = conn
+			} else {
+				conn.conn.Close()
+			}
+			continue
+		}
+		if !c.readOnly && conn.leader != "" {
+			conn.conn.Close()
+			if conn = c.dial(conn.leader); conn == nil || conn.leader != "" {
+				if conn != nil {
+					log.Printf("Leader '%s' says it is a replica of '%s'\n", conn.endpoint, conn.leader)
+					conn.conn.Close()
+				}
+				continue
+			}
+		}
+		if fallback != nil {
+			fallback.conn.Close()
+		}
+		fallback = conn
+		break
+	}
+	if fallback != nil {
+		c.pendingLock.Lock()
+		c.setTarget(fallback.endpoint)
+		c.pendingLock.Unlock()
+	}
+	return fallback
+}
+
+// Dials the server and shakes hands, returns nil if either fails
+func (c *Client) dial(server string) *connection {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: c.config.DialTimeout}
+	if c.tlsConfig != nil {
+		tlsConfig := c.tlsConfig.Clone()
+		tlsConfig.ServerName = strings.Split(server, ":")[0]
+		conn, err = tls.DialWithDialer(dialer, "tcp", server, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", server)
+	}
 	if err != nil {
 		log.Printf("Cannot connect to '%s' server: %v\n", server, err)
-		return -1, nil
+		return nil
 	}
 
-	client := &Client{
-		Host:     host,
-		Port:     uint16(port),
-		conn:     conn,
-		connLock: sync.Mutex{},
-		pending:  make(map[string]chan protobuf.Response),
+	connection, err := c.handshake(conn)
+	if err != nil {
+		log.Printf("Handshake with '%s' server failed: %v\n", server, err)
+		conn.Close()
+		return nil
+	}
+	connection.endpoint = server
+	return connection
+}
+
+// Agrees on the protocol version, frame sizes and features before any other request
+// is sent, and logs in when given credentials. A server that accepts the connection
+// but never answers is given up on after DialTimeout
+func (c *Client) handshake(conn net.Conn) (*connection, error) {
+	if c.config.DialTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.config.DialTimeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	request := &protobuf.Request{
+		Id: proto.String("hello"),
+		// Version 1 servers need a type to parse the request, they answer a get of the
+		// empty key without a status and newer ones go by op
+		Type:  proto.String("get"),
+		Op:    protobuf.Request_HELLO.Enum(),
+		Key:   []byte{},
+		Hello: protobuf.NewHello(c.offered, c.MaxFrameSize),
+	}
+	request.Hello.Credentials = c.credentials
+	if c.session != "" {
+		request.Hello.Session = proto.String(c.session)
+	}
+	if err := protobuf.WriteFrame(conn, request); err != nil {
+		return nil, err
 	}
 
-	go client.run()
+	// Nothing else is in flight yet so the response can be read straight off the connection
+	response := new(protobuf.Response)
+	if err := protobuf.ReadFrame(conn, c.MaxFrameSize, response); err == io.EOF {
+		// What a server too old to parse the hello does
+		return nil, fmt.Errorf("server closed the connection after the hello, it may speak protocol version 1 but client needs at least %d", protobuf.MinProtocolVersion)
+	} else if err != nil {
+		return nil, err
+	}
+	hello := response.GetHello()
+	switch code := response.GetStatus().GetCode(); {
+	case response.GetStatus() == nil || code == protobuf.Status_UNKNOWN_OPERATION:
+		return nil, fmt.Errorf("server speaks protocol version 1, client needs at least %d", protobuf.MinProtocolVersion)
+	case code != protobuf.Status_OK:
+		return nil, fmt.Errorf("%v: %s", code, response.GetStatus().GetMessage())
+	case !protobuf.SupportedVersion(hello.GetVersion()):
+		return nil, fmt.Errorf("server speaks protocol version %d, client supports %d to %d",
+			hello.GetVersion(), protobuf.MinProtocolVersion, protobuf.ProtocolVersion)
+	}
 
-	return 0, client
+	return &connection{
+		conn:      conn,
+		leader:    hello.GetLeader(),
+		frameSize: protobuf.PeerFrameSize(c.MaxFrameSize, hello),
+		features:  protobuf.Negotiate(c.offered, hello.GetFeatures()),
+	}, nil
+}
+
+// Adds conn to the pool unless the client was closed or the pool filled up meanwhile
+func (c *Client) connected(conn *connection) {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	if c.shutdown || len(c.conns) >= c.config.PoolSize {
+		conn.conn.Close()
+		return
+	}
+	conn.lastUsed = time.Now()
+	c.conns = append(c.conns, conn)
+	if len(c.conns) == 1 {
+		close(c.up)
+	}
+	go c.run(conn)
+}
+
+// The connection with the fewest requests in flight, nil while disconnected.
+// Another is dialed in the background when even that one is busy and the pool has room
+func (c *Client) pick() *connection {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	var best *connection
+	for _, conn := range c.conns {
+		if best == nil || conn.inflight < best.inflight {
+			best = conn
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	best.lastUsed = time.Now()
+	if best.inflight > 0 && len(c.conns) < c.config.PoolSize && !c.dialing && !c.shutdown {
+		c.dialing = true
+		go c.grow()
+	}
+	return best
+}
+
+func (c *Client) grow() {
+	if conn := c.connect(); conn != nil {
+		c.connected(conn)
+	}
+	c.pendingLock.Lock()
+	c.dialing = false
+	c.pendingLock.Unlock()
+}
+
+// Whether both sides agreed on the feature in the handshake, false while disconnected
+func (c *Client) HasFeature(feature string) bool {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	return len(c.conns) > 0 && c.conns[0].features[feature]
 }
 
-func (c *Client) run() {
+func (c *Client) run(conn *connection) {
+	defer c.fail(conn)
+	reader := bufio.NewReader(conn.conn)
 	for {
-		data := make([]byte, 4)
-		_, err := c.conn.Read(data)
-		if err != nil {
-			log.Printf("Error reading length: %v", err)
-		}
-		length := int(binary.BigEndian.Uint32(data))
-		data = make([]byte, length)
-		for i := 0; i < length; {
-			//Read the data waiting on the connection and put it in the data buffer
-			n, err := c.conn.Read(data[i : length-i])
-			i += n
+		response := new(protobuf.Response)
+		if err := protobuf.ReadFrame(reader, c.MaxFrameSize, response); err != nil {
+			log.Printf("Error reading response: %v\n", err)
+			return
+		}
+		if response.GetCompressed() {
+			value, err := protobuf.Inflate(response.GetValue(), int(c.MaxFrameSize))
 			if err != nil {
-				log.Printf("Error reading request: %v", err)
-				break
+				log.Printf("Error inflating value of response %s: %v\n", response.GetId(), err)
+				return
 			}
+			response.Value, response.Compressed = value, nil
 		}
 
-		response := new(protobuf.Response)
-		err = proto.Unmarshal(data, response)
-		if err != nil {
-			log.Fatal("Unmarshaling error: ", err)
+		if response.GetId() == protobuf.InvalidateId && c.cache != nil {
+			for _, key := range response.GetInvalidate() {
+				c.cache.invalidate(string(key))
+			}
+			continue
+		}
+
+		// Large values arrive as several chunks, the call is done after the last one
+		id := response.GetId()
+		c.pendingLock.Lock()
+		call, present := c.pending[id]
+		if present && !response.GetMore() {
+			delete(c.pending, id)
+			conn.inflight--
+		}
+		c.pendingLock.Unlock()
+		if sequence := response.GetSequence(); sequence > 0 {
+			c.see(sequence)
+		}
+		if !present {
+			// The caller gave up on it
+			continue
+		}
+		if call.cacheKey != "" && call.chunks == 0 && !response.GetMore() {
+			// Before the next frame is read, so an invalidation after it always finds it
+			if code := response.GetStatus().GetCode(); code == protobuf.Status_OK || code == protobuf.Status_NOT_FOUND {
+				c.cache.put(call.cacheKey, responseResult(response), response.GetValue(), response.GetSequence(), conn)
+			}
+		}
+		call.chunks++
+
+		// Only this goroutine sends and closes responses, so they're never closed twice
+		select {
+		case call.responses <- *response:
+		case <-call.abandoned:
+		}
+		if !response.GetMore() {
+			close(call.responses)
+		}
+	}
+}
+
+// Wakes every request still waiting on conn once it is gone, they end without a
+// final response. Only run calls this, so responses are never closed while it sends on them
+func (c *Client) fail(conn *connection) {
+	conn.conn.Close()
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	c.remove(conn)
+	for id, call := range c.pending {
+		if call.conn == conn {
+			close(call.responses)
+			delete(c.pending, id)
+		}
+	}
+	conn.inflight = 0
+}
+
+// Closes conn and takes it out of the pool, its run then fails what was in flight
+func (c *Client) drop(conn *connection) {
+	conn.conn.Close()
+	c.pendingLock.Lock()
+	c.remove(conn)
+	c.pendingLock.Unlock()
+}
+
+// Under pendingLock. Once the last connection is gone it is dialed again in the
+// background unless told not to
+func (c *Client) remove(conn *connection) {
+	if conn.dropped {
+		return
+	}
+	conn.dropped = true
+	if c.cache != nil {
+		// Nobody will tell us when these change any more
+		c.cache.forget(conn)
+	}
+	for i, other := range c.conns {
+		if other == conn {
+			c.conns = append(c.conns[:i], c.conns[i+1:]...)
+			break
+		}
+	}
+	if len(c.conns) > 0 {
+		return
+	}
+	c.up = make(chan struct{})
+	if c.config.Reconnect {
+		log.Printf("Lost connection to '%s' server, reconnecting\n", conn.endpoint)
+		c.startReconnect()
+	}
+}
+
+// Under pendingLock, at most one reconnect runs at a time
+func (c *Client) startReconnect() {
+	if !c.reconnecting && !c.shutdown {
+		c.reconnecting = true
+		go c.reconnect()
+	}
+}
+
+// Sends every later request to leader, dropping the connections to anywhere else
+func (c *Client) follow(leader string) {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	if c.endpoint(leader) != c.target {
+		log.Printf("Following redirect to leader '%s'\n", leader)
+	}
+	c.setTarget(leader)
+	for _, conn := range append([]*connection{}, c.conns...) {
+		if conn.endpoint != leader {
+			conn.conn.Close()
+			c.remove(conn)
+		}
+	}
+	if len(c.conns) == 0 {
+		c.startReconnect()
+	}
+}
+
+// Dials until it gets through or the client is closed, waiting twice as long after every failure
+func (c *Client) reconnect() {
+	backoff := c.config.MinBackoff
+	for {
+		// Jittered so clients dropped together don't all come back at once
+		wait := backoff/2 + time.Duration(mathrand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-c.done:
+			return
+		case <-time.After(wait):
+		}
+		if conn := c.connect(); conn != nil {
+			c.pendingLock.Lock()
+			c.reconnecting = false
+			c.pendingLock.Unlock()
+			c.connected(conn)
+			return
+		}
+		if backoff *= 2; backoff > c.config.MaxBackoff {
+			backoff = c.config.MaxBackoff
 		}
-		callback := c.pending[response.GetId()]
-		callback <- *response
-		close(callback)
-		delete(c.pending, response.GetId())
 	}
 }
 
-// No entropy added with hashing here, could just send random int instead
-func randomId() string {
-	random := rand.Int()
-	//randomBytes := make([]byte, 4)
-	//binary.BigEndian.PutUint32(randomBytes, random)
-	//hash := sha256.Sum256(randomBytes)
-	return string(strconv.Itoa(random))
+// Whether to send a request again after it failed with err on attempt, waiting to
+// be reconnected first. Requests lost to the connection are retried if the policy
+// says so, and redirected ones always are since the replica didn't apply them.
+// So are ones the server was too busy for, after backing off
+func (c *Client) retry(ctx context.Context, attempt int, err error) bool {
+	if attempt >= c.config.MaxRetries {
+		return false
+	}
+	if err == errBusy {
+		return c.backoff(ctx, attempt)
+	}
+	if redirect, redirected := err.(*redirectError); redirected {
+		c.follow(redirect.leader)
+	} else if err != errConnectionLost && err != errNotConnected || c.config.Retry != RetryInFlight {
+		return false
+	}
+	c.pendingLock.Lock()
+	up := c.up
+	c.pendingLock.Unlock()
+	select {
+	case <-up:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-c.done:
+		return false
+	}
 }
 
-func (c *Client) write(request *protobuf.Request) chan protobuf.Response {
-	data, err := proto.Marshal(request)
+// Waits MinBackoff doubled attempt times, at most MaxBackoff and jittered like
+// reconnect. False if ctx or the client is done first
+func (c *Client) backoff(ctx context.Context, attempt int) bool {
+	backoff := c.config.MinBackoff
+	for i := 0; i < attempt && backoff < c.config.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > c.config.MaxBackoff {
+		backoff = c.config.MaxBackoff
+	}
+	timer := time.NewTimer(backoff/2 + time.Duration(mathrand.Int63n(int64(backoff/2)+1)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-c.done:
+		return false
+	}
+}
+
+// Closes connections beyond the first that have been idle too long, and pings
+// the rest every HealthInterval dropping those that don't answer before the next
+func (c *Client) maintain() {
+	period := c.config.HealthInterval
+	if c.config.PoolSize > 1 && (period == 0 || c.config.IdleTimeout/2 < period) {
+		period = c.config.IdleTimeout / 2
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	var pinged time.Time
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.pendingLock.Lock()
+		conns := append([]*connection{}, c.conns...)
+		for i, conn := range conns {
+			if i > 0 && conn.inflight == 0 && time.Since(conn.lastUsed) > c.config.IdleTimeout {
+				c.remove(conn)
+				conn.conn.Close()
+			}
+		}
+		conns = append(conns[:0], c.conns...)
+		c.pendingLock.Unlock()
+
+		if c.config.HealthInterval > 0 && time.Since(pinged) >= c.config.HealthInterval {
+			pinged = time.Now()
+			for _, conn := range conns {
+				go c.ping(conn)
+			}
+		}
+	}
+}
+
+func (c *Client) ping(conn *connection) {
+	request := new(protobuf.Request)
+	request.Id = proto.String(c.nextId())
+	request.Op = protobuf.Request_PING.Enum()
+	request.Key = []byte{}
+	call, err := c.write(conn, request)
 	if err != nil {
-		log.Printf("Marshaling error: %v\n", err)
-		return nil
+		// Already gone
+		return
+	}
+	timer := time.NewTimer(c.config.HealthInterval)
+	defer timer.Stop()
+	select {
+	case <-call.responses:
+		// Any answer will do, old servers don't know the operation
+	case <-timer.C:
+		log.Printf("Connection to '%s' server did not answer a ping in %v, dropping it\n", conn.endpoint, c.config.HealthInterval)
+		c.forget(request.GetId(), call)
+		c.drop(conn)
+	}
+}
+
+// Ids only have to be unique among the requests of one session
+func (c *Client) nextId() string {
+	return strconv.FormatUint(atomic.AddUint64(&c.lastId, 1), 10)
+}
+
+// Sends the request on conn and returns the call its responses arrive on
+func (c *Client) write(conn *connection, request *protobuf.Request) (*pendingCall, error) {
+	// Registered before sending so a fast response always finds it.
+	// Buffered so a slow reader of a chunked value doesn't stall other responses as much
+	call := &pendingCall{
+		conn:      conn,
+		responses: make(chan protobuf.Response, 16),
+		abandoned: make(chan struct{}),
+	}
+	if c.cache != nil && conn != nil && conn.features[protobuf.FeatureInvalidate] &&
+		request.GetOp() == protobuf.Request_GET && request.MaxStaleness == nil {
+		// Only whole values the server promised to tell us about
+		call.cacheKey = string(request.GetKey())
+	}
+	id := request.GetId()
+	c.pendingLock.Lock()
+	if c.shutdown || conn == nil || conn.dropped {
+		// Dropped since the caller picked it
+		c.pendingLock.Unlock()
+		return nil, errNotConnected
 	}
+	c.pending[id] = call
+	conn.inflight++
+	c.pendingLock.Unlock()
 
-	length := len(data)
-	lengthBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(lengthBytes, uint32(length))
+	if err := c.writeFrame(conn, request); err != nil {
+		c.forget(id, call)
+		return nil, err
+	}
+	return call, nil
+}
 
+// A failed write drops the connection straight away so nothing more is sent on
+// it, and what was sent is as good as lost
+func (c *Client) writeFrame(conn *connection, request *protobuf.Request) error {
 	// Guarantee squential write of length then protobuf on stream
-	c.connLock.Lock()
-	defer c.connLock.Unlock()
-	_, err = c.conn.Write(lengthBytes)
-	if err != nil {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	if err := protobuf.WriteFrame(conn.conn, request); err != nil {
 		log.Printf("Error writing data: %v\n", err)
+		c.drop(conn)
+		return errConnectionLost
+	}
+	return nil
+}
+
+// Stops waiting for a request, any responses still to come are dropped
+func (c *Client) forget(id string, call *pendingCall) {
+	c.pendingLock.Lock()
+	if c.pending[id] == call {
+		delete(c.pending, id)
+		call.conn.inflight--
+	}
+	c.pendingLock.Unlock()
+	close(call.abandoned)
+}
+
+// Milliseconds left until the deadline of ctx for the server to give up at, nil without one
+func timeout(ctx context.Context) *uint32 {
+	deadline, present := ctx.Deadline()
+	if !present {
 		return nil
 	}
-	_, err = c.conn.Write(data)
+	// Rounded up, zero would mean no timeout at all
+	left := (time.Until(deadline) + time.Millisecond - 1) / time.Millisecond
+	if left < 1 {
+		left = 1
+	}
+	return proto.Uint32(uint32(left))
+}
+
+func (c *Client) Get(key string) (int, string) {
+	return c.GetContext(context.Background(), key)
+}
+
+func (c *Client) Set(key string, value string) (int, string) {
+	return c.SetContext(context.Background(), key, value)
+}
+
+func (c *Client) GetBytes(key []byte) (int, []byte) {
+	return c.GetBytesContext(context.Background(), key)
+}
+
+func (c *Client) SetBytes(key []byte, value []byte) (int, []byte) {
+	return c.SetBytesContext(context.Background(), key, value)
+}
+
+// Streams the value of key into w as its chunks arrive rather than holding it all in memory
+func (c *Client) GetWriter(key []byte, w io.Writer) (int, error) {
+	return c.GetWriterContext(context.Background(), key, w)
+}
+
+// Streams the value for key from r to the server in chunks that fit the frame size agreed in the handshake
+func (c *Client) SetReader(key []byte, r io.Reader) (int, []byte) {
+	return c.SetReaderContext(context.Background(), key, r)
+}
+
+// The context variants give up with -1 once ctx is done and pass its deadline on
+// to the server, which drops requests it couldn't get to in time
+func (c *Client) GetContext(ctx context.Context, key string) (int, string) {
+	result, value := c.GetBytesContext(ctx, []byte(key))
+	return result, string(value)
+}
+
+func (c *Client) SetContext(ctx context.Context, key string, value string) (int, string) {
+	result, old := c.SetBytesContext(ctx, []byte(key), []byte(value))
+	return result, string(old)
+}
+
+func (c *Client) GetBytesContext(ctx context.Context, key []byte) (int, []byte) {
+	var value bytes.Buffer
+	result, err := c.GetWriterContext(ctx, key, &value)
 	if err != nil {
-		log.Printf("Error writing data: %v\n", err)
-		return nil
+		log.Printf("Error receiving value: %v\n", err)
+		return -1, nil
 	}
+	return result, value.Bytes()
+}
 
-	callback := make(chan protobuf.Response)
-	c.pending[request.GetId()] = callback
-	return callback
+func (c *Client) SetBytesContext(ctx context.Context, key []byte, value []byte) (int, []byte) {
+	id := c.nextId()
+	result, old, err := c.upload(ctx, id, key, chunks(value))
+	return c.retrySet(ctx, id, key, value, result, old, err)
 }
 
-func (c *Client) Get(key string) (int, string) {
-	request := new(protobuf.Request)
-	request.Id = proto.String(randomId())
-	request.Type = proto.String("get")
-	request.Key = proto.String(key)
+// Sends the set again while the last attempt failed in a way that can be retried.
+// The same id on every attempt lets the server recognise a set it already applied
+func (c *Client) retrySet(ctx context.Context, id string, key []byte, value []byte, result int, old []byte, err error) (int, []byte) {
+	for attempt := 0; err != nil && c.retry(ctx, attempt, err); attempt++ {
+		result, old, err = c.upload(ctx, id, key, chunks(value))
+	}
+	if err != nil {
+		log.Printf("Error setting value: %v\n", err)
+	}
+	return result, old
+}
 
-	callback := c.write(request)
-	if callback == nil {
-		return -1, ""
+// Hands out value a frame at a time for upload
+func chunks(value []byte) func(int) ([]byte, bool, error) {
+	return func(size int) ([]byte, bool, error) {
+		if size > len(value) {
+			size = len(value)
+		}
+		chunk := value[:size]
+		value = value[size:]
+		return chunk, len(value) == 0, nil
 	}
+}
 
-	// Block on callback
-	response := <-callback
-	return int(response.GetResult()), response.GetValue()
+func (c *Client) GetWriterContext(ctx context.Context, key []byte, w io.Writer) (int, error) {
+	if result, value, hit := c.cached(string(key)); hit {
+		_, err := w.Write(value)
+		return result, err
+	}
+	if c.replicas != nil {
+		// A replica too far behind or gone sends us on to the leader
+		result, written, err := c.replicas.get(ctx, key, w, c.config.ReadStaleness)
+		if err == nil || written || ctx.Err() != nil {
+			return result, err
+		}
+	}
+	result, written, err := c.get(ctx, key, w, 0)
+	return c.retryGet(ctx, key, w, result, written, err)
 }
 
-func (c *Client) Set(key string, value string) (int, string) {
+// Sends the get to the leader again while the last attempt failed in a way that
+// can be retried. Only if none of the value was written yet, w can't take it back
+func (c *Client) retryGet(ctx context.Context, key []byte, w io.Writer, result int, written bool, err error) (int, error) {
+	for attempt := 0; err != nil && !written && c.retry(ctx, attempt, err); attempt++ {
+		result, written, err = c.get(ctx, key, w, 0)
+	}
+	return result, err
+}
+
+// One attempt at a get, reports whether any of the value was written to w. Replicas
+// answer it if they're at most staleness behind their leader
+func (c *Client) get(ctx context.Context, key []byte, w io.Writer, staleness time.Duration) (int, bool, error) {
+	id, call, err := c.sendGet(ctx, key, staleness)
+	if err != nil {
+		return -1, false, err
+	}
+	return c.receiveGet(ctx, id, call, w)
+}
+
+// Answers a get from the near cache when it has the key. With ReadYourWrites the
+// entry must have been read after every write we've seen
+func (c *Client) cached(key string) (int, []byte, bool) {
+	if c.cache == nil {
+		return -1, nil, false
+	}
+	var since uint64
+	if c.config.ReadYourWrites {
+		since = atomic.LoadUint64(&c.seen)
+	}
+	return c.cache.get(key, since)
+}
+
+// Raises seen to sequence unless it's already past it
+func (c *Client) see(sequence uint64) {
+	for {
+		seen := atomic.LoadUint64(&c.seen)
+		if sequence <= seen || atomic.CompareAndSwapUint64(&c.seen, seen, sequence) {
+			return
+		}
+	}
+}
+
+func (c *Client) sendGet(ctx context.Context, key []byte, staleness time.Duration) (string, *pendingCall, error) {
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
 	request := new(protobuf.Request)
-	request.Id = proto.String(randomId())
-	request.Type = proto.String("set")
-	request.Key = proto.String(key)
-	request.Value = proto.String(value)
+	request.Id = proto.String(c.nextId())
+	request.Op = protobuf.Request_GET.Enum()
+	request.Key = nonNil(key)
+	request.Timeout = timeout(ctx)
+	if staleness > 0 {
+		request.MaxStaleness = proto.Uint32(uint32((staleness + time.Millisecond - 1) / time.Millisecond))
+	}
+	if c.config.ReadYourWrites {
+		if seen := atomic.LoadUint64(&c.seen); seen > 0 {
+			request.MinSequence = proto.Uint64(seen)
+		}
+	}
+
+	call, err := c.write(c.pick(), request)
+	return request.GetId(), call, err
+}
+
+func (c *Client) receiveGet(ctx context.Context, id string, call *pendingCall, w io.Writer) (int, bool, error) {
+	// Block on the call, draining every chunk even if w fails so the connection keeps moving
+	var err error
+	written := false
+	result, lost := c.receive(ctx, id, call, func(response *protobuf.Response) {
+		if err == nil && len(response.GetValue()) > 0 {
+			written = true
+			_, err = w.Write(response.GetValue())
+		}
+	})
+	if err == nil {
+		err = lost
+	}
+	return result, written, err
+}
+
+// Not retried, what was read from r is gone
+func (c *Client) SetReaderContext(ctx context.Context, key []byte, r io.Reader) (int, []byte) {
+	var buffer []byte
+	result, old, err := c.upload(ctx, c.nextId(), key, func(size int) ([]byte, bool, error) {
+		if buffer == nil {
+			buffer = make([]byte, size)
+		}
+		n, err := io.ReadFull(r, buffer)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return buffer[:n], true, nil
+		}
+		return buffer[:n], false, err
+	})
+	if redirect, redirected := err.(*redirectError); redirected {
+		c.follow(redirect.leader)
+	}
+	if err != nil {
+		log.Printf("Error setting value: %v\n", err)
+	}
+	return result, old
+}
+
+// Sends a set whose value is produced chunk by chunk by next, which is given
+// the most bytes that fit in a frame and reports when it returns the last chunk
+func (c *Client) upload(ctx context.Context, id string, key []byte, next func(int) ([]byte, bool, error)) (int, []byte, error) {
+	call, err := c.sendSet(ctx, id, key, next)
+	if err != nil {
+		return -1, nil, err
+	}
+	return c.receiveSet(ctx, id, call)
+}
+
+func (c *Client) sendSet(ctx context.Context, id string, key []byte, next func(int) ([]byte, bool, error)) (*pendingCall, error) {
+	if c.cache != nil {
+		// The server tells us too but only once it's applied, we may read it back before then
+		c.cache.invalidate(string(key))
+	}
+	conn := c.pick()
+	if conn == nil {
+		return nil, errNotConnected
+	}
+	size := protobuf.ChunkSize(conn.frameSize, id, key)
+	if size < 1 {
+		return nil, fmt.Errorf("key of %d bytes does not fit in a frame of %d bytes", len(key), conn.frameSize)
+	}
+
+	var call *pendingCall
+	for last := false; !last; {
+		if err := ctx.Err(); err != nil {
+			if call != nil {
+				c.abandon(conn, id, call)
+			}
+			return nil, fmt.Errorf("gave up sending value: %v", err)
+		}
+		chunk, end, err := next(size)
+		if err != nil {
+			if call != nil {
+				c.abandon(conn, id, call)
+			}
+			return nil, fmt.Errorf("error reading value: %v", err)
+		}
+		last = end
+
+		request := new(protobuf.Request)
+		request.Id = proto.String(id)
+		request.Op = protobuf.Request_SET.Enum()
+		request.Key = nonNil(key)
+		request.Value = nonNil(chunk)
+		request.Timeout = timeout(ctx)
+		if conn.features[protobuf.FeatureDeflate] {
+			if deflated, compressed := protobuf.Deflate(chunk); compressed {
+				request.Value, request.Compressed = deflated, proto.Bool(true)
+			}
+		}
+		if !last {
+			request.More = proto.Bool(true)
+		}
+
+		// The server only answers once the last chunk arrives
+		if call == nil {
+			if call, err = c.write(conn, request); err != nil {
+				return nil, c.setLost(conn, err)
+			}
+		} else if err := c.writeFrame(conn, request); err != nil {
+			c.forget(id, call)
+			return nil, c.setLost(conn, err)
+		}
+	}
+	return call, nil
+}
+
+// Gives up on an upload after some of its chunks were sent. The server is told
+// to drop them, or the connection is closed when it can't be told
+func (c *Client) abandon(conn *connection, id string, call *pendingCall) {
+	c.forget(id, call)
+	if conn.features[protobuf.FeatureAbort] {
+		request := &protobuf.Request{Id: proto.String(id), Op: protobuf.Request_SET.Enum(), Key: []byte{}, Abort: proto.Bool(true)}
+		// A connection that fails the write is dropped by writeFrame
+		c.writeFrame(conn, request)
+		return
+	}
+	c.drop(conn)
+}
 
-	callback := c.write(request)
-	if callback == nil {
-		return -1, ""
+func (c *Client) receiveSet(ctx context.Context, id string, call *pendingCall) (int, []byte, error) {
+	// Block on the call, the old value may come back in chunks too
+	var old []byte
+	result, err := c.receive(ctx, id, call, func(response *protobuf.Response) {
+		old = append(old, response.GetValue()...)
+	})
+	if err != nil {
+		return -1, nil, c.setLost(call.conn, err)
+	}
+	return result, old, nil
+}
+
+// A set lost with the connection may have been applied, so it is only safe to
+// send again if the server deduplicates sets
+func (c *Client) setLost(conn *connection, err error) error {
+	if err == errConnectionLost && !conn.features[protobuf.FeatureDedupe] {
+		return errSetUncertain
+	}
+	return err
+}
+
+// Hands every response to a call to chunk and returns the result of the last. The
+// responses closing before the last chunk means the connection was lost, and once
+// ctx is done the call is forgotten so late responses are dropped. A redirect
+// comes back as a *redirectError and a busy server as errBusy
+func (c *Client) receive(ctx context.Context, id string, call *pendingCall, chunk func(*protobuf.Response)) (int, error) {
+	result := -1
+	complete := false
+	for {
+		select {
+		case response, open := <-call.responses:
+			if !open {
+				if !complete {
+					return -1, errConnectionLost
+				}
+				return result, nil
+			}
+			if status := response.GetStatus(); status.GetCode() == protobuf.Status_REDIRECT {
+				c.forget(id, call)
+				return -1, &redirectError{leader: response.GetLeader(), message: status.GetMessage()}
+			} else if status.GetCode() == protobuf.Status_BUSY {
+				c.forget(id, call)
+				return -1, errBusy
+			}
+			result = responseResult(&response)
+			complete = !response.GetMore()
+			chunk(&response)
+		case <-ctx.Done():
+			c.forget(id, call)
+			return -1, ctx.Err()
+		}
+	}
+}
+
+// Old servers only send the result code, newer ones explain errors in the status
+func responseResult(response *protobuf.Response) int {
+	status := response.GetStatus()
+	if status == nil {
+		return int(response.GetResult())
+	}
+	if status.Result() == -1 && !response.GetMore() {
+		log.Printf("Request %s failed with %v: %s\n", response.GetId(), status.GetCode(), status.GetMessage())
 	}
+	return status.Result()
+}
 
-	// Block on callback
-	response := <-callback
-	return int(response.GetResult()), response.GetValue()
+// A nil slice is an unset field to protobuf, which isn't allowed for required fields
+func nonNil(data []byte) []byte {
+	if data == nil {
+		return []byte{}
+	}
+	return data
 }
 
+// Closes every connection for good, requests still waiting return -1
 func (c *Client) Close() {
-	c.conn.Close()
+	c.pendingLock.Lock()
+	if !c.shutdown {
+		c.shutdown = true
+		close(c.done)
+	}
+	conns := append([]*connection{}, c.conns...)
+	c.pendingLock.Unlock()
+	for _, conn := range conns {
+		conn.conn.Close()
+	}
+	if c.replicas != nil {
+		c.replicas.Close()
+	}
 }
@@ -1,16 +1,35 @@
 package client
 
 import (
+	"keyvalue/protobuf"
 	"keyvalue/server"
 
+	"code.google.com/p/goprotobuf/proto"
+
+	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"math/rand"
+	"net"
+	"path"
 )
 
 func TestClient(t *testing.T) {
@@ -20,6 +39,8 @@ func TestClient(t *testing.T) {
 	//c := clientInit("adelie-01:12345")
 	sanityTest(c)
 	correctnessTest(c)
+	binaryTest(c)
+	streamTest(c)
 	performanceTest(c, 100)
 	performanceTest(c, 200)
 	performanceTest(c, 500)
@@ -97,6 +118,65 @@ func correctnessTest(client *Client) {
 
 }
 
+func binaryTest(client *Client) {
+	printTestStart("Binary Test")
+
+	key := []byte{0xff, 0x00, 'k', 0xfe}
+	value := make([]byte, 256)
+	for i := range value {
+		value[i] = byte(i)
+	}
+
+	// Test Case 1: Write a key and value that aren't valid UTF-8
+	result, out := client.SetBytes(key, value)
+	if result != 1 {
+		log.Fatal("TC 1: Server did not return status 1 for writing a new binary key. Received : ", result)
+	}
+
+	// Test Case 2: Overwrite it and get every byte of the old value back
+	result, out = client.SetBytes(key, []byte{})
+	if result != 0 {
+		log.Fatal("TC 2: Server did not return status 0 for writing to an existing binary key. Received : ", result)
+	}
+	if !bytes.Equal(out, value) {
+		log.Fatalf("TC 2: Server did not return the expected old binary value. Expecting: %v, Received: %v ", value, out)
+	}
+
+	log.Printf("PASS")
+}
+
+func streamTest(client *Client) {
+	printTestStart("Stream Test")
+
+	// Several times the maximum frame size so it has to go in chunks both ways
+	value := make([]byte, 5*int(client.MaxFrameSize)+123)
+	rand.Read(value)
+
+	// Test Case 1: Upload a large value from a reader
+	result, _ := client.SetReader([]byte("large"), bytes.NewReader(value))
+	if result == -1 {
+		log.Fatal("TC 1: Server failed to store a value larger than a frame")
+	}
+
+	// Test Case 2: Download it into a writer
+	var out bytes.Buffer
+	result, err := client.GetWriter([]byte("large"), &out)
+	if err != nil || result != 0 {
+		log.Fatalf("TC 2: Server did not return status 0 for reading a large value. Received : %d (%v)", result, err)
+	}
+	if !bytes.Equal(out.Bytes(), value) {
+		log.Fatalf("TC 2: Large value was corrupted. Expecting %d bytes, Received %d bytes", len(value), out.Len())
+	}
+
+	// Test Case 3: Overwriting returns the whole large old value
+	result, old := client.SetBytes([]byte("large"), []byte("small"))
+	if result != 0 || !bytes.Equal(old, value) {
+		log.Fatalf("TC 3: Server did not return the large old value. Received : %d with %d bytes", result, len(old))
+	}
+
+	log.Printf("PASS")
+}
+
 func performanceTest(client *Client, valueSize int64) {
 	printTestStart("Performance Test")
 
@@ -239,3 +319,891 @@ func randRead(client *Client, numKeys int, value string) (float64, float64, floa
 func printTestStart(testName string) {
 	log.Printf("----------------- %s ------------------", testName)
 }
+
+// Writes a CA and a certificate signed by it for each name to dir, as name.pem and name.key
+func writeCertificates(t *testing.T, dir string, names ...string) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(crand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, path.Join(dir, "ca.pem"), "CERTIFICATE", caDER)
+
+	for i, name := range names {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+		cert := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(crand.Reader, cert, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, _ := x509.MarshalECPrivateKey(key)
+		writePEM(t, path.Join(dir, name+".pem"), "CERTIFICATE", der)
+		writePEM(t, path.Join(dir, name+".key"), "EC PRIVATE KEY", keyDER)
+	}
+}
+
+func writePEM(t *testing.T, name string, kind string, der []byte) {
+	if err := ioutil.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	writeCertificates(t, dir, "server", "client")
+
+	status, s := server.InitConfig(server.Config{
+		Port:         12360,
+		CertFile:     path.Join(dir, "server.pem"),
+		KeyFile:      path.Join(dir, "server.key"),
+		ClientCAFile: path.Join(dir, "ca.pem"),
+	})
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer s.Close()
+
+	status, c := InitConfig(Config{
+		Server:   "localhost:12360",
+		CAFile:   path.Join(dir, "ca.pem"),
+		CertFile: path.Join(dir, "client.pem"),
+		KeyFile:  path.Join(dir, "client.key"),
+	})
+	if status != 0 {
+		t.Fatal("Client with certificate inited with nonzero status")
+	}
+	defer c.Close()
+	c.Set("tls", "value")
+	if result, value := c.Get("tls"); result != 0 || value != "value" {
+		t.Fatalf("Get Expecting: (0, value), Received: (%d, %s)", result, value)
+	}
+
+	// Without a client certificate the server hangs up during the handshake
+	if status, _ := InitConfig(Config{Server: "localhost:12360", CAFile: path.Join(dir, "ca.pem")}); status == 0 {
+		t.Fatal("Client without certificate Expecting: nonzero status")
+	}
+	// Nor will the client trust a server outside the system roots without the CA
+	if status, _ := InitConfig(Config{Server: "localhost:12360", TLS: true}); status == 0 {
+		t.Fatal("Client without CA Expecting: nonzero status")
+	}
+}
+
+func TestClientCompress(t *testing.T) {
+	status, s := server.Init(12365)
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer s.Close()
+
+	status, c := InitConfig(Config{Server: "localhost:12365", MaxFrameSize: 4096, Compress: true})
+	if status != 0 {
+		t.Fatal("Client inited with nonzero status")
+	}
+	defer c.Close()
+	if !c.HasFeature(protobuf.FeatureDeflate) {
+		t.Fatal("Expecting: deflate to be negotiated")
+	}
+
+	// Spans several frames, each chunk is deflated on its own
+	value := bytes.Repeat([]byte("compressible "), 10000)
+	c.SetBytes([]byte("compressed"), value)
+	if result, out := c.GetBytes([]byte("compressed")); result != 0 || !bytes.Equal(out, value) {
+		t.Fatalf("Get Expecting: (0, %d bytes), Received: (%d, %d bytes)", len(value), result, len(out))
+	}
+}
+
+// Run with -race, every goroutine must only ever see the responses to its own requests
+func TestClientConcurrent(t *testing.T) {
+	status, s := server.InitConfig(server.Config{Port: 12366, MaxFrameSize: 4096})
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer s.Close()
+	status, c := InitConfig(Config{Server: "localhost:12366", MaxFrameSize: 4096})
+	if status != 0 {
+		t.Fatal("Client inited with nonzero status")
+	}
+	defer c.Close()
+
+	const workers = 32
+	const operations = 200
+	values := make([]string, workers)
+	for i := range values {
+		// Some values span several frames so their chunks interleave with other responses
+		values[i] = strings.Repeat(strconv.Itoa(i)+"-", 1+(i%4)*2000)
+		if err := s.Update("concurrent-"+strconv.Itoa(i), func(string, bool) (string, bool, error) {
+			return values[i], false, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wait sync.WaitGroup
+	errs := make(chan string, workers)
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			key := "concurrent-" + strconv.Itoa(i)
+			for n := 0; n < operations; n++ {
+				if result, value := c.Get(key); result != 0 || value != values[i] {
+					errs <- fmt.Sprintf("Get %s Expecting: (0, %d bytes), Received: (%d, %d bytes)", key, len(values[i]), result, len(value))
+					return
+				}
+				if result, _ := c.Set(key+"-scratch", strconv.Itoa(n)); result == -1 {
+					errs <- fmt.Sprintf("Set %s-scratch failed", key)
+					return
+				}
+			}
+		}(i)
+	}
+	wait.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Requests on a closed connection fail rather than hang
+	c.Close()
+	if result, _ := c.Get("concurrent-0"); result != -1 {
+		t.Fatalf("Get after Close Expecting: -1, Received: %d", result)
+	}
+}
+
+// A server that says hello and then never answers anything
+func silentServer(t *testing.T, port int, requests chan *protobuf.Request) net.Listener {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			request := new(protobuf.Request)
+			if err := protobuf.ReadFrame(conn, protobuf.DefaultMaxFrameSize, request); err != nil {
+				return
+			}
+			if request.GetOp() == protobuf.Request_HELLO {
+				response := &protobuf.Response{
+					Id:     request.Id,
+					Result: proto.Int32(0),
+					Status: protobuf.NewStatus(protobuf.Status_OK, ""),
+					Hello:  protobuf.NewHello(nil, protobuf.DefaultMaxFrameSize),
+				}
+				protobuf.WriteFrame(conn, response)
+				continue
+			}
+			requests <- request
+		}
+	}()
+	return listener
+}
+
+func TestClientContext(t *testing.T) {
+	requests := make(chan *protobuf.Request, 10)
+	listener := silentServer(t, 12367, requests)
+	defer listener.Close()
+	status, c := Init("localhost:12367")
+	if status != 0 {
+		t.Fatal("Client inited with nonzero status")
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if result, _ := c.GetContext(ctx, "key"); result != -1 {
+		t.Fatalf("Get past deadline Expecting: -1, Received: %d", result)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Get past deadline took %v", elapsed)
+	}
+	request := <-requests
+	if timeout := request.GetTimeout(); timeout == 0 || timeout > 100 {
+		t.Fatalf("Timeout sent Expecting: 1 to 100ms, Received: %d", timeout)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-requests
+		cancel()
+	}()
+	if result, _ := c.SetContext(cancelled, "key", "value"); result != -1 {
+		t.Fatalf("Cancelled set Expecting: -1, Received: %d", result)
+	}
+
+	c.pendingLock.Lock()
+	left := len(c.pending)
+	c.pendingLock.Unlock()
+	if left != 0 {
+		t.Fatalf("Pending calls Expecting: 0, Received: %d", left)
+	}
+}
+
+// Forwards connections on port to target until drop is called, which cuts all of them
+func dropProxy(t *testing.T, port int, target string) (net.Listener, func()) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			lock.Lock()
+			conns = append(conns, conn, upstream)
+			lock.Unlock()
+			go io.Copy(upstream, conn)
+			go io.Copy(conn, upstream)
+		}
+	}()
+	return listener, func() {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		conns = nil
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	status, s := server.Init(12369)
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer s.Close()
+	listener, drop := dropProxy(t, 12370, "localhost:12369")
+	defer listener.Close()
+
+	status, c := InitConfig(Config{Server: "localhost:12370", Retry: RetryInFlight, MinBackoff: 10 * time.Millisecond})
+	if status != 0 {
+		t.Fatal("Client inited with nonzero status")
+	}
+	defer c.Close()
+	if !c.HasFeature(protobuf.FeatureDedupe) {
+		t.Fatal("Expecting: dedupe agreed in the handshake")
+	}
+	if result, _ := c.Set("reconnect", "before"); result == -1 {
+		t.Fatal("Set Expecting: success")
+	}
+
+	// Requests made while the connection is down wait for it to come back
+	drop()
+	if result, value := c.Get("reconnect"); result != 0 || value != "before" {
+		t.Fatalf("Get after drop Expecting: before, Received: %d %q", result, value)
+	}
+	drop()
+	if result, old := c.Set("reconnect", "after"); result != 0 || old != "before" {
+		t.Fatalf("Set after drop Expecting: old value before, Received: %d %q", result, old)
+	}
+
+	// Without retries a request in flight fails instead of hanging
+	requests := make(chan *protobuf.Request, 10)
+	silent := silentServer(t, 12371, requests)
+	defer silent.Close()
+	silentListener, silentDrop := dropProxy(t, 12372, "localhost:12371")
+	defer silentListener.Close()
+	status, failing := InitConfig(Config{Server: "localhost:12372", Reconnect: true, MinBackoff: 10 * time.Millisecond})
+	if status != 0 {
+		t.Fatal("Client inited with nonzero status")
+	}
+	defer failing.Close()
+	go func() {
+		<-requests
+		silentDrop()
+	}()
+	if result, _ := failing.Get("key"); result != -1 {
+		t.Fatalf("Get in flight on drop Expecting: -1, Received: %d", result)
+	}
+}
+
+func TestClientPool(t *testing.T) {
+	status, s := server.Init(12373)
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer s.Close()
+	status, c := InitConfig(Config{Server: "localhost:12373", PoolSize: 4, IdleTimeout: 200 * time.Millisecond, HealthInterval: 50 * time.Millisecond})
+	if status != 0 {
+		t.Fatal("Client inited with nonzero status")
+	}
+	defer c.Close()
+	open := func(c *Client) int {
+		c.pendingLock.Lock()
+		defer c.pendingLock.Unlock()
+		return len(c.conns)
+	}
+	waitFor := func(c *Client, n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for open(c) != n && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	// Busy connections make the pool grow
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := fmt.Sprintf("pool-%d-%d", i, j)
+				if result, _ := c.Set(key, key); result == -1 {
+					t.Errorf("Set %s failed", key)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := open(c); n < 2 || n > 4 {
+		t.Fatalf("Connections under load Expecting: 2 to 4, Received: %d", n)
+	}
+
+	// And shrink back to one once they've been idle, which the pings don't count as use
+	waitFor(c, 1)
+	if n := open(c); n != 1 {
+		t.Fatalf("Connections when idle Expecting: 1, Received: %d", n)
+	}
+	if result, value := c.Get("pool-0-0"); result != 0 || value != "pool-0-0" {
+		t.Fatalf("Get Expecting: pool-0-0, Received: %d %q", result, value)
+	}
+
+	// A server that stops answering fails its health check
+	requests := make(chan *protobuf.Request, 10)
+	silent := silentServer(t, 12374, requests)
+	defer silent.Close()
+	status, unhealthy := InitConfig(Config{Server: "localhost:12374", HealthInterval: 50 * time.Millisecond})
+	if status != 0 {
+		t.Fatal("Client inited with nonzero status")
+	}
+	defer unhealthy.Close()
+	<-requests
+	waitFor(unhealthy, 0)
+	if n := open(unhealthy); n != 0 {
+		t.Fatalf("Connections after unanswered ping Expecting: 0, Received: %d", n)
+	}
+}
+
+func TestClientFailover(t *testing.T) {
+	status, leader := server.Init(12375)
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer leader.Close()
+	status, replica := server.InitConfig(server.Config{Port: 12376, Leader: "localhost:12375"})
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer replica.Close()
+	endpoint := func(c *Client) string {
+		c.pendingLock.Lock()
+		defer c.pendingLock.Unlock()
+		if len(c.conns) == 0 {
+			return ""
+		}
+		return c.conns[0].endpoint
+	}
+
+	// Given only the replica the client finds the leader from its hello
+	status, c := Init("localhost:12376")
+	if status != 0 {
+		t.Fatal("Client inited with nonzero status")
+	}
+	defer c.Close()
+	if e := endpoint(c); e != "localhost:12375" {
+		t.Fatalf("Connected to Expecting: leader localhost:12375, Received: %q", e)
+	}
+	if result, _ := c.Set("failover", "leader"); result == -1 {
+		t.Fatal("Set Expecting: success")
+	}
+
+	// Stale reads go to the replica while it's fresh enough and to the leader otherwise
+	status, reader := InitConfig(Config{Server: "localhost:12375", Servers: []string{"localhost:12376"}, ReadStaleness: time.Second})
+	if status != 0 {
+		t.Fatal("Client inited with nonzero status")
+	}
+	defer reader.Close()
+	if e := endpoint(reader.replicas); e != "localhost:12376" {
+		t.Fatalf("Replica reads connected to Expecting: localhost:12376, Received: %q", e)
+	}
+	if result, value := reader.Get("failover"); result != 0 || value != "leader" {
+		t.Fatalf("Get from unsynced replica Expecting: leader's value, Received: %d %q", result, value)
+	}
+	// Nothing actually replicates here so the replica doesn't have the key
+	replica.Synced(time.Now())
+	if result, _ := reader.Get("failover"); result != 1 {
+		t.Fatalf("Get from synced replica Expecting: 1, Received: %d", result)
+	}
+
+	// Once the first server is gone the client fails over to the next
+	listener, drop := dropProxy(t, 12378, "localhost:12375")
+	status, failing := InitConfig(Config{Server: "localhost:12378", Servers: []string{"localhost:12377", "localhost:12375"}, Retry: RetryInFlight, MinBackoff: 10 * time.Millisecond})
+	if status != 0 {
+		t.Fatal("Client inited with nonzero status")
+	}
+	defer failing.Close()
+	listener.Close()
+	drop()
+	if result, value := failing.Get("failover"); result != 0 || value != "leader" {
+		t.Fatalf("Get after failover Expecting: leader, Received: %d %q", result, value)
+	}
+	if e := endpoint(failing); e != "localhost:12375" {
+		t.Fatalf("Failed over to Expecting: localhost:12375, Received: %q", e)
+	}
+}
+
+func TestClientAsync(t *testing.T) {
+	status, s := server.Init(12382)
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer s.Close()
+	c := clientInit("localhost:12382")
+	defer c.Close()
+
+	// Everything is sent before anything is waited for
+	futures := make([]*Future, 1000)
+	for i := range futures {
+		key := fmt.Sprintf("async-%d", i)
+		futures[i] = c.SetAsync(key, key)
+	}
+	for i, f := range futures {
+		if result, _ := f.Wait(); result == -1 {
+			t.Fatalf("SetAsync %d failed", i)
+		}
+	}
+	for i := range futures {
+		futures[i] = c.GetAsync(fmt.Sprintf("async-%d", i))
+	}
+	for i, f := range futures {
+		<-f.Done()
+		if result, value := f.Wait(); result != 0 || value != fmt.Sprintf("async-%d", i) {
+			t.Fatalf("GetAsync %d Expecting: async-%d, Received: %d %q", i, i, result, value)
+		}
+	}
+
+	c.Close()
+	if result, _ := c.GetAsync("async-0").Wait(); result != -1 {
+		t.Fatalf("GetAsync after Close Expecting: -1, Received: %d", result)
+	}
+}
+
+func TestClientNearCache(t *testing.T) {
+	status, s := server.Init(12383)
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer s.Close()
+	status, c := InitConfig(Config{Server: "localhost:12383", NearCache: 2, CacheLease: 200 * time.Millisecond})
+	if status != 0 {
+		t.Fatal("Client inited with nonzero status")
+	}
+	defer c.Close()
+	if !c.HasFeature(protobuf.FeatureInvalidate) {
+		t.Fatal("Expecting: invalidate agreed in the handshake")
+	}
+	writer := clientInit("localhost:12383")
+	defer writer.Close()
+
+	cached := func(key string) (string, bool) {
+		_, value, hit := c.cache.get(key, 0)
+		return string(value), hit
+	}
+	writer.Set("near", "first")
+	if result, value := c.Get("near"); result != 0 || value != "first" {
+		t.Fatalf("Get Expecting: first, Received: %d %q", result, value)
+	}
+	if value, hit := cached("near"); !hit || value != "first" {
+		t.Fatalf("Cached Expecting: first, Received: %v %q", hit, value)
+	}
+
+	// Another client's set reaches us as an invalidation
+	writer.Set("near", "second")
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if _, hit := cached("near"); !hit {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expecting: invalidation after another client's set")
+		}
+	}
+	if result, value := c.Get("near"); result != 0 || value != "second" {
+		t.Fatalf("Get after invalidation Expecting: second, Received: %d %q", result, value)
+	}
+
+	// Our own sets are read back straight away
+	c.Set("near", "third")
+	if result, value := c.Get("near"); result != 0 || value != "third" {
+		t.Fatalf("Get after own set Expecting: third, Received: %d %q", result, value)
+	}
+
+	// Least recently used goes first
+	c.Get("other")
+	c.Get("another")
+	if _, hit := cached("near"); hit {
+		t.Fatal("Expecting: oldest entry evicted")
+	}
+	if _, hit := cached("another"); !hit {
+		t.Fatal("Expecting: newest entry cached")
+	}
+
+	// Even without an invalidation answers don't outlive the lease
+	time.Sleep(250 * time.Millisecond)
+	if _, hit := cached("another"); hit {
+		t.Fatal("Expecting: entry expired after the lease")
+	}
+}
+
+func TestClientReadYourWrites(t *testing.T) {
+	status, s := server.Init(12386)
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer s.Close()
+	status, c := InitConfig(Config{Server: "localhost:12386", ReadYourWrites: true, PoolSize: 4})
+	if status != 0 {
+		t.Fatal("Client inited with nonzero status")
+	}
+	defer c.Close()
+
+	// Sets and gets may go out on different connections
+	var wg sync.WaitGroup
+	errs := make(chan string, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			key := fmt.Sprintf("ryw-%d", g)
+			for i := 0; i < 200; i++ {
+				value := strconv.Itoa(i)
+				c.Set(key, value)
+				if result, read := c.Get(key); result != 0 || read != value {
+					errs <- fmt.Sprintf("Get after set Expecting: %s, Received: %d %q", value, result, read)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if seen := atomic.LoadUint64(&c.seen); seen < 8*200 {
+		t.Fatalf("Seen Expecting: at least %d, Received: %d", 8*200, seen)
+	}
+}
+
+func TestClientReadYourWritesNearCache(t *testing.T) {
+	status, s := server.Init(12403)
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer s.Close()
+	status, c := InitConfig(Config{Server: "localhost:12403", NearCache: 10, ReadYourWrites: true})
+	if status != 0 {
+		t.Fatal("Client inited with nonzero status")
+	}
+	defer c.Close()
+	writer := clientInit("localhost:12403")
+	defer writer.Close()
+
+	writer.Set("near", "first")
+	if result, value := c.Get("near"); result != 0 || value != "first" {
+		t.Fatalf("Get Expecting: first, Received: %d %q", result, value)
+	}
+	read := s.Applied()
+	writer.Set("near", "second")
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if _, _, hit := c.cache.get("near", 0); !hit {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expecting: invalidation after another client's set")
+		}
+	}
+	// As if the invalidation were still on its way
+	c.cache.put("near", 0, []byte("first"), read, c.pick())
+
+	// Once we've seen a later write the entry read before it is skipped
+	c.Set("other", "value")
+	if result, value := c.Get("near"); result != 0 || value != "second" {
+		t.Fatalf("Get after a later write Expecting: second, Received: %d %q", result, value)
+	}
+	if _, value, hit := c.cache.get("near", atomic.LoadUint64(&c.seen)); !hit || string(value) != "second" {
+		t.Fatalf("Cached Expecting: second, Received: %v %q", hit, value)
+	}
+}
+
+func TestClientBusy(t *testing.T) {
+	status, s := server.InitConfig(server.Config{Port: 12389, RateLimit: 20, RateBurst: 1})
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer s.Close()
+	c := clientInit("localhost:12389")
+	defer c.Close()
+
+	// Busy answers are sent again after backing off, whatever the retry policy
+	for i := 0; i < 5; i++ {
+		if result, _ := c.Set("busy", strconv.Itoa(i)); result == -1 {
+			t.Fatalf("Set %d Expecting: success after backing off", i)
+		}
+	}
+	if result, value := c.Get("busy"); result != 0 || value != "4" {
+		t.Fatalf("Get Expecting: 4, Received: %d %q", result, value)
+	}
+}
+
+var (
+	benchOnce   sync.Once
+	benchClient *Client
+)
+
+// One server and client shared by the benchmarks, which run more than once
+func benchmarkClient(b *testing.B) *Client {
+	benchOnce.Do(func() {
+		server.Init(12381)
+		_, benchClient = Init("localhost:12381")
+	})
+	if benchClient == nil {
+		b.Fatal("Client inited with nonzero status")
+	}
+	return benchClient
+}
+
+// Sets waiting for each answer before sending the next, to compare against
+func BenchmarkSet(b *testing.B) {
+	c := benchmarkClient(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := "bench-" + strconv.Itoa(i%10000)
+		if result, _ := c.Set(key, key); result == -1 {
+			b.Fatal("Set failed")
+		}
+	}
+}
+
+// Sets sent a window at a time without waiting in between
+func BenchmarkSetPipelined(b *testing.B) {
+	c := benchmarkClient(b)
+	futures := make([]*Future, 0, 1000)
+	wait := func() {
+		for _, f := range futures {
+			if result, _ := f.Wait(); result == -1 {
+				b.Fatal("SetAsync failed")
+			}
+		}
+		futures = futures[:0]
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := "bench-" + strconv.Itoa(i%10000)
+		futures = append(futures, c.SetAsync(key, key))
+		if len(futures) == cap(futures) {
+			wait()
+		}
+	}
+	wait()
+}
+
+// Endless bytes, cancels after the first chunk has been read
+type cancellingReader struct {
+	reads  int
+	cancel context.CancelFunc
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	if r.reads++; r.reads > 1 {
+		r.cancel()
+	}
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+func TestClientAbortUpload(t *testing.T) {
+	status, s := server.InitConfig(server.Config{Port: 12402, MaxFrameSize: 1024})
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer s.Close()
+	status, c := InitConfig(Config{Server: "localhost:12402", MaxFrameSize: 1024})
+	if status != 0 {
+		t.Fatal("Client inited with nonzero status")
+	}
+	defer c.Close()
+	if !c.HasFeature(protobuf.FeatureAbort) {
+		t.Fatal("Expecting: abort agreed in the handshake")
+	}
+	conn := c.pick()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if result, _ := c.SetReaderContext(ctx, []byte("abort"), &cancellingReader{cancel: cancel}); result != -1 {
+		t.Fatalf("Cancelled upload Expecting: -1, Received: %d", result)
+	}
+	if result, _ := c.Get("abort"); result != 1 {
+		t.Fatalf("Get of cancelled upload Expecting: 1, Received: %d", result)
+	}
+
+	// The server was told to drop the chunks, the connection carries on
+	if result, _ := c.Set("abort", "value"); result == -1 {
+		t.Fatal("Set after cancelled upload Expecting: success")
+	}
+	if result, value := c.Get("abort"); result != 0 || value != "value" {
+		t.Fatalf("Get after cancelled upload Expecting: value, Received: %d %s", result, value)
+	}
+	if c.pick() != conn {
+		t.Fatal("Expecting: the connection kept after the upload was aborted")
+	}
+}
+
+// The messages of protocol version 1, before the handshake
+type v1Request struct {
+	Id               *string `protobuf:"bytes,1,req,name=id" json:"id,omitempty"`
+	Type             *string `protobuf:"bytes,2,req,name=type" json:"type,omitempty"`
+	Key              *string `protobuf:"bytes,3,req,name=key" json:"key,omitempty"`
+	Value            *string `protobuf:"bytes,4,opt,name=value" json:"value,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *v1Request) Reset()         { *m = v1Request{} }
+func (m *v1Request) String() string { return proto.CompactTextString(m) }
+func (*v1Request) ProtoMessage()    {}
+
+func (m *v1Request) GetType() string {
+	if m != nil && m.Type != nil {
+		return *m.Type
+	}
+	return ""
+}
+
+type v1Response struct {
+	Id               *string `protobuf:"bytes,1,req,name=id" json:"id,omitempty"`
+	Result           *int32  `protobuf:"varint,2,req,name=result" json:"result,omitempty"`
+	Value            *string `protobuf:"bytes,3,opt,name=value" json:"value,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *v1Response) Reset()         { *m = v1Response{} }
+func (m *v1Response) String() string { return proto.CompactTextString(m) }
+func (*v1Response) ProtoMessage()    {}
+
+// Serves one connection the way servers did before the handshake, closing it on
+// a request it can't parse and sending back the types of the requests it could
+func v1Server(t *testing.T, port int, types chan string) net.Listener {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			request := new(v1Request)
+			if err := protobuf.ReadFrame(conn, protobuf.DefaultMaxFrameSize, request); err != nil {
+				return
+			}
+			types <- request.GetType()
+			response := &v1Response{Id: request.Id, Result: proto.Int32(1), Value: proto.String("")}
+			if request.GetType() != "get" {
+				response.Result = proto.Int32(0)
+			}
+			if err := protobuf.WriteFrame(conn, response); err != nil {
+				return
+			}
+		}
+	}()
+	return listener
+}
+
+func TestClientVersion1Server(t *testing.T) {
+	types := make(chan string, 10)
+	listener := v1Server(t, 12404, types)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", "localhost:12404")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &Client{MaxFrameSize: protobuf.DefaultMaxFrameSize}
+	_, err = c.handshake(conn)
+	if err == nil || !strings.Contains(err.Error(), "speaks protocol version 1") {
+		t.Fatalf("Handshake Expecting: version 1 error, Received: %v", err)
+	}
+	// Parsed and answered as a harmless get
+	if kind := <-types; kind != "get" {
+		t.Fatalf("Hello as seen by a version 1 server Expecting: get, Received: %q", kind)
+	}
+}
+
+func TestClientHandshakeTimeout(t *testing.T) {
+	// Accepts connections but never answers
+	listener, err := net.Listen("tcp", "localhost:12409")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", "localhost:12409")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &Client{MaxFrameSize: protobuf.DefaultMaxFrameSize, config: Config{DialTimeout: 50 * time.Millisecond}}
+	started := time.Now()
+	if _, err := c.handshake(conn); err == nil {
+		t.Fatal("Handshake with a silent server Expecting: error")
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("Handshake with a silent server Expecting: to give up after DialTimeout, Received: %v", elapsed)
+	}
+}
@@ -0,0 +1,57 @@
+package lsm
+
+import (
+	"hash/fnv"
+)
+
+const (
+	bloomBitsPerKey = 10
+	bloomProbes     = 7 // ln(2) * bits per key minimizes the false positive rate
+)
+
+// Bloom filter over the keys of a table, the last byte holds the number of probes
+type bloom []byte
+
+func bloomHash(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	return hash.Sum64()
+}
+
+func newBloom(hashes []uint64) bloom {
+	bits := uint32(len(hashes) * bloomBitsPerKey)
+	if bits < 64 {
+		bits = 64
+	}
+	length := (bits + 7) / 8
+	bits = length * 8
+
+	filter := make(bloom, length+1)
+	for _, hash := range hashes {
+		h1, h2 := uint32(hash), uint32(hash>>32)|1
+		for i := uint32(0); i < bloomProbes; i++ {
+			bit := (h1 + i*h2) % bits
+			filter[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	filter[length] = bloomProbes
+	return filter
+}
+
+func (b bloom) mayContain(key string) bool {
+	if len(b) < 2 {
+		return true
+	}
+	probes := uint32(b[len(b)-1])
+	bits := uint32(len(b)-1) * 8
+
+	hash := bloomHash(key)
+	h1, h2 := uint32(hash), uint32(hash>>32)|1
+	for i := uint32(0); i < probes; i++ {
+		bit := (h1 + i*h2) % bits
+		if b[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
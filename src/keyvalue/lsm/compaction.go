@@ -0,0 +1,159 @@
+package lsm
+
+import (
+	"log"
+	"os"
+	"sort"
+)
+
+// Merges tables from level into the overlapping tables of level+1
+type compaction struct {
+	level  int
+	inputs [2][]*table
+}
+
+func keyRange(tables ...[]*table) (string, string) {
+	var smallest, largest string
+	first := true
+	for _, list := range tables {
+		for _, t := range list {
+			if first || t.smallest < smallest {
+				smallest = t.smallest
+			}
+			if first || t.largest > largest {
+				largest = t.largest
+			}
+			first = false
+		}
+	}
+	return smallest, largest
+}
+
+func overlapping(tables []*table, smallest string, largest string) []*table {
+	var result []*table
+	for _, t := range tables {
+		if t.largest >= smallest && t.smallest <= largest {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+func levelSize(tables []*table) uint64 {
+	var size uint64
+	for _, t := range tables {
+		size += t.size
+	}
+	return size
+}
+
+func (db *DB) maxBytes(level int) uint64 {
+	bytes := db.options.LevelSize
+	for i := 1; i < level; i++ {
+		bytes *= LevelMultiplier
+	}
+	return bytes
+}
+
+// Only the background goroutine changes the levels, so it can read them without locking
+func (db *DB) pickCompaction() *compaction {
+	if len(db.levels[0]) >= db.options.L0Tables {
+		c := &compaction{level: 0}
+		c.inputs[0] = append([]*table(nil), db.levels[0]...)
+		smallest, largest := keyRange(c.inputs[0])
+		c.inputs[1] = overlapping(db.levels[1], smallest, largest)
+		return c
+	}
+
+	for level := 1; level < MaxLevels-1; level++ {
+		tables := db.levels[level]
+		if levelSize(tables) <= db.maxBytes(level) {
+			continue
+		}
+
+		// Rotate through the key space so every table eventually gets pushed down
+		pick := tables[0]
+		for _, t := range tables {
+			if t.smallest > db.pointers[level] {
+				pick = t
+				break
+			}
+		}
+		db.pointers[level] = pick.largest
+
+		c := &compaction{level: level}
+		c.inputs[0] = []*table{pick}
+		c.inputs[1] = overlapping(db.levels[level+1], pick.smallest, pick.largest)
+		return c
+	}
+	return nil
+}
+
+func (db *DB) compact(c *compaction) error {
+	// Newer entries must come first in the merge, level 0 is ordered oldest first
+	var inputs []iterator
+	for i := len(c.inputs[0]) - 1; i >= 0; i-- {
+		inputs = append(inputs, c.inputs[0][i].iterator())
+	}
+	for _, t := range c.inputs[1] {
+		inputs = append(inputs, t.iterator())
+	}
+
+	// Tombstones can be dropped once nothing below the output level could still hold the key
+	smallest, largest := keyRange(c.inputs[0], c.inputs[1])
+	bottom := true
+	for level := c.level + 2; level < MaxLevels; level++ {
+		if len(overlapping(db.levels[level], smallest, largest)) > 0 {
+			bottom = false
+			break
+		}
+	}
+
+	outputs, err := db.writeTables(newMergingIterator(inputs), db.options.TableSize, bottom)
+	if err != nil {
+		return err
+	}
+
+	obsolete := make(map[*table]bool)
+	for _, list := range c.inputs {
+		for _, t := range list {
+			obsolete[t] = true
+		}
+	}
+	levels := make([][]*table, len(db.levels))
+	for level, tables := range db.levels {
+		for _, t := range tables {
+			if !obsolete[t] {
+				levels[level] = append(levels[level], t)
+			}
+		}
+	}
+	output := append(levels[c.level+1], outputs...)
+	sort.Sort(bySmallest(output))
+	levels[c.level+1] = output
+
+	if err := db.writeManifest(levels); err != nil {
+		for _, t := range outputs {
+			t.close()
+			os.Remove(t.path)
+		}
+		return err
+	}
+	db.versionLock.Lock()
+	db.levels = levels
+	db.versionLock.Unlock()
+
+	for t := range obsolete {
+		t.close()
+		if err := os.Remove(t.path); err != nil {
+			log.Printf("Could not remove compacted table %s: %v\n", t.path, err)
+		}
+	}
+	return nil
+}
+
+type bySmallest []*table
+
+func (b bySmallest) Len() int           { return len(b) }
+func (b bySmallest) Less(i, j int) bool { return b[i].smallest < b[j].smallest }
+func (b bySmallest) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,559 @@
+// Package lsm is a log-structured merge-tree storage engine. Writes go to a
+// write ahead log and an in memory memtable, full memtables are flushed to
+// immutable sorted tables on disk which are merged by leveled compaction.
+package lsm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	MaxLevels       = 7
+	LevelMultiplier = 10 // Each level holds this many times more bytes than the one above
+	manifestName    = "MANIFEST"
+)
+
+var ErrClosed = errors.New("lsm: database is closed")
+
+type Options struct {
+	MemtableSize int    // Bytes buffered in the memtable before it is flushed to level 0
+	BlockSize    int    // Target size of the data blocks within a table
+	TableSize    uint64 // Target size of the tables written by compaction
+	L0Tables     int    // Number of level 0 tables that triggers a compaction
+	LevelSize    uint64 // Maximum bytes in level 1
+}
+
+var DefaultOptions = Options{
+	MemtableSize: 4 << 20,
+	BlockSize:    4 << 10,
+	TableSize:    2 << 20,
+	L0Tables:     4,
+	LevelSize:    10 << 20,
+}
+
+type manifest struct {
+	NextFile uint64
+	Levels   [][]uint64
+}
+
+type DB struct {
+	dir      string
+	options  Options
+	nextFile uint64 // Accessed atomically
+
+	memLock sync.RWMutex // Guards the memtables, log and closed state
+	full    *sync.Cond   // Signalled when the immutable memtable has been flushed
+	mem     *memtable
+	imm     *memtable // Memtable waiting to be flushed, nil if there is none
+	wal     *writeAheadLog
+	closed  bool
+	bgErr   error
+
+	// Readers hold this while searching tables so compaction can't delete them underneath
+	versionLock sync.RWMutex
+	levels      [][]*table // Level 0 is ordered oldest to newest, the rest by smallest key
+
+	pointers [MaxLevels]string // Where the next compaction of each level starts in the key space
+	work     chan struct{}
+	done     chan struct{}
+}
+
+func Open(dir string, options Options) (*DB, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		dir:     dir,
+		options: options,
+		levels:  make([][]*table, MaxLevels),
+		work:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	db.full = sync.NewCond(&db.memLock)
+
+	m := manifest{NextFile: 1}
+	data, err := ioutil.ReadFile(path.Join(dir, manifestName))
+	if err == nil {
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("lsm: reading manifest: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	live := make(map[uint64]bool)
+	for level, numbers := range m.Levels {
+		if level >= MaxLevels {
+			return nil, fmt.Errorf("lsm: manifest has too many levels (%d)", len(m.Levels))
+		}
+		for _, number := range numbers {
+			t, err := openTable(db.tablePath(number), number)
+			if err != nil {
+				db.closeTables()
+				return nil, err
+			}
+			db.levels[level] = append(db.levels[level], t)
+			live[number] = true
+		}
+	}
+
+	// Clean up tables left behind by an interrupted compaction and find the logs to replay
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		db.closeTables()
+		return nil, err
+	}
+	var logs []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		number, err := strconv.ParseUint(strings.Split(name, ".")[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if number >= m.NextFile {
+			m.NextFile = number + 1
+		}
+		if strings.HasSuffix(name, ".sst") && !live[number] {
+			os.Remove(path.Join(dir, name))
+		} else if strings.HasSuffix(name, ".log") {
+			logs = append(logs, number)
+		}
+	}
+	db.nextFile = m.NextFile
+
+	sort.Sort(fileNumbers(logs))
+	mem := newMemtable(0)
+	for _, number := range logs {
+		if err := replayLog(db.logPath(number), mem); err != nil {
+			db.closeTables()
+			return nil, fmt.Errorf("lsm: replaying log %d: %v", number, err)
+		}
+	}
+	if len(mem.entries) > 0 {
+		tables, err := db.writeTables(mem.iterator(), 0, false)
+		if err != nil {
+			db.closeTables()
+			return nil, err
+		}
+		db.levels[0] = append(db.levels[0], tables...)
+	}
+	if err := db.writeManifest(db.levels); err != nil {
+		db.closeTables()
+		return nil, err
+	}
+	for _, number := range logs {
+		os.Remove(db.logPath(number))
+	}
+
+	number := db.newFileNumber()
+	db.wal, err = createLog(db.logPath(number))
+	if err != nil {
+		db.closeTables()
+		return nil, err
+	}
+	db.mem = newMemtable(number)
+
+	go db.background()
+	db.schedule()
+
+	return db, nil
+}
+
+type fileNumbers []uint64
+
+func (f fileNumbers) Len() int           { return len(f) }
+func (f fileNumbers) Less(i, j int) bool { return f[i] < f[j] }
+func (f fileNumbers) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+func (db *DB) tablePath(number uint64) string {
+	return path.Join(db.dir, fmt.Sprintf("%06d.sst", number))
+}
+
+func (db *DB) logPath(number uint64) string {
+	return path.Join(db.dir, fmt.Sprintf("%06d.log", number))
+}
+
+func (db *DB) newFileNumber() uint64 {
+	return atomic.AddUint64(&db.nextFile, 1) - 1
+}
+
+// Atomically replaces the manifest by writing a new one and renaming it into place
+func (db *DB) writeManifest(levels [][]*table) error {
+	m := manifest{Levels: make([][]uint64, len(levels))}
+	for level, tables := range levels {
+		m.Levels[level] = make([]uint64, len(tables))
+		for i, t := range tables {
+			m.Levels[level][i] = t.number
+		}
+	}
+	m.NextFile = atomic.LoadUint64(&db.nextFile)
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmpPath := path.Join(db.dir, manifestName+".tmp")
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path.Join(db.dir, manifestName))
+}
+
+func (db *DB) closeTables() {
+	for _, tables := range db.levels {
+		for _, t := range tables {
+			t.close()
+		}
+	}
+}
+
+// Returns the value stored for key and whether it was present
+func (db *DB) Get(key string) (string, bool, error) {
+	db.memLock.RLock()
+	if db.closed {
+		db.memLock.RUnlock()
+		return "", false, ErrClosed
+	}
+	e, found := db.mem.get(key)
+	if !found && db.imm != nil {
+		e, found = db.imm.get(key)
+	}
+	db.memLock.RUnlock()
+	if found {
+		return e.value, !e.deleted, nil
+	}
+
+	db.versionLock.RLock()
+	defer db.versionLock.RUnlock()
+
+	// Level 0 tables may overlap so the newest has to be checked first
+	level0 := db.levels[0]
+	for i := len(level0) - 1; i >= 0; i-- {
+		t := level0[i]
+		if key < t.smallest || key > t.largest {
+			continue
+		}
+		e, found, err := t.get(key)
+		if err != nil {
+			return "", false, err
+		}
+		if found {
+			return e.value, !e.deleted, nil
+		}
+	}
+
+	for _, tables := range db.levels[1:] {
+		i := sort.Search(len(tables), func(i int) bool { return tables[i].largest >= key })
+		if i == len(tables) || key < tables[i].smallest {
+			continue
+		}
+		e, found, err := tables[i].get(key)
+		if err != nil {
+			return "", false, err
+		}
+		if found {
+			return e.value, !e.deleted, nil
+		}
+	}
+	return "", false, nil
+}
+
+func (db *DB) Put(key string, value string) error {
+	return db.write(entry{key: key, value: value})
+}
+
+func (db *DB) Delete(key string) error {
+	return db.write(entry{key: key, deleted: true})
+}
+
+// Calls found with every live key starting with prefix and its value in key order,
+// stopping early if found returns false
+func (db *DB) Scan(prefix string, found func(key string, value string) bool) error {
+	return db.scan(prefix, prefix, found)
+}
+
+// Like Scan over every key from start on, tables are read from the block holding start
+func (db *DB) ScanFrom(start string, found func(key string, value string) bool) error {
+	return db.scan("", start, found)
+}
+
+func (db *DB) scan(prefix string, start string, found func(key string, value string) bool) error {
+	db.memLock.RLock()
+	if db.closed {
+		db.memLock.RUnlock()
+		return ErrClosed
+	}
+	inputs := []iterator{db.mem.iterator()}
+	if db.imm != nil {
+		inputs = append(inputs, db.imm.iterator())
+	}
+	db.memLock.RUnlock()
+
+	// Holding the version lock keeps compaction from closing the tables under us
+	db.versionLock.RLock()
+	defer db.versionLock.RUnlock()
+
+	mayContain := func(t *table) bool {
+		return t.largest >= start && (t.smallest <= start || strings.HasPrefix(t.smallest, prefix))
+	}
+	level0 := db.levels[0]
+	for i := len(level0) - 1; i >= 0; i-- {
+		if mayContain(level0[i]) {
+			inputs = append(inputs, level0[i].iteratorFrom(start))
+		}
+	}
+	for _, tables := range db.levels[1:] {
+		for _, t := range tables {
+			if mayContain(t) {
+				inputs = append(inputs, t.iteratorFrom(start))
+			}
+		}
+	}
+
+	it := newMergingIterator(inputs)
+	for it.next() {
+		e := it.entry()
+		if e.key < start || e.deleted {
+			continue
+		}
+		if !strings.HasPrefix(e.key, prefix) {
+			break
+		}
+		if !found(e.key, e.value) {
+			break
+		}
+	}
+	return it.err()
+}
+
+func (db *DB) write(e entry) error {
+	db.memLock.Lock()
+	defer db.memLock.Unlock()
+
+	if err := db.makeRoom(); err != nil {
+		return err
+	}
+	if err := db.wal.add(e); err != nil {
+		return err
+	}
+	db.mem.add(e)
+	return nil
+}
+
+// Swaps out a full memtable to be flushed, waiting if the previous one hasn't been yet
+func (db *DB) makeRoom() error {
+	for {
+		if db.closed {
+			return ErrClosed
+		}
+		if db.bgErr != nil {
+			return db.bgErr
+		}
+		if db.mem.size < db.options.MemtableSize {
+			return nil
+		}
+		if db.imm != nil {
+			db.full.Wait()
+			continue
+		}
+
+		number := db.newFileNumber()
+		wal, err := createLog(db.logPath(number))
+		if err != nil {
+			return err
+		}
+		if err := db.wal.close(); err != nil {
+			log.Printf("Error closing write ahead log: %v\n", err)
+		}
+		db.wal = wal
+		db.imm = db.mem
+		db.mem = newMemtable(number)
+		db.schedule()
+	}
+}
+
+// Wakes the background goroutine if it isn't already awake
+func (db *DB) schedule() {
+	select {
+	case db.work <- struct{}{}:
+	default:
+	}
+}
+
+func (db *DB) background() {
+	defer close(db.done)
+	for range db.work {
+		if err := db.flush(); err != nil {
+			log.Printf("Error flushing memtable: %v\n", err)
+			db.memLock.Lock()
+			db.bgErr = err
+			db.full.Broadcast()
+			db.memLock.Unlock()
+			continue
+		}
+
+		for c := db.pickCompaction(); c != nil; c = db.pickCompaction() {
+			if err := db.compact(c); err != nil {
+				log.Printf("Error compacting level %d: %v\n", c.level, err)
+				break
+			}
+		}
+	}
+}
+
+func (db *DB) flush() error {
+	db.memLock.RLock()
+	imm := db.imm
+	db.memLock.RUnlock()
+	if imm == nil {
+		return nil
+	}
+
+	tables, err := db.writeTables(imm.iterator(), 0, false)
+	if err != nil {
+		return err
+	}
+
+	levels := db.copyLevels()
+	levels[0] = append(levels[0], tables...)
+	if err := db.writeManifest(levels); err != nil {
+		for _, t := range tables {
+			t.close()
+			os.Remove(t.path)
+		}
+		return err
+	}
+	db.versionLock.Lock()
+	db.levels = levels
+	db.versionLock.Unlock()
+
+	db.memLock.Lock()
+	db.imm = nil
+	db.full.Broadcast()
+	db.memLock.Unlock()
+
+	os.Remove(db.logPath(imm.log))
+	return nil
+}
+
+func (db *DB) copyLevels() [][]*table {
+	levels := make([][]*table, len(db.levels))
+	for i, tables := range db.levels {
+		levels[i] = append([]*table(nil), tables...)
+	}
+	return levels
+}
+
+// Writes the entries from the iterator into new tables, starting a new table
+// each time one grows past limit (zero for no limit)
+func (db *DB) writeTables(it iterator, limit uint64, dropDeleted bool) ([]*table, error) {
+	var tables []*table
+	var writer *tableWriter
+	var number uint64
+	var err error
+
+	abort := func() {
+		if writer != nil {
+			writer.abort()
+		}
+		for _, t := range tables {
+			t.close()
+			os.Remove(t.path)
+		}
+	}
+
+	finish := func() error {
+		if err := writer.finish(); err != nil {
+			return err
+		}
+		t, err := openTable(writer.path, number)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, t)
+		writer = nil
+		return nil
+	}
+
+	for it.next() {
+		e := it.entry()
+		if e.deleted && dropDeleted {
+			continue
+		}
+		if writer == nil {
+			number = db.newFileNumber()
+			writer, err = createTable(db.tablePath(number), db.options.BlockSize)
+			if err != nil {
+				abort()
+				return nil, err
+			}
+		}
+		if err := writer.add(e); err != nil {
+			abort()
+			return nil, err
+		}
+		if limit > 0 && writer.size() >= limit {
+			if err := finish(); err != nil {
+				abort()
+				return nil, err
+			}
+		}
+	}
+	if err := it.err(); err != nil {
+		abort()
+		return nil, err
+	}
+	if writer != nil {
+		if err := finish(); err != nil {
+			abort()
+			return nil, err
+		}
+	}
+	return tables, nil
+}
+
+// Stops background work and closes every file, anything still in the
+// memtable is recovered from the write ahead log on the next Open
+func (db *DB) Close() error {
+	db.memLock.Lock()
+	if db.closed {
+		db.memLock.Unlock()
+		return ErrClosed
+	}
+	db.closed = true
+	close(db.work)
+	db.full.Broadcast()
+	err := db.wal.close()
+	db.memLock.Unlock()
+
+	<-db.done
+
+	db.versionLock.Lock()
+	defer db.versionLock.Unlock()
+	db.closeTables()
+	return err
+}
@@ -0,0 +1,160 @@
+package lsm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+var testOptions = Options{
+	MemtableSize: 4 << 10,
+	BlockSize:    256,
+	TableSize:    8 << 10,
+	L0Tables:     2,
+	LevelSize:    16 << 10,
+}
+
+func openTest(t *testing.T, dir string) *DB {
+	db, err := Open(dir, testOptions)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return db
+}
+
+func expect(t *testing.T, db *DB, key string, value string, present bool) {
+	out, found, err := db.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%s) failed: %v", key, err)
+	}
+	if found != present || out != value {
+		t.Fatalf("Get(%s) Expecting: (%s, %v), Received: (%s, %v)", key, value, present, out, found)
+	}
+}
+
+func TestPutGetDelete(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lsm")
+	defer os.RemoveAll(dir)
+
+	db := openTest(t, dir)
+	defer db.Close()
+
+	expect(t, db, "key", "", false)
+	db.Put("key", "value")
+	expect(t, db, "key", "value", true)
+	db.Put("key", "other")
+	expect(t, db, "key", "other", true)
+	db.Delete("key")
+	expect(t, db, "key", "", false)
+}
+
+func TestCompactionAndRecovery(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lsm")
+	defer os.RemoveAll(dir)
+
+	db := openTest(t, dir)
+	keys := 5000
+	for i := 0; i < keys; i++ {
+		if err := db.Put(fmt.Sprintf("key%06d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	// Overwrite and delete some keys so tombstones and shadowed values move through the levels
+	for i := 0; i < keys; i += 3 {
+		db.Put(fmt.Sprintf("key%06d", i), fmt.Sprintf("new%d", i))
+	}
+	for i := 1; i < keys; i += 7 {
+		db.Delete(fmt.Sprintf("key%06d", i))
+	}
+
+	check := func(db *DB) {
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("key%06d", i)
+			switch {
+			case i%7 == 1:
+				expect(t, db, key, "", false)
+			case i%3 == 0:
+				expect(t, db, key, fmt.Sprintf("new%d", i), true)
+			default:
+				expect(t, db, key, fmt.Sprintf("value%d", i), true)
+			}
+		}
+	}
+	check(db)
+
+	// Give compaction a chance to push data below level 0
+	time.Sleep(100 * time.Millisecond)
+	db.versionLock.RLock()
+	deeper := 0
+	for _, tables := range db.levels[1:] {
+		deeper += len(tables)
+	}
+	db.versionLock.RUnlock()
+	if deeper == 0 {
+		t.Fatal("No tables were compacted below level 0")
+	}
+	check(db)
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	db = openTest(t, dir)
+	defer db.Close()
+	check(db)
+}
+
+func TestScan(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lsm")
+	defer os.RemoveAll(dir)
+
+	db := openTest(t, dir)
+	defer db.Close()
+
+	// Enough keys that some are flushed to tables and some are still in the memtable
+	for i := 0; i < 2000; i++ {
+		db.Put(fmt.Sprintf("a%04d", i), "old")
+		db.Put(fmt.Sprintf("b%04d", i), "value")
+	}
+	for i := 0; i < 2000; i += 2 {
+		db.Put(fmt.Sprintf("a%04d", i), "new")
+		db.Delete(fmt.Sprintf("a%04d", i+1))
+	}
+
+	var keys []string
+	err := db.Scan("a", func(key string, value string) bool {
+		if value != "new" {
+			t.Fatalf("Scan(%s) Expecting: new, Received: %s", key, value)
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(keys) != 1000 || keys[0] != "a0000" || keys[999] != "a1998" {
+		t.Fatalf("Scan Expecting: 1000 keys from a0000 to a1998, Received: %d keys", len(keys))
+	}
+
+	count := 0
+	db.Scan("b", func(key string, value string) bool {
+		count++
+		return count < 10
+	})
+	if count != 10 {
+		t.Fatalf("Scan Expecting: to stop after 10 keys, Received: %d", count)
+	}
+	// Past the deleted a1999 straight into the b keys
+	keys = nil
+	err = db.ScanFrom("a1998\x00", func(key string, value string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("ScanFrom failed: %v", err)
+	}
+	if len(keys) != 2000 || keys[0] != "b0000" || keys[1999] != "b1999" {
+		t.Fatalf("ScanFrom Expecting: 2000 keys from b0000 to b1999, Received: %d keys", len(keys))
+	}
+}
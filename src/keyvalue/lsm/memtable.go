@@ -0,0 +1,180 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+const (
+	kindValue  byte = 0
+	kindDelete byte = 1
+)
+
+var errCorrupt = errors.New("lsm: corrupt data")
+
+type entry struct {
+	key     string
+	value   string
+	deleted bool // Tombstones shadow older values until compacted away
+}
+
+func appendString(buf []byte, s string) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], uint64(len(s)))
+	buf = append(buf, scratch[:n]...)
+	return append(buf, s...)
+}
+
+func readString(data []byte) (string, []byte, error) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < length {
+		return "", nil, errCorrupt
+	}
+	end := n + int(length)
+	return string(data[n:end]), data[end:], nil
+}
+
+func appendEntry(buf []byte, e entry) []byte {
+	buf = appendString(buf, e.key)
+	if e.deleted {
+		buf = append(buf, kindDelete)
+	} else {
+		buf = append(buf, kindValue)
+	}
+	return appendString(buf, e.value)
+}
+
+func decodeEntry(data []byte) (entry, []byte, error) {
+	var e entry
+	var err error
+	e.key, data, err = readString(data)
+	if err != nil {
+		return e, nil, err
+	}
+	if len(data) == 0 {
+		return e, nil, errCorrupt
+	}
+	e.deleted = data[0] == kindDelete
+	e.value, data, err = readString(data[1:])
+	return e, data, err
+}
+
+// Sorted stream of entries, used to flush memtables and merge tables together
+type iterator interface {
+	next() bool
+	entry() entry
+	err() error
+}
+
+type sliceIterator struct {
+	entries  []entry
+	position int
+}
+
+func (it *sliceIterator) next() bool {
+	it.position++
+	return it.position <= len(it.entries)
+}
+
+func (it *sliceIterator) entry() entry {
+	return it.entries[it.position-1]
+}
+
+func (it *sliceIterator) err() error {
+	return nil
+}
+
+// Merges several sorted iterators, when a key appears in more than one
+// the entry from the earliest input wins so inputs must be ordered newest first
+type mergingIterator struct {
+	inputs  []iterator
+	valid   []bool
+	started bool
+	current entry
+	error   error
+}
+
+func newMergingIterator(inputs []iterator) *mergingIterator {
+	return &mergingIterator{
+		inputs: inputs,
+		valid:  make([]bool, len(inputs)),
+	}
+}
+
+func (m *mergingIterator) next() bool {
+	if m.error != nil {
+		return false
+	}
+
+	for i, input := range m.inputs {
+		if !m.started || (m.valid[i] && input.entry().key == m.current.key) {
+			m.valid[i] = input.next()
+			if err := input.err(); err != nil {
+				m.error = err
+				return false
+			}
+		}
+	}
+	m.started = true
+
+	smallest := -1
+	for i, input := range m.inputs {
+		if m.valid[i] && (smallest < 0 || input.entry().key < m.inputs[smallest].entry().key) {
+			smallest = i
+		}
+	}
+	if smallest < 0 {
+		return false
+	}
+	m.current = m.inputs[smallest].entry()
+	return true
+}
+
+func (m *mergingIterator) entry() entry {
+	return m.current
+}
+
+func (m *mergingIterator) err() error {
+	return m.error
+}
+
+type memtable struct {
+	log     uint64 // Number of the write ahead log backing this memtable
+	entries map[string]entry
+	size    int
+}
+
+func newMemtable(log uint64) *memtable {
+	return &memtable{
+		log:     log,
+		entries: make(map[string]entry),
+	}
+}
+
+func (m *memtable) add(e entry) {
+	if old, present := m.entries[e.key]; present {
+		m.size -= len(old.key) + len(old.value)
+	}
+	m.entries[e.key] = e
+	m.size += len(e.key) + len(e.value)
+}
+
+func (m *memtable) get(key string) (entry, bool) {
+	e, present := m.entries[key]
+	return e, present
+}
+
+func (m *memtable) iterator() iterator {
+	keys := make([]string, 0, len(m.entries))
+	for key := range m.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	entries := make([]entry, len(keys))
+	for i, key := range keys {
+		entries[i] = m.entries[key]
+	}
+	return &sliceIterator{entries: entries}
+}
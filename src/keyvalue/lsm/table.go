@@ -0,0 +1,326 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+)
+
+// Tables are immutable sorted files laid out as
+//
+//	data blocks (entries followed by a crc32)
+//	bloom filter
+//	index block (smallest key, then the last key, offset and length of each data block)
+//	footer (bloom offset, bloom length, index offset, index length, magic)
+const (
+	footerSize        = 40
+	tableMagic uint64 = 0x6b766c736d746162
+)
+
+type indexEntry struct {
+	last   string // Last key stored in the block
+	offset uint64
+	length uint64
+}
+
+type tableWriter struct {
+	path      string
+	file      *os.File
+	writer    *bufio.Writer
+	blockSize int
+	offset    uint64
+	block     []byte
+	last      string
+	smallest  string
+	count     int
+	index     []indexEntry
+	hashes    []uint64
+}
+
+func createTable(path string, blockSize int) (*tableWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &tableWriter{
+		path:      path,
+		file:      f,
+		writer:    bufio.NewWriter(f),
+		blockSize: blockSize,
+	}, nil
+}
+
+// Entries must be added in increasing key order
+func (w *tableWriter) add(e entry) error {
+	if w.count == 0 {
+		w.smallest = e.key
+	}
+	w.count++
+	w.last = e.key
+	w.hashes = append(w.hashes, bloomHash(e.key))
+	w.block = appendEntry(w.block, e)
+	if len(w.block) >= w.blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+func (w *tableWriter) size() uint64 {
+	return w.offset + uint64(len(w.block))
+}
+
+func (w *tableWriter) write(data []byte) error {
+	_, err := w.writer.Write(data)
+	w.offset += uint64(len(data))
+	return err
+}
+
+func (w *tableWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(w.block))
+	w.block = append(w.block, checksum[:]...)
+
+	w.index = append(w.index, indexEntry{last: w.last, offset: w.offset, length: uint64(len(w.block))})
+	err := w.write(w.block)
+	w.block = w.block[:0]
+	return err
+}
+
+func (w *tableWriter) finish() error {
+	if err := w.flushBlock(); err != nil {
+		return err
+	}
+
+	bloomOffset := w.offset
+	filter := newBloom(w.hashes)
+	if err := w.write(filter); err != nil {
+		return err
+	}
+
+	indexOffset := w.offset
+	var scratch [binary.MaxVarintLen64]byte
+	index := appendString(nil, w.smallest)
+	for _, block := range w.index {
+		index = appendString(index, block.last)
+		n := binary.PutUvarint(scratch[:], block.offset)
+		index = append(index, scratch[:n]...)
+		n = binary.PutUvarint(scratch[:], block.length)
+		index = append(index, scratch[:n]...)
+	}
+	if err := w.write(index); err != nil {
+		return err
+	}
+
+	footer := make([]byte, footerSize)
+	binary.BigEndian.PutUint64(footer[0:], bloomOffset)
+	binary.BigEndian.PutUint64(footer[8:], uint64(len(filter)))
+	binary.BigEndian.PutUint64(footer[16:], indexOffset)
+	binary.BigEndian.PutUint64(footer[24:], uint64(len(index)))
+	binary.BigEndian.PutUint64(footer[32:], tableMagic)
+	if err := w.write(footer); err != nil {
+		return err
+	}
+
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+func (w *tableWriter) abort() {
+	w.file.Close()
+	os.Remove(w.path)
+}
+
+type table struct {
+	number   uint64
+	path     string
+	file     *os.File
+	size     uint64
+	smallest string
+	largest  string
+	index    []indexEntry
+	filter   bloom
+}
+
+func openTable(path string, number uint64) (*table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readTable(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lsm: reading table %s: %v", path, err)
+	}
+	t.number = number
+	t.path = path
+	return t, nil
+}
+
+func readTable(f *os.File) (*table, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(info.Size())
+	if size < footerSize {
+		return nil, errCorrupt
+	}
+
+	footer := make([]byte, footerSize)
+	if _, err := f.ReadAt(footer, int64(size-footerSize)); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint64(footer[32:]) != tableMagic {
+		return nil, errCorrupt
+	}
+	bloomOffset := binary.BigEndian.Uint64(footer[0:])
+	bloomLength := binary.BigEndian.Uint64(footer[8:])
+	indexOffset := binary.BigEndian.Uint64(footer[16:])
+	indexLength := binary.BigEndian.Uint64(footer[24:])
+	if bloomOffset+bloomLength > indexOffset || indexOffset+indexLength > size-footerSize {
+		return nil, errCorrupt
+	}
+
+	t := &table{file: f, size: size}
+	t.filter = make(bloom, bloomLength)
+	if _, err := f.ReadAt(t.filter, int64(bloomOffset)); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, indexLength)
+	if _, err := f.ReadAt(data, int64(indexOffset)); err != nil {
+		return nil, err
+	}
+	t.smallest, data, err = readString(data)
+	if err != nil {
+		return nil, err
+	}
+	for len(data) > 0 {
+		var block indexEntry
+		var n int
+		block.last, data, err = readString(data)
+		if err != nil {
+			return nil, err
+		}
+		block.offset, n = binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errCorrupt
+		}
+		data = data[n:]
+		block.length, n = binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errCorrupt
+		}
+		data = data[n:]
+		t.index = append(t.index, block)
+	}
+	if len(t.index) == 0 {
+		return nil, errCorrupt
+	}
+	t.largest = t.index[len(t.index)-1].last
+	return t, nil
+}
+
+func (t *table) readBlock(i int) ([]byte, error) {
+	block := t.index[i]
+	if block.length < 4 {
+		return nil, errCorrupt
+	}
+	data := make([]byte, block.length)
+	if _, err := t.file.ReadAt(data, int64(block.offset)); err != nil {
+		return nil, err
+	}
+	data, checksum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(checksum) {
+		return nil, fmt.Errorf("lsm: checksum mismatch in block %d of %s", i, t.path)
+	}
+	return data, nil
+}
+
+func (t *table) get(key string) (entry, bool, error) {
+	if !t.filter.mayContain(key) {
+		return entry{}, false, nil
+	}
+
+	// First block whose last key is not before the key is the only one that can hold it
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].last >= key })
+	if i == len(t.index) {
+		return entry{}, false, nil
+	}
+	data, err := t.readBlock(i)
+	if err != nil {
+		return entry{}, false, err
+	}
+	for len(data) > 0 {
+		var e entry
+		e, data, err = decodeEntry(data)
+		if err != nil {
+			return entry{}, false, err
+		}
+		if e.key == key {
+			return e, true, nil
+		} else if e.key > key {
+			break
+		}
+	}
+	return entry{}, false, nil
+}
+
+func (t *table) iterator() iterator {
+	return &tableIterator{table: t}
+}
+
+// Skips the blocks holding only keys before start
+func (t *table) iteratorFrom(start string) iterator {
+	block := sort.Search(len(t.index), func(i int) bool { return t.index[i].last >= start })
+	return &tableIterator{table: t, block: block}
+}
+
+func (t *table) close() error {
+	return t.file.Close()
+}
+
+type tableIterator struct {
+	table   *table
+	block   int
+	data    []byte
+	current entry
+	error   error
+}
+
+func (it *tableIterator) next() bool {
+	if it.error != nil {
+		return false
+	}
+	for len(it.data) == 0 {
+		if it.block >= len(it.table.index) {
+			return false
+		}
+		it.data, it.error = it.table.readBlock(it.block)
+		if it.error != nil {
+			return false
+		}
+		it.block++
+	}
+	it.current, it.data, it.error = decodeEntry(it.data)
+	return it.error == nil
+}
+
+func (it *tableIterator) entry() entry {
+	return it.current
+}
+
+func (it *tableIterator) err() error {
+	return it.error
+}
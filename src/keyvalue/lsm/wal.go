@@ -0,0 +1,77 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Every write is appended to the log before it reaches the memtable,
+// records are a crc32 and length followed by the encoded entry
+type writeAheadLog struct {
+	file   *os.File
+	buffer []byte
+}
+
+func createLog(path string) (*writeAheadLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{file: f}, nil
+}
+
+func (l *writeAheadLog) add(e entry) error {
+	record := append(l.buffer[:0], 0, 0, 0, 0, 0, 0, 0, 0)
+	record = appendEntry(record, e)
+	binary.BigEndian.PutUint32(record[0:], crc32.ChecksumIEEE(record[8:]))
+	binary.BigEndian.PutUint32(record[4:], uint32(len(record)-8))
+	l.buffer = record
+
+	_, err := l.file.Write(record)
+	return err
+}
+
+func (l *writeAheadLog) close() error {
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+func replayLog(path string, mem *memtable) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	for len(data) > 0 {
+		// A torn record at the tail means we crashed mid write, everything before it is intact
+		if len(data) < 8 {
+			log.Printf("Ignoring truncated record at the end of %s\n", path)
+			return nil
+		}
+		checksum := binary.BigEndian.Uint32(data[0:])
+		length := binary.BigEndian.Uint32(data[4:])
+		if uint64(len(data)-8) < uint64(length) {
+			log.Printf("Ignoring truncated record at the end of %s\n", path)
+			return nil
+		}
+		payload := data[8 : 8+length]
+		if crc32.ChecksumIEEE(payload) != checksum {
+			log.Printf("Ignoring corrupt record at the end of %s\n", path)
+			return nil
+		}
+
+		e, _, err := decodeEntry(payload)
+		if err != nil {
+			return err
+		}
+		mem.add(e)
+		data = data[8+length:]
+	}
+	return nil
+}
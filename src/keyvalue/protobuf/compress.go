@@ -0,0 +1,50 @@
+package protobuf
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Offered in the handshake by peers that accept deflated values. Once both sides
+// agree either may send a value chunk deflated, marked by compressed on its message.
+const FeatureDeflate = "deflate"
+
+// Values smaller than this aren't worth the time to compress
+const MinCompressSize = 512
+
+// Returns the deflated data and true, or the data as is and false if it is too
+// small or doesn't get any smaller
+func Deflate(data []byte) ([]byte, bool) {
+	if len(data) < MinCompressSize {
+		return data, false
+	}
+	var buffer bytes.Buffer
+	w, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+	if err != nil {
+		return data, false
+	}
+	if _, err := w.Write(data); err != nil {
+		return data, false
+	}
+	if err := w.Close(); err != nil || buffer.Len() >= len(data) {
+		return data, false
+	}
+	return buffer.Bytes(), true
+}
+
+// Stops at limit bytes so a small message can't inflate into an enormous one
+func Inflate(data []byte, limit int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	inflated, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(inflated) > limit {
+		return nil, fmt.Errorf("compressed value inflates past %d bytes", limit)
+	}
+	return inflated, nil
+}
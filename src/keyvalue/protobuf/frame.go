@@ -0,0 +1,54 @@
+package protobuf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// Every message on the wire is framed as a 4 byte big endian length followed
+// by the protobuf encoding. Values that don't fit in one frame are split into
+// chunks sent as consecutive messages with the same id and more set on all but the last.
+const DefaultMaxFrameSize uint32 = 1 << 20
+
+// Room reserved in each frame for everything but the id, key and value bytes
+const FrameOverhead = 64
+
+// How many value bytes fit in a chunk alongside the given id and key
+func ChunkSize(maxFrameSize uint32, id string, key []byte) int {
+	return int(maxFrameSize) - FrameOverhead - len(id) - len(key)
+}
+
+func ReadFrame(r io.Reader, maxFrameSize uint32, message proto.Message) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(header)
+	// Check before allocating so a bogus length can't exhaust memory
+	if length > maxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds maximum of %d", length, maxFrameSize)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, message)
+}
+
+// The length and message go out in a single write so concurrent writers can't interleave them
+func WriteFrame(w io.Writer, message proto.Message) error {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	_, err = w.Write(frame)
+	return err
+}
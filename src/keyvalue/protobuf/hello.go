@@ -0,0 +1,63 @@
+package protobuf
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// Version 1 was the original protocol without a handshake. Version 2 added the
+// handshake, the operation enum, status responses and chunked values.
+const (
+	ProtocolVersion    uint32 = 2
+	MinProtocolVersion uint32 = 2
+)
+
+// Offered in the handshake by clients that give a session in their hello. Once
+// agreed the server remembers the answers to recent sets by session and request
+// id, so a set retried on a new connection is answered again rather than applied twice.
+const FeatureDedupe = "dedupe"
+
+// Offered by clients that cache what they read. Once agreed the server pushes
+// responses with id InvalidateId listing keys written since the client read them
+const (
+	FeatureInvalidate = "invalidate"
+	InvalidateId      = "invalidate"
+)
+
+// Offered by servers that take a request with abort set as the end of an upload
+// the client gave up on. Without it a client drops the connection instead.
+const FeatureAbort = "abort"
+
+func NewHello(features []string, maxFrameSize uint32) *Hello {
+	return &Hello{
+		Version:      proto.Uint32(ProtocolVersion),
+		Features:     features,
+		MaxFrameSize: proto.Uint32(maxFrameSize),
+	}
+}
+
+func SupportedVersion(version uint32) bool {
+	return version >= MinProtocolVersion && version <= ProtocolVersion
+}
+
+// Features offered by both sides of the handshake
+func Negotiate(ours []string, theirs []string) map[string]bool {
+	offered := make(map[string]bool)
+	for _, feature := range theirs {
+		offered[feature] = true
+	}
+	features := make(map[string]bool)
+	for _, feature := range ours {
+		if offered[feature] {
+			features[feature] = true
+		}
+	}
+	return features
+}
+
+// Frames sent to a peer must fit both our limit and the one it declared
+func PeerFrameSize(ours uint32, hello *Hello) uint32 {
+	if theirs := hello.GetMaxFrameSize(); theirs > 0 && theirs < ours {
+		return theirs
+	}
+	return ours
+}
@@ -10,23 +10,150 @@ It is generated from these files:
 
 It has these top-level messages:
 	Request
+	Status
 	Response
+	Hello
+	Credentials
+	GetRequest
+	SetRequest
+	DeleteRequest
+	ValueResponse
 */
 package protobuf
 
 import proto "code.google.com/p/goprotobuf/proto"
 import math "math"
 
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
 // Reference imports to suppress errors if they are not otherwise used.
 var _ = proto.Marshal
 var _ = math.Inf
 
+type Request_Operation int32
+
+const (
+	Request_GET   Request_Operation = 1
+	Request_SET   Request_Operation = 2
+	Request_HELLO Request_Operation = 3
+	Request_PING  Request_Operation = 4
+	Request_SYNC  Request_Operation = 5
+)
+
+var Request_Operation_name = map[int32]string{
+	1: "GET",
+	2: "SET",
+	3: "HELLO",
+	4: "PING",
+	5: "SYNC",
+}
+var Request_Operation_value = map[string]int32{
+	"GET":   1,
+	"SET":   2,
+	"HELLO": 3,
+	"PING":  4,
+	"SYNC":  5,
+}
+
+func (x Request_Operation) Enum() *Request_Operation {
+	p := new(Request_Operation)
+	*p = x
+	return p
+}
+func (x Request_Operation) String() string {
+	return proto.EnumName(Request_Operation_name, int32(x))
+}
+func (x *Request_Operation) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(Request_Operation_value, data, "Request_Operation")
+	if err != nil {
+		return err
+	}
+	*x = Request_Operation(value)
+	return nil
+}
+
+type Status_Code int32
+
+const (
+	Status_OK                Status_Code = 0
+	Status_NOT_FOUND         Status_Code = 1
+	Status_ERROR             Status_Code = 2
+	Status_UNKNOWN_OPERATION Status_Code = 3
+	Status_TOO_LARGE         Status_Code = 4
+	Status_VERSION_MISMATCH  Status_Code = 5
+	Status_UNAUTHENTICATED   Status_Code = 6
+	Status_PERMISSION_DENIED Status_Code = 7
+	Status_DEADLINE_EXCEEDED Status_Code = 8
+	Status_REDIRECT          Status_Code = 9
+	Status_BUSY              Status_Code = 10
+	Status_INVALID           Status_Code = 11
+)
+
+var Status_Code_name = map[int32]string{
+	0:  "OK",
+	1:  "NOT_FOUND",
+	2:  "ERROR",
+	3:  "UNKNOWN_OPERATION",
+	4:  "TOO_LARGE",
+	5:  "VERSION_MISMATCH",
+	6:  "UNAUTHENTICATED",
+	7:  "PERMISSION_DENIED",
+	8:  "DEADLINE_EXCEEDED",
+	9:  "REDIRECT",
+	10: "BUSY",
+	11: "INVALID",
+}
+var Status_Code_value = map[string]int32{
+	"OK":                0,
+	"NOT_FOUND":         1,
+	"ERROR":             2,
+	"UNKNOWN_OPERATION": 3,
+	"TOO_LARGE":         4,
+	"VERSION_MISMATCH":  5,
+	"UNAUTHENTICATED":   6,
+	"PERMISSION_DENIED": 7,
+	"DEADLINE_EXCEEDED": 8,
+	"REDIRECT":          9,
+	"BUSY":              10,
+	"INVALID":           11,
+}
+
+func (x Status_Code) Enum() *Status_Code {
+	p := new(Status_Code)
+	*p = x
+	return p
+}
+func (x Status_Code) String() string {
+	return proto.EnumName(Status_Code_name, int32(x))
+}
+func (x *Status_Code) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(Status_Code_value, data, "Status_Code")
+	if err != nil {
+		return err
+	}
+	*x = Status_Code(value)
+	return nil
+}
+
 type Request struct {
-	Id               *string `protobuf:"bytes,1,req,name=id" json:"id,omitempty"`
-	Type             *string `protobuf:"bytes,2,req,name=type" json:"type,omitempty"`
-	Key              *string `protobuf:"bytes,3,req,name=key" json:"key,omitempty"`
-	Value            *string `protobuf:"bytes,4,opt,name=value" json:"value,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	Id               *string            `protobuf:"bytes,1,req,name=id" json:"id,omitempty"`
+	Type             *string            `protobuf:"bytes,2,opt,name=type" json:"type,omitempty"`
+	Key              []byte             `protobuf:"bytes,3,req,name=key" json:"key,omitempty"`
+	Value            []byte             `protobuf:"bytes,4,opt,name=value" json:"value,omitempty"`
+	More             *bool              `protobuf:"varint,5,opt,name=more" json:"more,omitempty"`
+	Op               *Request_Operation `protobuf:"varint,6,opt,name=op,enum=protobuf.Request_Operation" json:"op,omitempty"`
+	Hello            *Hello             `protobuf:"bytes,7,opt,name=hello" json:"hello,omitempty"`
+	Compressed       *bool              `protobuf:"varint,8,opt,name=compressed" json:"compressed,omitempty"`
+	Timeout          *uint32            `protobuf:"varint,9,opt,name=timeout" json:"timeout,omitempty"`
+	MaxStaleness     *uint32            `protobuf:"varint,10,opt,name=max_staleness" json:"max_staleness,omitempty"`
+	MinSequence      *uint64            `protobuf:"varint,11,opt,name=min_sequence" json:"min_sequence,omitempty"`
+	Abort            *bool              `protobuf:"varint,12,opt,name=abort" json:"abort,omitempty"`
+	XXX_unrecognized []byte             `json:"-"`
 }
 
 func (m *Request) Reset()         { *m = Request{} }
@@ -47,25 +174,112 @@ func (m *Request) GetType() string {
 	return ""
 }
 
-func (m *Request) GetKey() string {
-	if m != nil && m.Key != nil {
-		return *m.Key
+func (m *Request) GetKey() []byte {
+	if m != nil {
+		return m.Key
 	}
-	return ""
+	return nil
+}
+
+func (m *Request) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+func (m *Request) GetMore() bool {
+	if m != nil && m.More != nil {
+		return *m.More
+	}
+	return false
+}
+
+func (m *Request) GetOp() Request_Operation {
+	if m != nil && m.Op != nil {
+		return *m.Op
+	}
+	return Request_GET
 }
 
-func (m *Request) GetValue() string {
-	if m != nil && m.Value != nil {
-		return *m.Value
+func (m *Request) GetHello() *Hello {
+	if m != nil {
+		return m.Hello
+	}
+	return nil
+}
+
+func (m *Request) GetCompressed() bool {
+	if m != nil && m.Compressed != nil {
+		return *m.Compressed
+	}
+	return false
+}
+
+func (m *Request) GetTimeout() uint32 {
+	if m != nil && m.Timeout != nil {
+		return *m.Timeout
+	}
+	return 0
+}
+
+func (m *Request) GetMaxStaleness() uint32 {
+	if m != nil && m.MaxStaleness != nil {
+		return *m.MaxStaleness
+	}
+	return 0
+}
+
+func (m *Request) GetMinSequence() uint64 {
+	if m != nil && m.MinSequence != nil {
+		return *m.MinSequence
+	}
+	return 0
+}
+
+func (m *Request) GetAbort() bool {
+	if m != nil && m.Abort != nil {
+		return *m.Abort
+	}
+	return false
+}
+
+type Status struct {
+	Code             *Status_Code `protobuf:"varint,1,req,name=code,enum=protobuf.Status_Code" json:"code,omitempty"`
+	Message          *string      `protobuf:"bytes,2,opt,name=message" json:"message,omitempty"`
+	XXX_unrecognized []byte       `json:"-"`
+}
+
+func (m *Status) Reset()         { *m = Status{} }
+func (m *Status) String() string { return proto.CompactTextString(m) }
+func (*Status) ProtoMessage()    {}
+
+func (m *Status) GetCode() Status_Code {
+	if m != nil && m.Code != nil {
+		return *m.Code
+	}
+	return Status_OK
+}
+
+func (m *Status) GetMessage() string {
+	if m != nil && m.Message != nil {
+		return *m.Message
 	}
 	return ""
 }
 
 type Response struct {
-	Id               *string `protobuf:"bytes,1,req,name=id" json:"id,omitempty"`
-	Result           *int32  `protobuf:"varint,2,req,name=result" json:"result,omitempty"`
-	Value            *string `protobuf:"bytes,3,opt,name=value" json:"value,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	Id               *string  `protobuf:"bytes,1,req,name=id" json:"id,omitempty"`
+	Result           *int32   `protobuf:"varint,2,req,name=result" json:"result,omitempty"`
+	Value            []byte   `protobuf:"bytes,3,opt,name=value" json:"value,omitempty"`
+	More             *bool    `protobuf:"varint,4,opt,name=more" json:"more,omitempty"`
+	Status           *Status  `protobuf:"bytes,5,opt,name=status" json:"status,omitempty"`
+	Hello            *Hello   `protobuf:"bytes,6,opt,name=hello" json:"hello,omitempty"`
+	Compressed       *bool    `protobuf:"varint,7,opt,name=compressed" json:"compressed,omitempty"`
+	Leader           *string  `protobuf:"bytes,8,opt,name=leader" json:"leader,omitempty"`
+	Invalidate       [][]byte `protobuf:"bytes,9,rep,name=invalidate" json:"invalidate,omitempty"`
+	Sequence         *uint64  `protobuf:"varint,10,opt,name=sequence" json:"sequence,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
 }
 
 func (m *Response) Reset()         { *m = Response{} }
@@ -86,12 +300,521 @@ func (m *Response) GetResult() int32 {
 	return 0
 }
 
-func (m *Response) GetValue() string {
-	if m != nil && m.Value != nil {
-		return *m.Value
+func (m *Response) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+func (m *Response) GetMore() bool {
+	if m != nil && m.More != nil {
+		return *m.More
+	}
+	return false
+}
+
+func (m *Response) GetStatus() *Status {
+	if m != nil {
+		return m.Status
+	}
+	return nil
+}
+
+func (m *Response) GetHello() *Hello {
+	if m != nil {
+		return m.Hello
+	}
+	return nil
+}
+
+func (m *Response) GetCompressed() bool {
+	if m != nil && m.Compressed != nil {
+		return *m.Compressed
+	}
+	return false
+}
+
+func (m *Response) GetLeader() string {
+	if m != nil && m.Leader != nil {
+		return *m.Leader
 	}
 	return ""
 }
 
+func (m *Response) GetInvalidate() [][]byte {
+	if m != nil {
+		return m.Invalidate
+	}
+	return nil
+}
+
+func (m *Response) GetSequence() uint64 {
+	if m != nil && m.Sequence != nil {
+		return *m.Sequence
+	}
+	return 0
+}
+
+type Hello struct {
+	Version          *uint32      `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
+	Features         []string     `protobuf:"bytes,2,rep,name=features" json:"features,omitempty"`
+	MaxFrameSize     *uint32      `protobuf:"varint,3,opt,name=max_frame_size" json:"max_frame_size,omitempty"`
+	Credentials      *Credentials `protobuf:"bytes,4,opt,name=credentials" json:"credentials,omitempty"`
+	Session          *string      `protobuf:"bytes,5,opt,name=session" json:"session,omitempty"`
+	Leader           *string      `protobuf:"bytes,6,opt,name=leader" json:"leader,omitempty"`
+	XXX_unrecognized []byte       `json:"-"`
+}
+
+func (m *Hello) Reset()         { *m = Hello{} }
+func (m *Hello) String() string { return proto.CompactTextString(m) }
+func (*Hello) ProtoMessage()    {}
+
+func (m *Hello) GetVersion() uint32 {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return 0
+}
+
+func (m *Hello) GetFeatures() []string {
+	if m != nil {
+		return m.Features
+	}
+	return nil
+}
+
+func (m *Hello) GetMaxFrameSize() uint32 {
+	if m != nil && m.MaxFrameSize != nil {
+		return *m.MaxFrameSize
+	}
+	return 0
+}
+
+func (m *Hello) GetCredentials() *Credentials {
+	if m != nil {
+		return m.Credentials
+	}
+	return nil
+}
+
+func (m *Hello) GetSession() string {
+	if m != nil && m.Session != nil {
+		return *m.Session
+	}
+	return ""
+}
+
+func (m *Hello) GetLeader() string {
+	if m != nil && m.Leader != nil {
+		return *m.Leader
+	}
+	return ""
+}
+
+type Credentials struct {
+	Username         *string `protobuf:"bytes,1,opt,name=username" json:"username,omitempty"`
+	Password         *string `protobuf:"bytes,2,opt,name=password" json:"password,omitempty"`
+	Token            *string `protobuf:"bytes,3,opt,name=token" json:"token,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Credentials) Reset()         { *m = Credentials{} }
+func (m *Credentials) String() string { return proto.CompactTextString(m) }
+func (*Credentials) ProtoMessage()    {}
+
+func (m *Credentials) GetUsername() string {
+	if m != nil && m.Username != nil {
+		return *m.Username
+	}
+	return ""
+}
+
+func (m *Credentials) GetPassword() string {
+	if m != nil && m.Password != nil {
+		return *m.Password
+	}
+	return ""
+}
+
+func (m *Credentials) GetToken() string {
+	if m != nil && m.Token != nil {
+		return *m.Token
+	}
+	return ""
+}
+
+type GetRequest struct {
+	Key              []byte `protobuf:"bytes,1,req,name=key" json:"key,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *GetRequest) Reset()         { *m = GetRequest{} }
+func (m *GetRequest) String() string { return proto.CompactTextString(m) }
+func (*GetRequest) ProtoMessage()    {}
+
+func (m *GetRequest) GetKey() []byte {
+	if m != nil {
+		return m.Key
+	}
+	return nil
+}
+
+type SetRequest struct {
+	Key              []byte `protobuf:"bytes,1,req,name=key" json:"key,omitempty"`
+	Value            []byte `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *SetRequest) Reset()         { *m = SetRequest{} }
+func (m *SetRequest) String() string { return proto.CompactTextString(m) }
+func (*SetRequest) ProtoMessage()    {}
+
+func (m *SetRequest) GetKey() []byte {
+	if m != nil {
+		return m.Key
+	}
+	return nil
+}
+
+func (m *SetRequest) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+type DeleteRequest struct {
+	Key              []byte `protobuf:"bytes,1,req,name=key" json:"key,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *DeleteRequest) Reset()         { *m = DeleteRequest{} }
+func (m *DeleteRequest) String() string { return proto.CompactTextString(m) }
+func (*DeleteRequest) ProtoMessage()    {}
+
+func (m *DeleteRequest) GetKey() []byte {
+	if m != nil {
+		return m.Key
+	}
+	return nil
+}
+
+type ValueResponse struct {
+	Status           *Status `protobuf:"bytes,1,req,name=status" json:"status,omitempty"`
+	Value            []byte  `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *ValueResponse) Reset()         { *m = ValueResponse{} }
+func (m *ValueResponse) String() string { return proto.CompactTextString(m) }
+func (*ValueResponse) ProtoMessage()    {}
+
+func (m *ValueResponse) GetStatus() *Status {
+	if m != nil {
+		return m.Status
+	}
+	return nil
+}
+
+func (m *ValueResponse) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
 func init() {
+	proto.RegisterEnum("protobuf.Request_Operation", Request_Operation_name, Request_Operation_value)
+	proto.RegisterEnum("protobuf.Status_Code", Status_Code_name, Status_Code_value)
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// KeyValueClient is the client API for KeyValue service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type KeyValueClient interface {
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*ValueResponse, error)
+	Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*ValueResponse, error)
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*ValueResponse, error)
+	GetStream(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (KeyValue_GetStreamClient, error)
+	SetStream(ctx context.Context, opts ...grpc.CallOption) (KeyValue_SetStreamClient, error)
+}
+
+type keyValueClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewKeyValueClient(cc *grpc.ClientConn) KeyValueClient {
+	return &keyValueClient{cc}
+}
+
+func (c *keyValueClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*ValueResponse, error) {
+	out := new(ValueResponse)
+	err := c.cc.Invoke(ctx, "/protobuf.KeyValue/Get", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyValueClient) Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*ValueResponse, error) {
+	out := new(ValueResponse)
+	err := c.cc.Invoke(ctx, "/protobuf.KeyValue/Set", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyValueClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*ValueResponse, error) {
+	out := new(ValueResponse)
+	err := c.cc.Invoke(ctx, "/protobuf.KeyValue/Delete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyValueClient) GetStream(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (KeyValue_GetStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_KeyValue_serviceDesc.Streams[0], "/protobuf.KeyValue/GetStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &keyValueGetStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type KeyValue_GetStreamClient interface {
+	Recv() (*ValueResponse, error)
+	grpc.ClientStream
+}
+
+type keyValueGetStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *keyValueGetStreamClient) Recv() (*ValueResponse, error) {
+	m := new(ValueResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *keyValueClient) SetStream(ctx context.Context, opts ...grpc.CallOption) (KeyValue_SetStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_KeyValue_serviceDesc.Streams[1], "/protobuf.KeyValue/SetStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &keyValueSetStreamClient{stream}
+	return x, nil
+}
+
+type KeyValue_SetStreamClient interface {
+	Send(*SetRequest) error
+	CloseAndRecv() (*ValueResponse, error)
+	grpc.ClientStream
+}
+
+type keyValueSetStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *keyValueSetStreamClient) Send(m *SetRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *keyValueSetStreamClient) CloseAndRecv() (*ValueResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(ValueResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// KeyValueServer is the server API for KeyValue service.
+type KeyValueServer interface {
+	Get(context.Context, *GetRequest) (*ValueResponse, error)
+	Set(context.Context, *SetRequest) (*ValueResponse, error)
+	Delete(context.Context, *DeleteRequest) (*ValueResponse, error)
+	GetStream(*GetRequest, KeyValue_GetStreamServer) error
+	SetStream(KeyValue_SetStreamServer) error
+}
+
+// UnimplementedKeyValueServer can be embedded to have forward compatible implementations.
+type UnimplementedKeyValueServer struct {
+}
+
+func (*UnimplementedKeyValueServer) Get(ctx context.Context, req *GetRequest) (*ValueResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+
+func (*UnimplementedKeyValueServer) Set(ctx context.Context, req *SetRequest) (*ValueResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Set not implemented")
+}
+
+func (*UnimplementedKeyValueServer) Delete(ctx context.Context, req *DeleteRequest) (*ValueResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+
+func (*UnimplementedKeyValueServer) GetStream(req *GetRequest, srv KeyValue_GetStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetStream not implemented")
+}
+
+func (*UnimplementedKeyValueServer) SetStream(srv KeyValue_SetStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method SetStream not implemented")
+}
+
+func RegisterKeyValueServer(s *grpc.Server, srv KeyValueServer) {
+	s.RegisterService(&_KeyValue_serviceDesc, srv)
+}
+
+func _KeyValue_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyValueServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/protobuf.KeyValue/Get",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyValueServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyValue_Set_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyValueServer).Set(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/protobuf.KeyValue/Set",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyValueServer).Set(ctx, req.(*SetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyValue_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyValueServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/protobuf.KeyValue/Delete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyValueServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyValue_GetStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KeyValueServer).GetStream(m, &keyValueGetStreamServer{stream})
+}
+
+type KeyValue_GetStreamServer interface {
+	Send(*ValueResponse) error
+	grpc.ServerStream
+}
+
+type keyValueGetStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *keyValueGetStreamServer) Send(m *ValueResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _KeyValue_SetStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(KeyValueServer).SetStream(&keyValueSetStreamServer{stream})
+}
+
+type KeyValue_SetStreamServer interface {
+	SendAndClose(*ValueResponse) error
+	Recv() (*SetRequest, error)
+	grpc.ServerStream
+}
+
+type keyValueSetStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *keyValueSetStreamServer) SendAndClose(m *ValueResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *keyValueSetStreamServer) Recv() (*SetRequest, error) {
+	m := new(SetRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _KeyValue_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "protobuf.KeyValue",
+	HandlerType: (*KeyValueServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler:    _KeyValue_Get_Handler,
+		},
+		{
+			MethodName: "Set",
+			Handler:    _KeyValue_Set_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _KeyValue_Delete_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "GetStream",
+			Handler:       _KeyValue_GetStream_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "SetStream",
+			Handler:       _KeyValue_SetStream_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "service.proto",
 }
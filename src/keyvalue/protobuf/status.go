@@ -0,0 +1,35 @@
+package protobuf
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+)
+
+func NewStatus(code Status_Code, message string) *Status {
+	status := &Status{Code: code.Enum()}
+	if message != "" {
+		status.Message = proto.String(message)
+	}
+	return status
+}
+
+// Status for one of the result codes returned by keyvalue.Service
+func ResultStatus(result int) *Status {
+	switch result {
+	case 0:
+		return NewStatus(Status_OK, "")
+	case 1:
+		return NewStatus(Status_NOT_FOUND, "")
+	}
+	return NewStatus(Status_ERROR, "server error, see the server log")
+}
+
+// Result code for the status, which is also what old clients read from Response.result
+func (s *Status) Result() int {
+	switch s.GetCode() {
+	case Status_OK:
+		return 0
+	case Status_NOT_FOUND:
+		return 1
+	}
+	return -1
+}
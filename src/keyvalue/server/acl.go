@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Access control, loaded from a JSON file naming each principal, how it
+// authenticates and the key prefixes it may read or write:
+//
+//   {
+//     "principals": [
+//       {"name": "alice", "password": "secret", "grants": [{"prefix": "alice/", "access": "rw"}]},
+//       {"name": "backup", "token": "4f9c2e", "grants": [{"prefix": "", "access": "r"}]}
+//     ],
+//     "anonymous": [{"prefix": "public/", "access": "r"}]
+//   }
+//
+// Clients that don't authenticate get the anonymous grants, which are none by
+// default. Secrets are compared as given so serve TLS when using an ACL.
+
+const anonymousName = "anonymous"
+
+var errUnauthenticated = errors.New("unknown user, wrong password or unknown token")
+
+type aclFile struct {
+	Principals []aclPrincipal `json:"principals"`
+	Anonymous  []grant        `json:"anonymous"`
+}
+
+type aclPrincipal struct {
+	Name     string  `json:"name"`
+	Password string  `json:"password"`
+	Token    string  `json:"token"`
+	Grants   []grant `json:"grants"`
+}
+
+type grant struct {
+	Prefix string `json:"prefix"`
+	Access string `json:"access"` // r, w or rw
+}
+
+// Who a connection authenticated as and what it may touch
+type principal struct {
+	name   string
+	grants []grant
+}
+
+type acl struct {
+	principals []aclPrincipal
+	anonymous  *principal
+}
+
+func loadACL(file string) (*acl, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var parsed aclFile
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, p := range parsed.Principals {
+		switch {
+		case p.Name == "" || p.Name == anonymousName:
+			return nil, fmt.Errorf("principal name '%s' is not allowed", p.Name)
+		case names[p.Name]:
+			return nil, fmt.Errorf("principal %s is listed twice", p.Name)
+		case p.Password == "" && p.Token == "":
+			return nil, fmt.Errorf("principal %s needs a password or a token", p.Name)
+		}
+		names[p.Name] = true
+		if err := checkGrants(p.Grants); err != nil {
+			return nil, fmt.Errorf("principal %s: %v", p.Name, err)
+		}
+	}
+	if err := checkGrants(parsed.Anonymous); err != nil {
+		return nil, fmt.Errorf("anonymous: %v", err)
+	}
+
+	return &acl{
+		principals: parsed.Principals,
+		anonymous:  &principal{name: anonymousName, grants: parsed.Anonymous},
+	}, nil
+}
+
+func checkGrants(grants []grant) error {
+	for _, g := range grants {
+		switch g.Access {
+		case "r", "w", "rw", "wr":
+		default:
+			return fmt.Errorf("access '%s' for prefix '%s' must be r, w or rw", g.Access, g.Prefix)
+		}
+	}
+	return nil
+}
+
+// No credentials at all is the anonymous principal. Every principal is checked
+// in constant time so the response time doesn't give away which part was wrong.
+func (a *acl) authenticate(username string, password string, token string) (*principal, error) {
+	if username == "" && password == "" && token == "" {
+		return a.anonymous, nil
+	}
+	var found *aclPrincipal
+	for i := range a.principals {
+		p := &a.principals[i]
+		var match int
+		if token != "" {
+			match = secretsEqual(p.Token, token)
+		} else {
+			match = secretsEqual(p.Name, username) & secretsEqual(p.Password, password)
+		}
+		if match == 1 && found == nil {
+			found = p
+		}
+	}
+	if found == nil {
+		return nil, errUnauthenticated
+	}
+	return &principal{name: found.Name, grants: found.Grants}, nil
+}
+
+// An empty secret never matches, principals without a token can't log in with one
+func secretsEqual(secret string, given string) int {
+	if secret == "" {
+		return 0
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(given))
+}
+
+// Credentials from an HTTP or gRPC authorization header, either Basic or Bearer
+func (a *acl) authorization(header string) (*principal, error) {
+	if header == "" {
+		return a.anonymous, nil
+	}
+	split := strings.SplitN(header, " ", 2)
+	if len(split) != 2 {
+		return nil, errUnauthenticated
+	}
+	switch strings.ToLower(split[0]) {
+	case "bearer":
+		return a.authenticate("", "", strings.TrimSpace(split[1]))
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(split[1]))
+		if err != nil {
+			return nil, errUnauthenticated
+		}
+		credentials := strings.SplitN(string(decoded), ":", 2)
+		if len(credentials) != 2 || credentials[0] == "" {
+			return nil, errUnauthenticated
+		}
+		return a.authenticate(credentials[0], credentials[1], "")
+	}
+	return nil, errUnauthenticated
+}
+
+// Any grant whose prefix starts the key allows it
+func (p *principal) can(key string, write bool) bool {
+	access := "r"
+	if write {
+		access = "w"
+	}
+	for _, g := range p.grants {
+		if strings.HasPrefix(key, g.Prefix) && strings.Contains(g.Access, access) {
+			return true
+		}
+	}
+	return false
+}
+
+// Without an ACL everyone may do anything and the principal is nil
+func (s *Server) authorized(p *principal, key string, write bool) bool {
+	return s.acl == nil || p.can(key, write)
+}
+
+func (s *Server) anonymous() *principal {
+	if s.acl == nil {
+		return nil
+	}
+	return s.acl.anonymous
+}
+
+func denied(p *principal, key string, write bool) string {
+	access := "read"
+	if write {
+		access = "write"
+	}
+	return fmt.Sprintf("%s may not %s key '%s'", p.name, access, key)
+}
+
+// Drops the keys p may not read
+func (s *Server) readable(p *principal, keys []string) []string {
+	if s.acl == nil {
+		return keys
+	}
+	allowed := keys[:0]
+	for _, key := range keys {
+		if p.can(key, false) {
+			allowed = append(allowed, key)
+		}
+	}
+	return allowed
+}
+
+type principalKey struct{}
+
+// The HTTP gateway and gRPC keep the principal of a request in its context
+func withPrincipal(ctx context.Context, p *principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+func contextPrincipal(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return p
+}
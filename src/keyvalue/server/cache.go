@@ -0,0 +1,366 @@
+package server
+
+import (
+	"keyvalue/protobuf"
+
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync/atomic"
+)
+
+// When the server has a memory budget, cold keys are evicted from store once
+// it grows past the budget and their values are read back from the persistence
+// files. Only clean keys, whose latest value is already on disk, can be evicted.
+
+// Where a persisted value lives inside one of the files in LogDir
+type location struct {
+	file       string
+	offset     int64
+	length     int64
+	sealed     bool // Encrypted, see crypt.go
+	compressed bool // Deflated before being sealed
+}
+
+func readLocation(key string, loc location, keys *keyring) (string, error) {
+	f, err := os.Open(path.Join(LogDir, loc.file))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data := make([]byte, loc.length)
+	if _, err := f.ReadAt(data, loc.offset); err != nil {
+		return "", err
+	}
+	var value []byte
+	if err := json.Unmarshal(data, &value); err != nil {
+		return "", err
+	}
+	if loc.sealed {
+		if value, err = keys.open(value, loc.file, valuePurpose(key, loc.compressed)); err != nil {
+			return "", err
+		}
+	} else if err := keys.unsealed(); err != nil {
+		return "", err
+	}
+	if loc.compressed {
+		value, err = protobuf.Inflate(value, MaxValueSize)
+	}
+	return string(value), err
+}
+
+// Key and value of a set read from the base or delta file. Plaintext sets are only
+// taken as they are without encryption or while migrating to it, see crypt.go
+func readSet(file string, set persistedSet, keys *keyring) (string, string, error) {
+	key, value := set.Key, set.Value
+	var err error
+	if set.Sealed {
+		if key, err = keys.open(key, file, keyPurpose(set.Deleted)); err != nil {
+			return "", "", err
+		}
+		if !set.Deleted {
+			if value, err = keys.open(value, file, valuePurpose(string(key), set.Compressed)); err != nil {
+				return "", "", err
+			}
+		}
+	} else if err := keys.unsealed(); err != nil {
+		return "", "", err
+	}
+	if set.Compressed {
+		if value, err = protobuf.Inflate(value, MaxValueSize); err != nil {
+			return "", "", err
+		}
+	}
+	return string(key), string(value), nil
+}
+
+// CLOCK approximation of LRU, a key used since the hand last passed gets a second chance
+type clock struct {
+	keys       []string
+	used       []bool
+	referenced []uint32 // Set atomically by readers holding only the store read lock
+	slots      map[string]int
+	free       []int
+	hand       int
+}
+
+func newClock() *clock {
+	return &clock{slots: make(map[string]int)}
+}
+
+// Must hold the store write lock
+func (c *clock) add(key string) {
+	if slot, present := c.slots[key]; present {
+		atomic.StoreUint32(&c.referenced[slot], 1)
+		return
+	}
+	if len(c.free) > 0 {
+		slot := c.free[len(c.free)-1]
+		c.free = c.free[:len(c.free)-1]
+		c.keys[slot], c.used[slot], c.referenced[slot] = key, true, 1
+		c.slots[key] = slot
+		return
+	}
+	c.slots[key] = len(c.keys)
+	c.keys = append(c.keys, key)
+	c.used = append(c.used, true)
+	c.referenced = append(c.referenced, 1)
+}
+
+// Safe with only the store read lock held
+func (c *clock) reference(key string) {
+	if slot, present := c.slots[key]; present {
+		atomic.StoreUint32(&c.referenced[slot], 1)
+	}
+}
+
+// Must hold the store write lock
+func (c *clock) remove(key string) {
+	slot, present := c.slots[key]
+	if !present {
+		return
+	}
+	delete(c.slots, key)
+	c.keys[slot], c.used[slot], c.referenced[slot] = "", false, 0
+	c.free = append(c.free, slot)
+}
+
+// Sweeps the hand until it finds an unreferenced key that can be evicted,
+// gives up after two full turns since every key has lost its reference by then
+func (c *clock) victim(evictable func(string) bool) (string, bool) {
+	for i := 0; i < 2*len(c.keys); i++ {
+		slot := c.hand
+		c.hand = (c.hand + 1) % len(c.keys)
+		if !c.used[slot] {
+			continue
+		}
+		if atomic.LoadUint32(&c.referenced[slot]) == 1 {
+			atomic.StoreUint32(&c.referenced[slot], 0)
+			continue
+		}
+		if evictable(c.keys[slot]) {
+			return c.keys[slot], true
+		}
+	}
+	return "", false
+}
+
+// Must hold the store write lock
+func (s *Server) evict() {
+	for s.memory > s.budget {
+		key, found := s.clock.victim(func(key string) bool {
+			_, clean := s.index[key]
+			return clean
+		})
+		if !found {
+			// Everything left is dirty, try again once the next delta is persisted
+			return
+		}
+		s.dropValue(key)
+		s.clock.remove(key)
+		atomic.AddUint64(&s.evictions, 1)
+	}
+}
+
+// Returns how many reads were served from memory, from disk and how many keys were evicted
+func (s *Server) CacheStats() (uint64, uint64, uint64) {
+	return atomic.LoadUint64(&s.hits), atomic.LoadUint64(&s.misses), atomic.LoadUint64(&s.evictions)
+}
+
+// Persistence files are written one entry at a time so we know where each value lands,
+// both bases and deltas are a JSON array of persisted sets
+type persistWriter struct {
+	name     string
+	sealer   *fileSealer // Seals keys and values when encrypting
+	compress bool        // Deflate values big enough to be worth it
+	writer   *bufio.Writer
+	offset   int64
+	entries  int
+	err      error
+}
+
+func newPersistWriter(name string, f *os.File, keys *keyring, compress bool) *persistWriter {
+	p := &persistWriter{name: name, compress: compress, writer: bufio.NewWriter(f)}
+	if keys != nil {
+		p.sealer, p.err = keys.sealer(name)
+	}
+	return p
+}
+
+func (p *persistWriter) write(data []byte) {
+	if p.err != nil {
+		return
+	}
+	n, err := p.writer.Write(data)
+	p.offset += int64(n)
+	p.err = err
+}
+
+// Writes data as a JSON byte array, sealed for purpose first when encrypting
+func (p *persistWriter) writeBytes(data []byte, purpose []byte) location {
+	if p.sealer != nil {
+		var err error
+		if data, err = p.sealer.seal(data, purpose); err != nil && p.err == nil {
+			p.err = err
+		}
+	}
+	loc := p.writeJSON(data)
+	loc.sealed = p.sealer != nil
+	return loc
+}
+
+func (p *persistWriter) writeJSON(v interface{}) location {
+	data, err := json.Marshal(v)
+	if err != nil && p.err == nil {
+		p.err = err
+	}
+	loc := location{file: p.name, offset: p.offset, length: int64(len(data))}
+	p.write(data)
+	return loc
+}
+
+func (p *persistWriter) entry(key string, value string) location {
+	if p.entries == 0 {
+		p.write([]byte("["))
+	} else {
+		p.write([]byte(","))
+	}
+	p.entries++
+
+	data, compressed := []byte(value), false
+	if p.compress {
+		data, compressed = protobuf.Deflate(data)
+	}
+
+	p.write([]byte(`{"Key":`))
+	p.writeBytes([]byte(key), keyPurpose(false))
+	p.write([]byte(`,"Value":`))
+	loc := p.writeBytes(data, valuePurpose(key, compressed))
+	if compressed {
+		loc.compressed = true
+		p.write([]byte(`,"Compressed":true`))
+	}
+	p.sealed()
+	p.write([]byte("}"))
+	return loc
+}
+
+// Deltas record deleted keys as an entry without a value
+func (p *persistWriter) tombstone(key string) {
+	if p.entries == 0 {
+		p.write([]byte("["))
+	} else {
+		p.write([]byte(","))
+	}
+	p.entries++
+
+	p.write([]byte(`{"Key":`))
+	p.writeBytes([]byte(key), keyPurpose(true))
+	p.write([]byte(`,"Deleted":true`))
+	p.sealed()
+	p.write([]byte("}"))
+}
+
+func (p *persistWriter) sealed() {
+	if p.sealer != nil {
+		p.write([]byte(`,"Sealed":true`))
+	}
+}
+
+func (p *persistWriter) finish() error {
+	if p.entries == 0 {
+		p.write([]byte("["))
+	}
+	p.write([]byte("]"))
+	if p.err != nil {
+		return p.err
+	}
+	return p.writer.Flush()
+}
+
+// Bases in the old format are an object, they have to fail here to be recovered the old way
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expecting %v in persistence file, found %v", delim, token)
+	}
+	return nil
+}
+
+// Walks a base or delta file calling found with the location of every value in the order they were set,
+// deleted keys are reported with an empty location
+func scanSets(name string, keys *keyring, found func(key string, loc location)) error {
+	f, err := os.Open(path.Join(LogDir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	if err := expectDelim(decoder, '['); err != nil {
+		return err
+	}
+	for decoder.More() {
+		if err := expectDelim(decoder, '{'); err != nil {
+			return err
+		}
+
+		var key []byte
+		var loc location
+		var sealed, compressed, deleted bool
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			field, _ := token.(string)
+
+			var raw json.RawMessage
+			if err := decoder.Decode(&raw); err != nil {
+				return err
+			}
+			switch field {
+			case "Key":
+				if err := json.Unmarshal(raw, &key); err != nil {
+					return err
+				}
+			case "Value":
+				end := decoder.InputOffset()
+				loc = location{file: name, offset: end - int64(len(raw)), length: int64(len(raw))}
+			case "Sealed":
+				if err := json.Unmarshal(raw, &sealed); err != nil {
+					return err
+				}
+			case "Compressed":
+				if err := json.Unmarshal(raw, &compressed); err != nil {
+					return err
+				}
+			case "Deleted":
+				if err := json.Unmarshal(raw, &deleted); err != nil {
+					return err
+				}
+			}
+		}
+
+		if _, err := decoder.Token(); err != nil {
+			return err
+		}
+		if sealed {
+			if key, err = keys.open(key, name, keyPurpose(deleted)); err != nil {
+				return err
+			}
+			loc.sealed = loc.file != ""
+		} else if err := keys.unsealed(); err != nil {
+			return err
+		}
+		loc.compressed = compressed
+		found(string(key), loc)
+	}
+	return nil
+}
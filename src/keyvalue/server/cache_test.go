@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestPersistLocations(t *testing.T) {
+	os.MkdirAll(LogDir, 0777)
+	values := map[string]string{
+		"key1":         "value1",
+		"quoted":       `a "quoted" <value>`,
+		"unicode":      "héllo wörld",
+		"empty":        "",
+		"\xff\x00\xfe": "\x00\x01\x80\xff",
+	}
+
+	name := "1-test-base"
+	f, err := os.Create(path.Join(LogDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path.Join(LogDir, name))
+
+	written := make(map[string]location)
+	w := newPersistWriter(name, f, nil, false)
+	for key, value := range values {
+		written[key] = w.entry(key, value)
+	}
+	w.finish()
+	f.Close()
+
+	scanned := make(map[string]location)
+	err = scanSets(name, nil, func(key string, loc location) {
+		scanned[key] = loc
+	})
+	if err != nil {
+		t.Fatalf("Scanning %s failed: %v", name, err)
+	}
+	for key, value := range values {
+		if scanned[key] != written[key] {
+			t.Fatalf("Location of %q Expecting: %v, Received: %v", key, written[key], scanned[key])
+		}
+		out, err := readLocation(key, scanned[key], nil)
+		if err != nil || out != value {
+			t.Fatalf("Reading %q Expecting: %q, Received: %q (%v)", key, value, out, err)
+		}
+	}
+}
+
+func TestPersistCompressed(t *testing.T) {
+	os.MkdirAll(LogDir, 0777)
+	name := "1-test-compressed-base"
+	f, err := os.Create(path.Join(LogDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path.Join(LogDir, name))
+
+	value := string(bytes.Repeat([]byte("compressible "), 1000))
+	w := newPersistWriter(name, f, nil, true)
+	written := w.entry("big", value)
+	w.entry("small", "tiny")
+	w.finish()
+	f.Close()
+
+	data, err := ioutil.ReadFile(path.Join(LogDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= len(value) {
+		t.Fatalf("Compressed file Expecting: under %d bytes, Received: %d", len(value), len(data))
+	}
+
+	scanned := make(map[string]location)
+	if err := scanSets(name, nil, func(key string, loc location) { scanned[key] = loc }); err != nil {
+		t.Fatal(err)
+	}
+	if scanned["big"] != written || !written.compressed || scanned["small"].compressed {
+		t.Fatalf("Locations Expecting: only big compressed, Received: %v", scanned)
+	}
+	if out, err := readLocation("big", written, nil); err != nil || out != value {
+		t.Fatalf("Reading big Expecting: %d bytes, Received: %d (%v)", len(value), len(out), err)
+	}
+	if out, err := readLocation("small", scanned["small"], nil); err != nil || out != "tiny" {
+		t.Fatalf("Reading small Expecting: tiny, Received: %q (%v)", out, err)
+	}
+}
+
+func TestClockEviction(t *testing.T) {
+	c := newClock()
+	c.add("a")
+	c.add("b")
+	c.add("c")
+
+	// Every key starts referenced, so the first sweep only clears the bits
+	c.reference("b")
+	key, found := c.victim(func(string) bool { return true })
+	if !found || key != "a" {
+		t.Fatalf("Expecting victim a, Received: %s", key)
+	}
+	c.remove("a")
+
+	c.reference("b")
+	key, found = c.victim(func(string) bool { return true })
+	if !found || key != "c" {
+		t.Fatalf("Expecting victim c, Received: %s", key)
+	}
+
+	_, found = c.victim(func(string) bool { return false })
+	if found {
+		t.Fatal("Victim found when no key was evictable")
+	}
+}
+
+func TestRecoverLegacy(t *testing.T) {
+	// Leaves no bases behind for the other tests to recover
+	defer os.RemoveAll(LogDir)
+	for _, budget := range []int64{0, 1} {
+		os.MkdirAll(LogDir, 0777)
+		epoch := time.Now().UnixNano()
+		base := path.Join(LogDir, fmt.Sprintf("%d-base", epoch))
+		delta := path.Join(LogDir, fmt.Sprintf("%d-delta", epoch+1))
+		if err := ioutil.WriteFile(base, []byte(`{"legacy:a":"1","legacy:b":"2"}`), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(delta, []byte(`[{"Key":"legacy:b","Value":"3"}]`), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		// The second start reads the base the first rewrote in the new format
+		for restart := 0; restart < 2; restart++ {
+			status, server := InitConfig(Config{Port: 12392, MemoryBudget: budget})
+			if status != 0 {
+				t.Fatalf("Recovering budget %d Expecting: 0, Received: %d", budget, status)
+			}
+			if result, value := server.Get("legacy:a"); result != 0 || value != "1" {
+				t.Fatalf("Legacy base budget %d Expecting: 1, Received: %d %q", budget, result, value)
+			}
+			if result, value := server.Get("legacy:b"); result != 0 || value != "3" {
+				t.Fatalf("Legacy delta budget %d Expecting: 3, Received: %d %q", budget, result, value)
+			}
+			server.storeLock.RLock()
+			memory := server.memory
+			server.storeLock.RUnlock()
+			if memory != storeBytes(server) {
+				t.Fatalf("Memory budget %d Expecting: %d, Received: %d", budget, storeBytes(server), memory)
+			}
+			server.Close()
+		}
+		if _, err := os.Stat(base); !os.IsNotExist(err) {
+			t.Fatalf("Legacy base Expecting: deleted, Received: %v", err)
+		}
+	}
+
+	// A base that can't be read either way stops the start instead of losing it
+	bad := path.Join(LogDir, fmt.Sprintf("%d-base", time.Now().UnixNano()))
+	if err := ioutil.WriteFile(bad, []byte(`not json`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(bad)
+	if status, _ := InitConfig(Config{Port: 12392}); status != -1 {
+		t.Fatalf("Unreadable base Expecting: -1, Received: %d", status)
+	}
+}
+
+func TestServerEvictedKeys(t *testing.T) {
+	os.RemoveAll(LogDir)
+	defer os.RemoveAll(LogDir)
+	var server *Server
+	check := func(when string, expected int) {
+		server.storeLock.RLock()
+		keys := len(server.store) + server.evicted
+		server.storeLock.RUnlock()
+		if keys != expected || keys != storeKeys(server) {
+			t.Fatalf("Keys %s Expecting: %d, Received: %d, counted %d", when, expected, keys, storeKeys(server))
+		}
+	}
+
+	status, server := InitConfig(Config{Port: 12408, MemoryBudget: 100})
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	for i := 0; i < 50; i++ {
+		server.Set(fmt.Sprintf("evicted:%02d", i), "value")
+	}
+	server.waitApplied(context.Background(), server.Queued())
+	if err := server.writeDelta(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, evictions := server.CacheStats(); evictions == 0 {
+		t.Fatal("Evictions Expecting: some, Received: 0")
+	}
+	check("after evicting", 50)
+
+	// Reloads an evicted key, then deletes and overwrites some of both kinds
+	if result, value := server.Get("evicted:00"); result != 0 || value != "value" {
+		t.Fatalf("Get of evicted key Expecting: value, Received: %d %q", result, value)
+	}
+	for i := 0; i < 10; i++ {
+		server.Delete(fmt.Sprintf("evicted:%02d", i))
+		server.Set(fmt.Sprintf("evicted:%02d", 49-i), "other")
+	}
+	server.waitApplied(context.Background(), server.Queued())
+	check("after deleting", 40)
+	if err := server.writeDelta(); err != nil {
+		t.Fatal(err)
+	}
+	check("after persisting", 40)
+	if err := server.writeBase(); err != nil {
+		t.Fatal(err)
+	}
+	check("after a base", 40)
+	server.Close()
+
+	status, server = InitConfig(Config{Port: 12408, MemoryBudget: 100})
+	if status != 0 {
+		t.Fatal("Restarted server inited with nonzero status")
+	}
+	defer server.Close()
+	check("after recovering", 40)
+}
@@ -0,0 +1,390 @@
+package server
+
+import (
+	"keyvalue/protobuf"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Features the server offers clients in the handshake
+var Features = []string{protobuf.FeatureDeflate, protobuf.FeatureDedupe, protobuf.FeatureInvalidate, protobuf.FeatureAbort}
+
+// Uploads with no chunk for this long are given up on, a client that stopped
+// halfway may keep the connection for other requests
+var staleUpload = time.Minute
+
+// State of one client connection
+type connection struct {
+	conn         net.Conn
+	version      uint32          // Protocol version, 1 until the client says hello
+	maxFrameSize uint32          // Largest frame we may send, the smaller of ours and the client's
+	features     map[string]bool // Negotiated in the handshake
+	principal    *principal      // Who the client authenticated as, nil without an ACL
+	session      string          // Sets are deduplicated within it when not empty, see dedupe.go
+	uploads      map[string]*upload
+	writeLock    sync.Mutex // Invalidations are written from another goroutine
+
+	// Only used once the client agrees to invalidations, see invalidate.go
+	pushing     bool
+	tracked     map[string]bool // Keys the client may have cached, under the tracking lock
+	invalid     map[string]bool // Keys waiting to be sent, under the tracking lock
+	invalidated chan struct{}   // Wakes the pusher
+	closed      chan struct{}   // Stops the pusher
+}
+
+// Chunks of a large set being uploaded, the set is applied once the last one arrives
+type upload struct {
+	key        []byte // Named by the first chunk, every later one must name it too
+	authorized bool   // Whether the connection may write key, checked on the first chunk
+	value      []byte
+	rejected   *protobuf.Status // Answered instead of applying the set once the last chunk arrives
+	updated    time.Time        // When the last chunk arrived
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	if err := s.accept(conn, "binary"); err != nil {
+		if err == errBusy {
+			s.refuse(conn)
+		}
+		return
+	}
+	defer s.release(conn)
+	log.Println("Connection established with client")
+
+	c := &connection{
+		conn:         conn,
+		version:      1,
+		maxFrameSize: s.maxFrameSize,
+		features:     make(map[string]bool),
+		principal:    s.anonymous(),
+		uploads:      make(map[string]*upload),
+		tracked:      make(map[string]bool),
+		invalid:      make(map[string]bool),
+		invalidated:  make(chan struct{}, 1),
+		closed:       make(chan struct{}),
+	}
+	defer func() {
+		close(c.closed)
+		s.tracking.forget(c)
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		request := new(protobuf.Request)
+		err := protobuf.ReadFrame(reader, s.maxFrameSize, request)
+		if err != nil {
+			log.Printf("Error reading request: %v\n", err)
+			return
+		}
+		received := time.Now()
+		c.expireUploads(received)
+		if request.GetAbort() {
+			// The client gave up on the upload, nothing is answered
+			delete(c.uploads, request.GetId())
+			continue
+		}
+
+		value := request.GetValue()
+		if request.GetCompressed() {
+			// Chunks are compressed after splitting so none inflates past a frame
+			if value, err = protobuf.Inflate(value, int(s.maxFrameSize)); err != nil {
+				log.Printf("Error inflating value of request %s: %v\n", request.GetId(), err)
+				return
+			}
+		}
+		if u, present := c.uploads[request.GetId()]; present || request.GetMore() {
+			if !present {
+				u = &upload{key: request.GetKey(), authorized: s.authorized(c.principal, string(request.GetKey()), true)}
+				c.uploads[request.GetId()] = u
+			}
+			u.updated = received
+			// Drop what we have but keep swallowing chunks until the last one
+			if u.rejected == nil && !bytes.Equal(request.GetKey(), u.key) {
+				u.value = nil
+				u.rejected = protobuf.NewStatus(protobuf.Status_INVALID, fmt.Sprintf("chunk names key %s, the first named %s", request.GetKey(), u.key))
+			}
+			if u.rejected == nil && len(u.value)+len(value) > MaxValueSize {
+				u.value = nil
+				u.rejected = protobuf.NewStatus(protobuf.Status_TOO_LARGE, fmt.Sprintf("value larger than %d bytes", MaxValueSize))
+			}
+			// Chunks for a key we may not write are dropped, the set is denied below
+			if u.rejected == nil && u.authorized {
+				u.value = append(u.value, value...)
+			}
+			if request.GetMore() {
+				continue
+			}
+
+			delete(c.uploads, request.GetId())
+			if u.rejected != nil {
+				log.Printf("Rejected set of key %s, %s\n", request.GetKey(), u.rejected.GetMessage())
+				response := newResponse(request, u.rejected)
+				c.writeLock.Lock()
+				err := c.writeResponse(response)
+				c.writeLock.Unlock()
+				if err != nil {
+					log.Printf("Error writing data: %v\n", err)
+					return
+				}
+				continue
+			}
+			value = u.value
+		}
+
+		ctx, cancel := requestContext(request, received)
+		var response *protobuf.Response
+		held := false // Whether the case already holds writeLock
+		op, known := operation(request)
+		var busy *protobuf.Status
+		admitted := false
+		if known && op != protobuf.Request_HELLO && op != protobuf.Request_PING {
+			// Hellos and pings are always answered so clients can tell busy from gone
+			busy = s.limits.admit(clientName(c.principal, conn.RemoteAddr().String()))
+			admitted = busy == nil
+		}
+		switch {
+		case !known:
+			message := fmt.Sprintf("unknown operation %d (type '%s')", request.GetOp(), request.GetType())
+			log.Printf("Rejected request %s, %s\n", request.GetId(), message)
+			response = newResponse(request, protobuf.NewStatus(protobuf.Status_UNKNOWN_OPERATION, message))
+		case op == protobuf.Request_HELLO:
+			response = s.hello(c, request)
+		case op == protobuf.Request_PING:
+			response = newResponse(request, protobuf.NewStatus(protobuf.Status_OK, ""))
+		case busy != nil:
+			log.Printf("Rejected request %s, %s\n", request.GetId(), busy.GetMessage())
+			response = newResponse(request, busy)
+		case !s.authorized(c.principal, string(request.GetKey()), op == protobuf.Request_SET):
+			message := denied(c.principal, string(request.GetKey()), op == protobuf.Request_SET)
+			log.Printf("Rejected request %s, %s\n", request.GetId(), message)
+			response = newResponse(request, protobuf.NewStatus(protobuf.Status_PERMISSION_DENIED, message))
+		case ctx.Err() != nil:
+			// Waited behind earlier requests for longer than the client will wait for the answer
+			response = resultResponse(ctx, request, -1)
+		case op == protobuf.Request_GET:
+			if response = s.redirect(request, false); response != nil {
+				break
+			}
+			if !s.waitApplied(ctx, request.GetMinSequence()) {
+				response = resultResponse(ctx, request, -1)
+				break
+			}
+			sequence := s.Applied()
+			if c.features[protobuf.FeatureInvalidate] {
+				// Held until the response is written, so the invalidation of a write
+				// right after the read can't overtake it
+				c.writeLock.Lock()
+				held = true
+				s.tracking.track(c, string(request.GetKey()))
+			}
+			result, value := s.GetBytesContext(ctx, request.GetKey())
+			response = resultResponse(ctx, request, result)
+			response.Value = value
+			response.Sequence = proto.Uint64(sequence)
+		case op == protobuf.Request_SYNC:
+			if response = s.redirect(request, false); response != nil {
+				break
+			}
+			response = s.answerSync(request)
+		case op == protobuf.Request_SET:
+			if response = s.redirect(request, true); response != nil {
+				break
+			}
+			var sequence uint64
+			status, old := s.dedupedSet(c, request.GetId(), func() (*protobuf.Status, []byte) {
+				// A full queue holds the connection up no longer than QueueTimeout
+				result, old, queued, err := s.limitedSet(ctx, string(request.GetKey()), string(value))
+				if err == errQueueFull {
+					return protobuf.NewStatus(protobuf.Status_BUSY, err.Error()), nil
+				}
+				sequence = queued
+				return resultResponse(ctx, request, result).Status, []byte(old)
+			})
+			response = newResponse(request, status)
+			response.Value = old
+			if status.Result() != -1 {
+				if sequence == 0 {
+					// Answered from the first attempt, which was queued by now
+					sequence = s.Queued()
+				}
+				response.Sequence = proto.Uint64(sequence)
+			}
+		}
+		cancel()
+		if admitted {
+			s.limits.release()
+		}
+
+		if !held {
+			c.writeLock.Lock()
+		}
+		err = c.writeResponse(response)
+		c.writeLock.Unlock()
+		if err != nil {
+			log.Printf("Error writing data: %v\n", err)
+			return
+		}
+		s.metrics.request("binary", opLabel(op.String(), known), time.Since(received))
+		if code := response.GetStatus().GetCode(); code == protobuf.Status_VERSION_MISMATCH || code == protobuf.Status_UNAUTHENTICATED {
+			return
+		}
+	}
+}
+
+// Answers the first request on a connection past MaxConnections with a busy
+// status, which clients take as a failed handshake
+func (s *Server) refuse(conn net.Conn) {
+	log.Printf("Refused connection, already serving %d\n", s.limits.maxConns)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	request := new(protobuf.Request)
+	// Hellos are small, anything larger isn't worth reading
+	if err := protobuf.ReadFrame(bufio.NewReader(conn), 4096, request); err != nil {
+		return
+	}
+	message := fmt.Sprintf("already serving %d connections", s.limits.maxConns)
+	protobuf.WriteFrame(conn, newResponse(request, protobuf.NewStatus(protobuf.Status_BUSY, message)))
+}
+
+// Answers the handshake with our own hello, a version we don't speak or
+// credentials we don't accept end the connection
+func (s *Server) hello(c *connection, request *protobuf.Request) *protobuf.Response {
+	hello := request.GetHello()
+	var response *protobuf.Response
+	if !protobuf.SupportedVersion(hello.GetVersion()) {
+		message := fmt.Sprintf("client speaks protocol version %d, server supports %d to %d",
+			hello.GetVersion(), protobuf.MinProtocolVersion, protobuf.ProtocolVersion)
+		log.Printf("Rejected handshake, %s\n", message)
+		response = newResponse(request, protobuf.NewStatus(protobuf.Status_VERSION_MISMATCH, message))
+	} else if p, err := s.authenticate(hello.GetCredentials()); err != nil {
+		log.Printf("Rejected handshake, %v\n", err)
+		response = newResponse(request, protobuf.NewStatus(protobuf.Status_UNAUTHENTICATED, err.Error()))
+	} else {
+		c.principal = p
+		c.version = hello.GetVersion()
+		c.maxFrameSize = protobuf.PeerFrameSize(s.maxFrameSize, hello)
+		c.features = protobuf.Negotiate(Features, hello.GetFeatures())
+		if c.features[protobuf.FeatureInvalidate] && !c.pushing {
+			c.pushing = true
+			go s.pushInvalidations(c)
+		}
+		c.session = ""
+		if c.features[protobuf.FeatureDedupe] && hello.GetSession() != "" {
+			// Scoped to the principal so nobody else can read the answers by naming the session
+			c.session = hello.GetSession()
+			if p != nil {
+				c.session = p.name + "\x00" + c.session
+			}
+		}
+		response = newResponse(request, protobuf.NewStatus(protobuf.Status_OK, ""))
+	}
+	response.Hello = protobuf.NewHello(Features, s.maxFrameSize)
+	if s.leader != "" {
+		response.Hello.Leader = proto.String(s.leader)
+	}
+	return response
+}
+
+// Credentials are ignored without an ACL
+func (s *Server) authenticate(credentials *protobuf.Credentials) (*principal, error) {
+	if s.acl == nil {
+		return nil, nil
+	}
+	return s.acl.authenticate(credentials.GetUsername(), credentials.GetPassword(), credentials.GetToken())
+}
+
+// Old clients only send the type string, which is mapped onto the operation enum
+func operation(request *protobuf.Request) (protobuf.Request_Operation, bool) {
+	if request.Op != nil {
+		_, known := protobuf.Request_Operation_name[int32(*request.Op)]
+		return *request.Op, known
+	}
+	switch request.GetType() {
+	case "get":
+		return protobuf.Request_GET, true
+	case "set":
+		return protobuf.Request_SET, true
+	}
+	return 0, false
+}
+
+// Requests with a timeout get a context with the deadline counted from when they arrived
+func requestContext(request *protobuf.Request, received time.Time) (context.Context, context.CancelFunc) {
+	if timeout := request.GetTimeout(); timeout > 0 {
+		return context.WithDeadline(context.Background(), received.Add(time.Duration(timeout)*time.Millisecond))
+	}
+	return context.WithCancel(context.Background())
+}
+
+// A request given up on because its timeout ran out is reported as such rather than as an error
+func resultResponse(ctx context.Context, request *protobuf.Request, result int) *protobuf.Response {
+	if result == -1 && ctx.Err() != nil {
+		message := fmt.Sprintf("timed out after %dms", request.GetTimeout())
+		return newResponse(request, protobuf.NewStatus(protobuf.Status_DEADLINE_EXCEEDED, message))
+	}
+	return newResponse(request, protobuf.ResultStatus(result))
+}
+
+// Responses carry the status and the matching result code for old clients
+func newResponse(request *protobuf.Request, status *protobuf.Status) *protobuf.Response {
+	return &protobuf.Response{
+		Id:     request.Id,
+		Result: proto.Int32(int32(status.Result())),
+		Status: status,
+	}
+}
+
+// Values too large for one frame go out as a run of chunks with more set on all
+// but the last, under writeLock
+func (c *connection) writeResponse(response *protobuf.Response) error {
+	value := response.Value
+	size := protobuf.ChunkSize(c.maxFrameSize, response.GetId(), nil)
+	if size < 1 {
+		size = 1
+	}
+	for len(value) > size {
+		chunk := &protobuf.Response{
+			Id:     response.Id,
+			Result: response.Result,
+			More:   proto.Bool(true),
+			Status: response.Status,
+		}
+		c.setValue(chunk, value[:size])
+		if err := protobuf.WriteFrame(c.conn, chunk); err != nil {
+			return err
+		}
+		value = value[size:]
+	}
+	c.setValue(response, value)
+	return protobuf.WriteFrame(c.conn, response)
+}
+
+// Deflates the value when the client agreed to it in the handshake
+func (c *connection) setValue(response *protobuf.Response, value []byte) {
+	response.Value, response.Compressed = value, nil
+	if c.features[protobuf.FeatureDeflate] {
+		if deflated, compressed := protobuf.Deflate(value); compressed {
+			response.Value, response.Compressed = deflated, proto.Bool(true)
+		}
+	}
+}
+
+// Drops the chunks of uploads that went quiet. They stay rejected rather than
+// forgotten so a last chunk turning up late isn't applied as the whole value
+func (c *connection) expireUploads(now time.Time) {
+	for id, u := range c.uploads {
+		if u.rejected == nil && now.Sub(u.updated) > staleUpload {
+			log.Printf("Dropped upload %s, no chunk for %v\n", id, staleUpload)
+			u.value = nil
+			u.rejected = protobuf.NewStatus(protobuf.Status_DEADLINE_EXCEEDED, fmt.Sprintf("no chunk of the value for %v", staleUpload))
+		}
+	}
+}
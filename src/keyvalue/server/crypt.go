@@ -0,0 +1,235 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// Encryption at rest for the base and delta files. Every key and value is sealed
+// on its own with AES-GCM so evicted values can still be read back by location.
+// Each file is sealed with its own subkey, derived with HKDF from the configured
+// key and a random salt, so however often bases are rewritten no key seals more
+// than one file's worth of random nonces. A sealed blob is the fingerprint of the
+// configured key, the salt, the nonce and the ciphertext, and entries holding
+// sealed blobs are marked Sealed. The fingerprint and salt, the name of the file
+// and what the blob is for, the key of an entry or of a tombstone or the value of
+// a given key, are authenticated with it so blobs can't be moved between entries
+// or replayed from other files. With encryption on, unsealed entries are refused
+// unless EncryptionMigrate is set to encrypt a store that was written in plaintext.
+//
+// Keys are base64 encoded 16, 24 or 32 byte AES keys separated by whitespace or
+// commas. The first one encrypts everything written, the rest are old keys kept
+// so files written before a rotation can still be read. Once the next base has
+// been written (every minute) nothing is sealed with the old keys any more.
+
+const (
+	fingerprintSize = 4
+	saltSize        = 16
+	maxSubkeys      = 64 // Derived keys kept for reading, see subkey
+)
+
+type keyring struct {
+	current   [fingerprintSize]byte
+	keys      map[[fingerprintSize]byte][]byte
+	plaintext bool // Unsealed entries are read, see EncryptionMigrate
+
+	subkeysLock sync.Mutex
+	subkeys     map[subkeyId]cipher.AEAD
+}
+
+// A key and the salt of the file its subkey seals
+type subkeyId struct {
+	fingerprint [fingerprintSize]byte
+	salt        [saltSize]byte
+}
+
+// Failures to decrypt stop recovery rather than start the server without the data
+type sealError struct {
+	message string
+}
+
+func (e *sealError) Error() string {
+	return e.message
+}
+
+var errEncrypted = &sealError{"persistence files are encrypted but no encryption key was given"}
+
+// Only decryption failures stop recovery, anything else is logged and skipped like before
+func fatalRecovery(err error) error {
+	if _, sealed := err.(*sealError); sealed {
+		return err
+	}
+	return nil
+}
+
+// Keys from a file and from a string, usually an environment variable,
+// the string comes first. Returns nil if neither has any
+func loadKeyring(file string, keys string) (*keyring, error) {
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		keys += "\n" + string(data)
+	}
+
+	var k *keyring
+	for _, field := range strings.FieldsFunc(keys, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	}) {
+		key, err := base64.StdEncoding.DecodeString(field)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key is not base64: %v", err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("encryption key must be 16, 24 or 32 bytes: %v", err)
+		}
+
+		var fingerprint [fingerprintSize]byte
+		sum := sha256.Sum256(key)
+		copy(fingerprint[:], sum[:])
+		if k == nil {
+			k = &keyring{current: fingerprint, keys: make(map[[fingerprintSize]byte][]byte), subkeys: make(map[subkeyId]cipher.AEAD)}
+		} else if _, present := k.keys[fingerprint]; present {
+			return nil, fmt.Errorf("encryption key %x is given twice", fingerprint)
+		}
+		k.keys[fingerprint] = key
+	}
+	return k, nil
+}
+
+// HKDF with SHA-256 from RFC 5869, one block of output is enough for an AES key
+func hkdf(secret []byte, salt []byte, info []byte, size int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:size]
+}
+
+// Derives the subkey of a file, the ones used last are kept so reading a file
+// back doesn't derive it again for every entry
+func (k *keyring) subkey(id subkeyId) (cipher.AEAD, error) {
+	k.subkeysLock.Lock()
+	defer k.subkeysLock.Unlock()
+	if aead, present := k.subkeys[id]; present {
+		return aead, nil
+	}
+	key, present := k.keys[id.fingerprint]
+	if !present {
+		return nil, &sealError{fmt.Sprintf("data was encrypted with key %x which was not given", id.fingerprint)}
+	}
+	block, err := aes.NewCipher(hkdf(key, id.salt[:], []byte("keyvalue persistence file"), len(key)))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(k.subkeys) >= maxSubkeys {
+		k.subkeys = make(map[subkeyId]cipher.AEAD)
+	}
+	k.subkeys[id] = aead
+	return aead, nil
+}
+
+// What a sealed key is for, so the key of a tombstone can't stand in for the key
+// of an entry or the other way round
+func keyPurpose(deleted bool) []byte {
+	if deleted {
+		return []byte("tombstone key")
+	}
+	return []byte("key")
+}
+
+// What a sealed value is for, binding it to its key and to whether it's deflated
+func valuePurpose(key string, compressed bool) []byte {
+	if compressed {
+		return append([]byte("compressed value of "), key...)
+	}
+	return append([]byte("value of "), key...)
+}
+
+// Fingerprint and salt, the file name and purpose together are the additional data
+// of the seal. File names never hold a zero byte, so it ends them unambiguously
+func additionalData(id []byte, file string, purpose []byte) []byte {
+	data := make([]byte, 0, len(id)+len(file)+1+len(purpose))
+	data = append(append(data, id...), file...)
+	return append(append(data, 0), purpose...)
+}
+
+// Seals what is written to one file with its own subkey of the current key
+type fileSealer struct {
+	id   subkeyId
+	aead cipher.AEAD
+	file string
+}
+
+func (k *keyring) sealer(file string) (*fileSealer, error) {
+	id := subkeyId{fingerprint: k.current}
+	if _, err := io.ReadFull(rand.Reader, id.salt[:]); err != nil {
+		return nil, err
+	}
+	aead, err := k.subkey(id)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSealer{id: id, aead: aead, file: file}, nil
+}
+
+func (f *fileSealer) seal(plaintext []byte, purpose []byte) ([]byte, error) {
+	header := fingerprintSize + saltSize + f.aead.NonceSize()
+	sealed := make([]byte, header, header+len(plaintext)+f.aead.Overhead())
+	copy(sealed, f.id.fingerprint[:])
+	copy(sealed[fingerprintSize:], f.id.salt[:])
+	if _, err := io.ReadFull(rand.Reader, sealed[fingerprintSize+saltSize:]); err != nil {
+		return nil, err
+	}
+	return f.aead.Seal(sealed, sealed[fingerprintSize+saltSize:], plaintext, additionalData(sealed[:fingerprintSize+saltSize], f.file, purpose)), nil
+}
+
+// Unsealed entries are only trusted without encryption or while migrating to it,
+// otherwise anyone able to write the files could slip plaintext in
+func (k *keyring) unsealed() error {
+	if k == nil || k.plaintext {
+		return nil
+	}
+	return &sealError{"persistence files hold unencrypted entries, start once with encryption migration to encrypt them"}
+}
+
+// Opens a blob read from file. Safe on a nil keyring, which can't open anything
+func (k *keyring) open(sealed []byte, file string, purpose []byte) ([]byte, error) {
+	if k == nil {
+		return nil, errEncrypted
+	}
+	if len(sealed) < fingerprintSize+saltSize {
+		return nil, &sealError{"encrypted data is truncated"}
+	}
+	var id subkeyId
+	copy(id.fingerprint[:], sealed)
+	copy(id.salt[:], sealed[fingerprintSize:])
+	aead, err := k.subkey(id)
+	if err != nil {
+		return nil, err
+	}
+	header := fingerprintSize + saltSize + aead.NonceSize()
+	if len(sealed) < header {
+		return nil, &sealError{"encrypted data is truncated"}
+	}
+	plaintext, err := aead.Open(nil, sealed[fingerprintSize+saltSize:header], sealed[header:], additionalData(sealed[:fingerprintSize+saltSize], file, purpose))
+	if err != nil {
+		return nil, &sealError{fmt.Sprintf("could not decrypt with key %x, the file is corrupted or was tampered with", id.fingerprint)}
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testKey1 = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=" // 32 bytes
+	testKey2 = "ZmVkY2JhOTg3NjU0MzIxMA=="                     // 16 bytes
+)
+
+func TestKeyring(t *testing.T) {
+	old, err := loadKeyring("", testKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	purpose := valuePurpose("k", false)
+	sealer, err := old.sealer("1-base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealer.seal([]byte("secret"), purpose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Fatal("Sealed data contains the plaintext")
+	}
+
+	// Every file gets its own salt and so its own subkey
+	other, err := old.sealer("1-base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.id == sealer.id || !bytes.Equal(sealed[:fingerprintSize], old.current[:]) || !bytes.Equal(sealed[fingerprintSize:fingerprintSize+saltSize], sealer.id.salt[:]) {
+		t.Fatalf("Sealers Expecting: distinct salts, Received: %x and %x", sealer.id.salt, other.id.salt)
+	}
+
+	// After a rotation the old key is still there to read what it sealed
+	rotated, err := loadKeyring("", testKey2+","+testKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.current == old.current {
+		t.Fatal("Rotated keyring Expecting: the first key to be current")
+	}
+	if plaintext, err := rotated.open(sealed, "1-base", purpose); err != nil || string(plaintext) != "secret" {
+		t.Fatalf("Open Expecting: secret, Received: %q %v", plaintext, err)
+	}
+
+	// A sealed value only opens as the value of the key it was sealed for, read from the file it was written to
+	for _, other := range [][]byte{valuePurpose("other", false), valuePurpose("k", true), keyPurpose(false)} {
+		if _, err := old.open(sealed, "1-base", other); fatalRecovery(err) == nil {
+			t.Fatalf("Open for %q Expecting: seal error, Received: %v", other, err)
+		}
+	}
+	if _, err := old.open(sealed, "2-base", purpose); fatalRecovery(err) == nil {
+		t.Fatalf("Open from another file Expecting: seal error, Received: %v", err)
+	}
+
+	wrong, err := loadKeyring("", testKey2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrong.open(sealed, "1-base", purpose); fatalRecovery(err) == nil {
+		t.Fatalf("Wrong key Expecting: seal error, Received: %v", err)
+	}
+	if _, err := old.open(sealed[:fingerprintSize+saltSize+1], "1-base", purpose); fatalRecovery(err) == nil {
+		t.Fatalf("Truncated Expecting: seal error, Received: %v", err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := old.open(sealed, "1-base", purpose); fatalRecovery(err) == nil {
+		t.Fatalf("Tampered Expecting: seal error, Received: %v", err)
+	}
+	var none *keyring
+	if _, err := none.open(sealed, "1-base", purpose); err != errEncrypted {
+		t.Fatalf("No key Expecting: %v, Received: %v", errEncrypted, err)
+	}
+
+	if _, err := loadKeyring("", "not base64!"); err == nil {
+		t.Fatal("Bad key Expecting: error")
+	}
+	if _, err := loadKeyring("", "c2hvcnQ="); err == nil {
+		t.Fatal("Short key Expecting: error")
+	}
+	if k, err := loadKeyring("", " \n"); k != nil || err != nil {
+		t.Fatalf("No keys Expecting: nil, Received: %v %v", k, err)
+	}
+}
+
+func TestHKDF(t *testing.T) {
+	// First block of test case 1 from RFC 5869
+	secret := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	expected := "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf"
+	if derived := hex.EncodeToString(hkdf(secret, salt, info, 32)); derived != expected {
+		t.Fatalf("HKDF Expecting: %s, Received: %s", expected, derived)
+	}
+}
+
+func TestRecoverEncrypted(t *testing.T) {
+	keys, err := loadKeyring("", testKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(LogDir, 0777)
+	name := fmt.Sprintf("%d-delta", time.Now().UnixNano())
+	f, err := os.Create(path.Join(LogDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path.Join(LogDir, name))
+
+	w := newPersistWriter(name, f, keys, true)
+	loc := w.entry("crypt:key", "crypt:value")
+	w.tombstone("crypt:deleted")
+	if err := w.finish(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	data, err := ioutil.ReadFile(path.Join(LogDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("crypt:")) {
+		t.Fatalf("Encrypted delta contains plaintext: %s", data)
+	}
+	if value, err := readLocation("crypt:key", loc, keys); err != nil || value != "crypt:value" {
+		t.Fatalf("Reading location Expecting: crypt:value, Received: %q %v", value, err)
+	}
+
+	recovered := func(keys *keyring, index bool) (*Server, error) {
+		s := &Server{store: make(map[string]string), storeLock: &sync.RWMutex{}, keys: keys}
+		if index {
+			s.index, s.clock = make(map[string]location), newClock()
+		}
+		return s, s.recover()
+	}
+	for _, index := range []bool{false, true} {
+		s, err := recovered(keys, index)
+		if err != nil {
+			t.Fatalf("Recovery Expecting: success, Received: %v", err)
+		}
+		if result, value := s.get("crypt:key"); result != 0 || value != "crypt:value" {
+			t.Fatalf("Recovered Expecting: crypt:value, Received: %d %q", result, value)
+		}
+
+		if _, err := recovered(nil, index); err != errEncrypted {
+			t.Fatalf("Recovery without key Expecting: %v, Received: %v", errEncrypted, err)
+		}
+		wrong, _ := loadKeyring("", testKey2)
+		if _, err := recovered(wrong, index); fatalRecovery(err) == nil {
+			t.Fatalf("Recovery with wrong key Expecting: seal error, Received: %v", err)
+		}
+	}
+
+	// Values swapped between keys no longer open
+	var sets []persistedSet
+	if err := json.Unmarshal(data, &sets); err != nil || len(sets) != 2 {
+		t.Fatalf("Delta Expecting: 2 sets, Received: %d %v", len(sets), err)
+	}
+	sets[1].Value, sets[1].Deleted, sets[1].Compressed = sets[0].Value, false, sets[0].Compressed
+	swapped, err := json.Marshal(sets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(LogDir, name), swapped, 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, index := range []bool{false, true} {
+		if _, err := recovered(keys, index); fatalRecovery(err) == nil {
+			t.Fatalf("Recovery of swapped values Expecting: seal error, Received: %v", err)
+		}
+	}
+
+	// Nor does a file replayed under another name
+	os.Remove(path.Join(LogDir, name))
+	replayed := fmt.Sprintf("%d-delta", time.Now().UnixNano())
+	defer os.Remove(path.Join(LogDir, replayed))
+	if err := ioutil.WriteFile(path.Join(LogDir, replayed), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, index := range []bool{false, true} {
+		if _, err := recovered(keys, index); fatalRecovery(err) == nil {
+			t.Fatalf("Recovery of a renamed file Expecting: seal error, Received: %v", err)
+		}
+	}
+	os.Remove(path.Join(LogDir, replayed))
+
+	// Plaintext entries are only read while migrating
+	plain := fmt.Sprintf("%d-delta", time.Now().UnixNano())
+	f, err = os.Create(path.Join(LogDir, plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path.Join(LogDir, plain))
+	w = newPersistWriter(plain, f, nil, false)
+	w.entry("crypt:plain", "value")
+	if err := w.finish(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	for _, index := range []bool{false, true} {
+		if _, err := recovered(keys, index); fatalRecovery(err) == nil {
+			t.Fatalf("Recovery of plaintext Expecting: seal error, Received: %v", err)
+		}
+		keys.plaintext = true
+		s, err := recovered(keys, index)
+		if err != nil {
+			t.Fatalf("Migrating plaintext Expecting: success, Received: %v", err)
+		}
+		if result, value := s.get("crypt:plain"); result != 0 || value != "value" {
+			t.Fatalf("Migrated Expecting: value, Received: %d %q", result, value)
+		}
+		keys.plaintext = false
+	}
+}
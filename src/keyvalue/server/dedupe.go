@@ -0,0 +1,103 @@
+package server
+
+import (
+	"keyvalue/protobuf"
+
+	"sync"
+)
+
+// Clients that agree on protobuf.FeatureDedupe name themselves with a session in
+// their hello. The answers to their recent sets are kept by session and request
+// id, so a set retried on a new connection after the old one dropped gets the
+// answer of the first attempt instead of being applied a second time.
+
+const (
+	MaxDedupeSessions = 1024 // Oldest sessions are forgotten beyond this
+	MaxDedupeSets     = 256  // Answers kept per session, oldest first out
+)
+
+type dedupe struct {
+	lock     sync.Mutex
+	sessions map[string]*session
+	order    []string // Oldest session first
+}
+
+type session struct {
+	sets  map[string]*dedupedSet
+	order []string // Oldest request id first
+}
+
+// The answer to one set, which a retry waits on if the first attempt is still running
+type dedupedSet struct {
+	done   chan struct{} // Closed once status and value are filled in
+	status *protobuf.Status
+	value  []byte
+}
+
+func newDedupe() *dedupe {
+	return &dedupe{sessions: make(map[string]*session)}
+}
+
+// Returns the set for the request id and whether it was already there. If it
+// wasn't the caller applies the set and must call finish
+func (d *dedupe) start(name string, id string) (*dedupedSet, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	sess, present := d.sessions[name]
+	if !present {
+		sess = &session{sets: make(map[string]*dedupedSet)}
+		d.sessions[name] = sess
+		d.order = append(d.order, name)
+		if len(d.order) > MaxDedupeSessions {
+			delete(d.sessions, d.order[0])
+			d.order = d.order[1:]
+		}
+	}
+
+	if set, present := sess.sets[id]; present {
+		return set, true
+	}
+	set := &dedupedSet{done: make(chan struct{})}
+	sess.sets[id] = set
+	sess.order = append(sess.order, id)
+	if len(sess.order) > MaxDedupeSets {
+		delete(sess.sets, sess.order[0])
+		sess.order = sess.order[1:]
+	}
+	return set, false
+}
+
+// Failed sets are forgotten so a retry applies them again
+func (d *dedupe) finish(name string, id string, set *dedupedSet, status *protobuf.Status, value []byte) {
+	if status.Result() == -1 {
+		d.lock.Lock()
+		if sess, present := d.sessions[name]; present && sess.sets[id] == set {
+			delete(sess.sets, id)
+		}
+		d.lock.Unlock()
+	} else {
+		set.status, set.value = status, value
+	}
+	close(set.done)
+}
+
+// Applies a set from a session at most once, retries get the first answer
+func (s *Server) dedupedSet(c *connection, id string, apply func() (*protobuf.Status, []byte)) (*protobuf.Status, []byte) {
+	if c.session == "" {
+		return apply()
+	}
+	for {
+		set, retried := s.dedupe.start(c.session, id)
+		if !retried {
+			status, value := apply()
+			s.dedupe.finish(c.session, id, set, status, value)
+			return status, value
+		}
+		<-set.done
+		if set.status != nil {
+			return set.status, set.value
+		}
+		// The first attempt failed and was forgotten, try again
+	}
+}
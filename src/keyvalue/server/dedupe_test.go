@@ -0,0 +1,92 @@
+package server
+
+import (
+	"keyvalue/protobuf"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"bufio"
+	"net"
+	"testing"
+)
+
+func TestDedupe(t *testing.T) {
+	d := newDedupe()
+	set, retried := d.start("session", "1")
+	if retried {
+		t.Fatal("First attempt Expecting: not retried")
+	}
+	d.finish("session", "1", set, protobuf.NewStatus(protobuf.Status_OK, ""), []byte("old"))
+	if again, retried := d.start("session", "1"); !retried || string(again.value) != "old" {
+		t.Fatalf("Retry Expecting: first answer, Received: %v %q", retried, again.value)
+	}
+	if _, retried := d.start("other", "1"); retried {
+		t.Fatal("Same id in another session Expecting: not retried")
+	}
+
+	// Failures are forgotten so the retry applies the set
+	set, _ = d.start("session", "2")
+	d.finish("session", "2", set, protobuf.NewStatus(protobuf.Status_ERROR, "failed"), nil)
+	if _, retried := d.start("session", "2"); retried {
+		t.Fatal("Retry of failed set Expecting: not retried")
+	}
+
+	for i := 0; i < MaxDedupeSessions; i++ {
+		d.start(string(rune(i)), "1")
+	}
+	if _, present := d.sessions["session"]; present {
+		t.Fatal("Oldest session Expecting: forgotten")
+	}
+}
+
+func TestServerDedupe(t *testing.T) {
+	status, server := Init(12368)
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+
+	// Every connection says hello with the same session, like a client reconnecting
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", "localhost:12368")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hello := protobuf.NewHello([]string{protobuf.FeatureDedupe}, protobuf.DefaultMaxFrameSize)
+		hello.Session = proto.String("session")
+		if err := protobuf.WriteFrame(conn, &protobuf.Request{Id: proto.String("hello"), Op: protobuf.Request_HELLO.Enum(), Key: []byte{}, Hello: hello}); err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		response := new(protobuf.Response)
+		if err := protobuf.ReadFrame(reader, protobuf.DefaultMaxFrameSize, response); err != nil {
+			t.Fatal(err)
+		}
+		return conn, reader
+	}
+	set := func(conn net.Conn, reader *bufio.Reader, id string, value string) string {
+		request := &protobuf.Request{Id: proto.String(id), Op: protobuf.Request_SET.Enum(), Key: []byte("dedupe"), Value: []byte(value)}
+		if err := protobuf.WriteFrame(conn, request); err != nil {
+			t.Fatal(err)
+		}
+		response := new(protobuf.Response)
+		if err := protobuf.ReadFrame(reader, protobuf.DefaultMaxFrameSize, response); err != nil {
+			t.Fatal(err)
+		}
+		return string(response.GetValue())
+	}
+
+	conn, reader := dial()
+	set(conn, reader, "1", "first")
+	first := set(conn, reader, "2", "second")
+	conn.Close()
+
+	conn, reader = dial()
+	defer conn.Close()
+	if old := set(conn, reader, "2", "second"); old != first {
+		t.Fatalf("Retried set Expecting: old value %q, Received: %q", first, old)
+	}
+	if old := set(conn, reader, "3", "third"); old != "second" {
+		t.Fatalf("Next set Expecting: old value second, Received: %q", old)
+	}
+}
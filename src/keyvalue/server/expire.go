@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Keys can be given a time to live after which reads treat them as missing
+// and the sweeper deletes them. Expiries are only kept in memory, so a key
+// with a ttl survives a restart without it.
+
+var errNotExpired = errors.New("key no longer expired")
+
+// Returns 1 if key doesn't exist, like Get
+func (s *Server) Expire(key string, ttl time.Duration) int {
+	result, _ := s.Get(key)
+	if result != 0 {
+		return result
+	}
+
+	s.setExpiry(key, ttl)
+	return 0
+}
+
+func (s *Server) setExpiry(key string, ttl time.Duration) {
+	s.expiresLock.Lock()
+	s.expires[key] = time.Now().Add(ttl)
+	s.expiresLock.Unlock()
+}
+
+func (s *Server) expired(key string) bool {
+	s.expiresLock.Lock()
+	defer s.expiresLock.Unlock()
+	deadline, present := s.expires[key]
+	return present && time.Now().After(deadline)
+}
+
+func (s *Server) clearExpiry(key string) {
+	s.expiresLock.Lock()
+	delete(s.expires, key)
+	s.expiresLock.Unlock()
+}
+
+// Deletes expired keys every second, checking again when the delete is applied
+// since the key could have been set in the meantime
+func (s *Server) expireKeys() {
+	ticker := time.NewTicker(time.Second)
+	for waitTick(ticker, s.stop) {
+		now := time.Now()
+		var keys []string
+		s.expiresLock.Lock()
+		for key, deadline := range s.expires {
+			if now.After(deadline) {
+				keys = append(keys, key)
+			}
+		}
+		s.expiresLock.Unlock()
+
+		for _, key := range keys {
+			s.queue(context.Background(), &set{
+				Key: key,
+				// Expired keys are reported as not present, see set
+				update: func(old string, present bool) (string, bool, error) {
+					if present {
+						return "", false, errNotExpired
+					}
+					return "", true, nil
+				},
+				done: make(chan error, 1),
+			}, 0)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServerExpire(t *testing.T) {
+	status, server := Init(12355)
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+
+	server.Update("expire", func(string, bool) (string, bool, error) {
+		return "value", false, nil
+	})
+	if result := server.Expire("expire", time.Millisecond); result != 0 {
+		t.Fatalf("Expire Expecting: 0, Received: %d", result)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if result, _ := server.Get("expire"); result != 1 {
+		t.Fatalf("Get after ttl Expecting: 1, Received: %d", result)
+	}
+
+	// Writing the key again starts it without a ttl
+	server.Update("expire", func(old string, present bool) (string, bool, error) {
+		if present {
+			t.Errorf("Update Expecting expired key to be missing, Received: %s", old)
+		}
+		return "again", false, nil
+	})
+	if result, value := server.Get("expire"); result != 0 || value != "again" {
+		t.Fatalf("Get Expecting: (0, again), Received: (%d, %s)", result, value)
+	}
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"keyvalue/protobuf"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path"
+	"time"
+)
+
+// Serves protobuf.KeyValueServer on top of the same Get and Set as the framed protocol.
+// With an ACL clients authenticate with Basic or Bearer authorization metadata.
+type grpcService struct {
+	server *Server
+}
+
+func (s *Server) serveGRPC(port uint16) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+
+	options := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(int(s.maxFrameSize)),
+		grpc.MaxSendMsgSize(int(s.maxFrameSize)),
+		grpc.UnaryInterceptor(s.interceptUnary),
+		grpc.StreamInterceptor(s.interceptStream),
+	}
+	if s.tls != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(s.tls)))
+	}
+	s.grpcServer = grpc.NewServer(options...)
+	protobuf.RegisterKeyValueServer(s.grpcServer, &grpcService{server: s})
+	go func() {
+		if err := s.grpcServer.Serve(listener); err != nil {
+			log.Printf("Error serving gRPC: %v\n", err)
+		}
+	}()
+	log.Printf("Server accepting gRPC requests on port %d\n", port)
+	return nil
+}
+
+// Calls with bad credentials fail with Unauthenticated, calls past MaxInFlight or
+// the client's rate limit with ResourceExhausted, see limit.go. The returned
+// context keeps the principal for authorize
+func (s *Server) admitGRPC(ctx context.Context) (context.Context, error) {
+	var p *principal
+	if s.acl != nil {
+		var header string
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get("authorization"); len(values) > 0 {
+				header = values[0]
+			}
+		}
+		var err error
+		if p, err = s.acl.authorization(header); err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		ctx = withPrincipal(ctx, p)
+	}
+	addr := ""
+	if peer, ok := peer.FromContext(ctx); ok {
+		addr = peer.Addr.String()
+	}
+	if busy := s.limits.admit(clientName(p, addr)); busy != nil {
+		return nil, status.Error(codes.ResourceExhausted, busy.GetMessage())
+	}
+	return ctx, nil
+}
+
+// Every call is timed and goes through admission control
+func (s *Server) interceptUnary(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	defer s.measureGRPC(info.FullMethod, time.Now())
+	ctx, err := s.admitGRPC(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.limits.release()
+	return handler(ctx, request)
+}
+
+// Hands the stream's handler the context admitGRPC returned
+type admittedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (a admittedStream) Context() context.Context {
+	return a.ctx
+}
+
+func (s *Server) interceptStream(service interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	defer s.measureGRPC(info.FullMethod, time.Now())
+	ctx, err := s.admitGRPC(stream.Context())
+	if err != nil {
+		return err
+	}
+	defer s.limits.release()
+	return handler(service, admittedStream{stream, ctx})
+}
+
+// Methods are named like /keyvalue.KeyValue/Get
+func (s *Server) measureGRPC(method string, started time.Time) {
+	s.metrics.request("grpc", opLabel(path.Base(method), true), time.Since(started))
+}
+
+func valueResponse(result int, value []byte) *protobuf.ValueResponse {
+	return &protobuf.ValueResponse{Status: protobuf.ResultStatus(result), Value: value}
+}
+
+// Keys the principal admitGRPC found may not touch get a PERMISSION_DENIED response
+func (g *grpcService) authorize(ctx context.Context, key []byte, write bool) *protobuf.ValueResponse {
+	if g.server.acl == nil {
+		return nil
+	}
+	p := contextPrincipal(ctx)
+	if !p.can(string(key), write) {
+		return &protobuf.ValueResponse{Status: protobuf.NewStatus(protobuf.Status_PERMISSION_DENIED, denied(p, string(key), write))}
+	}
+	return nil
+}
+
+func (g *grpcService) Get(ctx context.Context, request *protobuf.GetRequest) (*protobuf.ValueResponse, error) {
+	if response := g.authorize(ctx, request.GetKey(), false); response != nil {
+		return response, nil
+	}
+	result, value := g.server.GetBytesContext(ctx, request.GetKey())
+	if len(value) > g.chunkSize() {
+		message := fmt.Sprintf("value of %d bytes does not fit in a message, use GetStream", len(value))
+		return &protobuf.ValueResponse{Status: protobuf.NewStatus(protobuf.Status_TOO_LARGE, message)}, nil
+	}
+	return valueResponse(result, value), nil
+}
+
+func (g *grpcService) Set(ctx context.Context, request *protobuf.SetRequest) (*protobuf.ValueResponse, error) {
+	if response := g.authorize(ctx, request.GetKey(), true); response != nil {
+		return response, nil
+	}
+	result, old, err := g.set(ctx, request.GetKey(), request.GetValue())
+	if err != nil {
+		return nil, err
+	}
+	if len(old) > g.chunkSize() {
+		// The set went through, only the old value is too big to return
+		old = nil
+	}
+	return valueResponse(result, old), nil
+}
+
+func (g *grpcService) Delete(ctx context.Context, request *protobuf.DeleteRequest) (*protobuf.ValueResponse, error) {
+	if response := g.authorize(ctx, request.GetKey(), true); response != nil {
+		return response, nil
+	}
+	result, old, _, err := g.server.limitedDelete(ctx, string(request.GetKey()))
+	if err == errQueueFull {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if len(old) > g.chunkSize() {
+		// Deleted all the same, only the old value is too big to return
+		old = ""
+	}
+	return valueResponse(result, []byte(old)), nil
+}
+
+func (g *grpcService) GetStream(request *protobuf.GetRequest, stream protobuf.KeyValue_GetStreamServer) error {
+	if response := g.authorize(stream.Context(), request.GetKey(), false); response != nil {
+		return stream.Send(response)
+	}
+	result, value := g.server.GetBytesContext(stream.Context(), request.GetKey())
+	size := g.chunkSize()
+	for {
+		chunk := value
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		if err := stream.Send(valueResponse(result, chunk)); err != nil {
+			return err
+		}
+		value = value[len(chunk):]
+		if len(value) == 0 {
+			return nil
+		}
+	}
+}
+
+func (g *grpcService) SetStream(stream protobuf.KeyValue_SetStreamServer) error {
+	var key, value []byte
+	chunks := 0
+	for {
+		request, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if chunks == 0 {
+			// Checked on the first chunk so a denied upload isn't buffered
+			if response := g.authorize(stream.Context(), request.GetKey(), true); response != nil {
+				return stream.SendAndClose(response)
+			}
+			key = request.GetKey()
+		} else if !bytes.Equal(request.GetKey(), key) {
+			// Only the first key was authorized
+			message := fmt.Sprintf("chunk %d names a different key than the first", chunks)
+			return stream.SendAndClose(&protobuf.ValueResponse{Status: protobuf.NewStatus(protobuf.Status_INVALID, message)})
+		}
+		chunks++
+		if len(value)+len(request.GetValue()) > MaxValueSize {
+			message := fmt.Sprintf("value larger than %d bytes", MaxValueSize)
+			return stream.SendAndClose(&protobuf.ValueResponse{Status: protobuf.NewStatus(protobuf.Status_TOO_LARGE, message)})
+		}
+		value = append(value, request.GetValue()...)
+	}
+	if chunks == 0 {
+		return stream.SendAndClose(&protobuf.ValueResponse{Status: protobuf.NewStatus(protobuf.Status_INVALID, "no chunks sent, not even the key")})
+	}
+
+	result, old, err := g.set(stream.Context(), key, value)
+	if err != nil {
+		return err
+	}
+	if len(old) > g.chunkSize() {
+		old = nil
+	}
+	return stream.SendAndClose(valueResponse(result, old))
+}
+
+// Sets waiting no longer than QueueTimeout for room in the queue, failing with
+// ResourceExhausted like admitGRPC if there was none
+func (g *grpcService) set(ctx context.Context, key []byte, value []byte) (int, []byte, error) {
+	result, old, _, err := g.server.limitedSet(ctx, string(key), string(value))
+	if err == errQueueFull {
+		return result, nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return result, []byte(old), nil
+}
+
+// Value bytes that fit in one gRPC message alongside the status
+func (g *grpcService) chunkSize() int {
+	return protobuf.ChunkSize(g.server.maxFrameSize, "", nil)
+}
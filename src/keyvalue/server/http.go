@@ -0,0 +1,289 @@
+package server
+
+import (
+	"keyvalue/protobuf"
+
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// REST gateway on top of Get, Set and Delete:
+//   GET/PUT/DELETE /keys/{key}  value is the raw request or response body
+//   GET /keys?prefix=p&limit=n  lists keys as JSON
+//   POST /batch                 runs a JSON list of operations in order, values
+//                               are base64 so they can hold any bytes
+// Errors come back as a JSON body with the status code name and a message.
+// With an ACL clients authenticate with Basic or Bearer authorization.
+
+type httpError struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+type batchRequest struct {
+	Operations []batchOperation `json:"operations"`
+}
+
+type batchOperation struct {
+	Op    string `json:"op"` // get, set or delete
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+}
+
+// Value is the value for a get and the old value for a set or delete
+type batchResult struct {
+	Key    string `json:"key"`
+	Status string `json:"status"`
+	Value  []byte `json:"value,omitempty"`
+}
+
+func (s *Server) serveHTTP(port uint16) error {
+	listener, err := s.listen(port)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keys", s.handleKeys)
+	mux.HandleFunc("/keys/", s.handleKey)
+	mux.HandleFunc("/batch", s.handleBatch)
+	s.httpServer = &http.Server{Handler: s.measureHTTP(s.authenticateHTTP(s.limitHTTP(mux)))}
+	go func() {
+		if err := s.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Error serving HTTP: %v\n", err)
+		}
+	}()
+	log.Printf("Server accepting HTTP requests on port %d\n", port)
+	return nil
+}
+
+// Keeps the principal in the request context, requests with bad credentials go no further
+func (s *Server) authenticateHTTP(handler http.Handler) http.Handler {
+	if s.acl == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := s.acl.authorization(r.Header.Get("Authorization"))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="keyvalue"`)
+			writeError(w, http.StatusUnauthorized, protobuf.Status_UNAUTHENTICATED, err.Error())
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+	})
+}
+
+// Times every request by the operation its path and method map to
+func (s *Server) measureHTTP(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		handler.ServeHTTP(w, r)
+		op := "unknown"
+		switch {
+		case r.URL.Path == "/keys":
+			op = "list"
+		case r.URL.Path == "/batch":
+			op = "batch"
+		case strings.HasPrefix(r.URL.Path, "/keys/") && r.Method == http.MethodGet:
+			op = "get"
+		case strings.HasPrefix(r.URL.Path, "/keys/") && r.Method == http.MethodPut:
+			op = "set"
+		case strings.HasPrefix(r.URL.Path, "/keys/") && r.Method == http.MethodDelete:
+			op = "delete"
+		}
+		s.metrics.request("http", op, time.Since(started))
+	})
+}
+
+// Requests past MaxInFlight or the client's rate limit get a 503, see limit.go
+func (s *Server) limitHTTP(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if busy := s.limits.admit(clientName(contextPrincipal(r.Context()), r.RemoteAddr)); busy != nil {
+			writeBusy(w, busy.GetMessage())
+			return
+		}
+		defer s.limits.release()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing HTTP response: %v\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, status protobuf.Status_Code, message string) {
+	writeJSON(w, code, httpError{Status: status.String(), Error: message})
+}
+
+// 503 telling the client to retry shortly
+func writeBusy(w http.ResponseWriter, message string) {
+	w.Header().Set("Retry-After", "1")
+	writeError(w, http.StatusServiceUnavailable, protobuf.Status_BUSY, message)
+}
+
+// Maps the result codes of Get, Set and Delete onto an error response, returns false if there was none
+func writeResultError(w http.ResponseWriter, result int, key string) bool {
+	switch result {
+	case 1:
+		writeError(w, http.StatusNotFound, protobuf.Status_NOT_FOUND, fmt.Sprintf("key '%s' not found", key))
+	case -1:
+		writeError(w, http.StatusInternalServerError, protobuf.Status_ERROR, "server error, see the server log")
+	default:
+		return false
+	}
+	return true
+}
+
+func (s *Server) handleKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/keys/")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, protobuf.Status_ERROR, "missing key, use /keys/{key}")
+		return
+	}
+	p := contextPrincipal(r.Context())
+	if write := r.Method == "PUT" || r.Method == "DELETE"; !s.authorized(p, key, write) {
+		writeError(w, http.StatusForbidden, protobuf.Status_PERMISSION_DENIED, denied(p, key, write))
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		result, value := s.Get(key)
+		if writeResultError(w, result, key) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+		io.WriteString(w, value)
+	case "PUT":
+		value, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(MaxValueSize)+1))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, protobuf.Status_ERROR, fmt.Sprintf("could not read value: %v", err))
+			return
+		}
+		if len(value) > MaxValueSize {
+			writeError(w, http.StatusRequestEntityTooLarge, protobuf.Status_TOO_LARGE, fmt.Sprintf("value larger than %d bytes", MaxValueSize))
+			return
+		}
+		// Writes wait no longer than QueueTimeout for room in the queue
+		result, _, _, err := s.limitedSet(r.Context(), key, string(value))
+		switch {
+		case result == 0:
+			w.WriteHeader(http.StatusNoContent)
+		case result == 1:
+			w.WriteHeader(http.StatusCreated)
+		case err == errQueueFull:
+			writeBusy(w, err.Error())
+		default:
+			writeResultError(w, result, key)
+		}
+	case "DELETE":
+		result, _, _, err := s.limitedDelete(r.Context(), key)
+		if err == errQueueFull {
+			writeBusy(w, err.Error())
+			return
+		}
+		if writeResultError(w, result, key) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, protobuf.Status_UNKNOWN_OPERATION, fmt.Sprintf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *Server) handleKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, protobuf.Status_UNKNOWN_OPERATION, fmt.Sprintf("method %s not allowed", r.Method))
+		return
+	}
+
+	query := r.URL.Query()
+	limit := -1
+	if param := query.Get("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, protobuf.Status_ERROR, fmt.Sprintf("limit '%s' is not a positive number", param))
+			return
+		}
+	}
+
+	result, keys := s.Keys(query.Get("prefix"))
+	if writeResultError(w, result, "") {
+		return
+	}
+	keys = s.readable(contextPrincipal(r.Context()), keys)
+	if keys == nil {
+		keys = []string{}
+	}
+	if limit >= 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"keys": keys})
+}
+
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, protobuf.Status_UNKNOWN_OPERATION, fmt.Sprintf("method %s not allowed", r.Method))
+		return
+	}
+
+	var batch batchRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, int64(MaxValueSize))).Decode(&batch); err != nil {
+		writeError(w, http.StatusBadRequest, protobuf.Status_ERROR, fmt.Sprintf("could not parse batch: %v", err))
+		return
+	}
+
+	ctx := r.Context()
+	p := contextPrincipal(ctx)
+	results := make([]batchResult, len(batch.Operations))
+	var written uint64 // Sequence of the last write, later operations wait for it to be applied
+	for i, op := range batch.Operations {
+		var result int
+		var value string
+		if known := op.Op == "get" || op.Op == "set" || op.Op == "delete"; known && !s.authorized(p, op.Key, op.Op != "get") {
+			results[i] = batchResult{Key: op.Key, Status: protobuf.Status_PERMISSION_DENIED.String()}
+			continue
+		}
+		if !s.waitApplied(ctx, written) {
+			results[i] = batchResult{Key: op.Key, Status: protobuf.ResultStatus(-1).GetCode().String()}
+			continue
+		}
+		var sequence uint64
+		var err error
+		switch op.Op {
+		case "get":
+			result, value = s.Get(op.Key)
+		case "set":
+			result, value, sequence, err = s.limitedSet(ctx, op.Key, string(op.Value))
+		case "delete":
+			result, value, sequence, err = s.limitedDelete(ctx, op.Key)
+		default:
+			results[i] = batchResult{Key: op.Key, Status: protobuf.Status_UNKNOWN_OPERATION.String()}
+			continue
+		}
+		if err == errQueueFull {
+			results[i] = batchResult{Key: op.Key, Status: protobuf.Status_BUSY.String()}
+			continue
+		}
+		if sequence > written {
+			written = sequence
+		}
+		results[i] = batchResult{Key: op.Key, Status: protobuf.ResultStatus(result).GetCode().String(), Value: []byte(value)}
+	}
+	writeJSON(w, http.StatusOK, map[string][]batchResult{"results": results})
+}
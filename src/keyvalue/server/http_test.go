@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func httpDo(t *testing.T, method string, url string, body string) (int, string) {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode, string(data)
+}
+
+// Sets are applied in the background so reads right after may still see the old value
+func httpEventually(t *testing.T, url string, code int) {
+	for i := 0; i < 100; i++ {
+		if got, _ := httpDo(t, "GET", url, ""); got == code {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("GET %s Expecting: %d", url, code)
+}
+
+func TestServerHTTP(t *testing.T) {
+	status, server := InitConfig(Config{Port: 12351, HTTPPort: 12352})
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+	base := "http://localhost:12352"
+
+	if code, _ := httpDo(t, "PUT", base+"/keys/http%2Fkey", "value"); code != http.StatusCreated && code != http.StatusNoContent {
+		t.Fatalf("PUT Expecting: 201 or 204, Received: %d", code)
+	}
+	httpEventually(t, base+"/keys/http%2Fkey", http.StatusOK)
+	if code, body := httpDo(t, "GET", base+"/keys/http%2Fkey", ""); code != http.StatusOK || body != "value" {
+		t.Fatalf("GET Expecting: 200 value, Received: %d %s", code, body)
+	}
+
+	code, body := httpDo(t, "GET", base+"/keys?prefix=http/", "")
+	var list struct{ Keys []string }
+	if err := json.Unmarshal([]byte(body), &list); err != nil || code != http.StatusOK || len(list.Keys) != 1 || list.Keys[0] != "http/key" {
+		t.Fatalf("GET /keys Expecting: 200 [http/key], Received: %d %s", code, body)
+	}
+
+	code, body = httpDo(t, "POST", base+"/batch", `{"operations": [{"op": "get", "key": "http/key"}, {"op": "bogus", "key": "x"}]}`)
+	var batch struct{ Results []batchResult }
+	if err := json.Unmarshal([]byte(body), &batch); err != nil || code != http.StatusOK || len(batch.Results) != 2 {
+		t.Fatalf("POST /batch Expecting: 200 with 2 results, Received: %d %s", code, body)
+	}
+	if batch.Results[0].Status != "OK" || string(batch.Results[0].Value) != "value" || batch.Results[1].Status != "UNKNOWN_OPERATION" {
+		t.Fatalf("POST /batch Received: %s", body)
+	}
+
+	// Later operations see the writes before them in the same batch
+	code, body = httpDo(t, "POST", base+"/batch", `{"operations": [{"op": "set", "key": "http/batch", "value": "MQ=="}, {"op": "get", "key": "http/batch"}, {"op": "set", "key": "http/batch", "value": "Mg=="}, {"op": "delete", "key": "http/batch"}, {"op": "get", "key": "http/batch"}]}`)
+	batch.Results = nil
+	if err := json.Unmarshal([]byte(body), &batch); err != nil || code != http.StatusOK || len(batch.Results) != 5 {
+		t.Fatalf("POST /batch Expecting: 200 with 5 results, Received: %d %s", code, body)
+	}
+	expected := []batchResult{{"http/batch", "NOT_FOUND", nil}, {"http/batch", "OK", []byte("1")}, {"http/batch", "OK", []byte("1")}, {"http/batch", "OK", []byte("2")}, {"http/batch", "NOT_FOUND", nil}}
+	for i, result := range batch.Results {
+		if result.Key != expected[i].Key || result.Status != expected[i].Status || !bytes.Equal(result.Value, expected[i].Value) {
+			t.Fatalf("POST /batch operation %d Expecting: %v, Received: %v", i, expected[i], result)
+		}
+	}
+
+	// Values are base64 so bytes that aren't UTF-8 come back unchanged
+	binary := []byte{0xff, 0xfe, 0x00, 0x80}
+	code, body = httpDo(t, "POST", base+"/batch", `{"operations": [{"op": "set", "key": "http/binary", "value": "//4AgA=="}, {"op": "get", "key": "http/binary"}]}`)
+	batch.Results = nil
+	if err := json.Unmarshal([]byte(body), &batch); err != nil || code != http.StatusOK || len(batch.Results) != 2 {
+		t.Fatalf("POST /batch binary Expecting: 200 with 2 results, Received: %d %s", code, body)
+	}
+	if batch.Results[1].Status != "OK" || !bytes.Equal(batch.Results[1].Value, binary) {
+		t.Fatalf("POST /batch binary get Expecting: %v, Received: %v", binary, batch.Results[1])
+	}
+	if code, body := httpDo(t, "GET", base+"/keys/http%2Fbinary", ""); code != http.StatusOK || body != string(binary) {
+		t.Fatalf("GET binary Expecting: 200 %q, Received: %d %q", binary, code, body)
+	}
+
+	if code, _ := httpDo(t, "DELETE", base+"/keys/http%2Fkey", ""); code != http.StatusNoContent {
+		t.Fatalf("DELETE Expecting: 204, Received: %d", code)
+	}
+	httpEventually(t, base+"/keys/http%2Fkey", http.StatusNotFound)
+
+	code, body = httpDo(t, "GET", base+"/keys/http%2Fkey", "")
+	var failure httpError
+	if err := json.Unmarshal([]byte(body), &failure); err != nil || failure.Status != "NOT_FOUND" {
+		t.Fatalf("GET Expecting: JSON NOT_FOUND error, Received: %d %s", code, body)
+	}
+}
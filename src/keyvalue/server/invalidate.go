@@ -0,0 +1,140 @@
+package server
+
+import (
+	"keyvalue/protobuf"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"log"
+	"sync"
+)
+
+// Clients that agree on protobuf.FeatureInvalidate may cache what they read. Every
+// key read on such a connection is tracked, and once it is written by anyone the
+// connection is told in a response with id protobuf.InvalidateId and the key is no
+// longer tracked until it is read again. Invalidations are queued by the writer
+// and sent by a goroutine per connection so writes never wait on slow clients.
+
+const MaxTrackedKeys = 65536 // Per connection, past this the client is told to drop older keys
+
+type tracking struct {
+	lock sync.Mutex
+	keys map[string]map[*connection]bool // Connections that may have each key cached
+}
+
+func newTracking() *tracking {
+	return &tracking{keys: make(map[string]map[*connection]bool)}
+}
+
+// Must be called before key is read so a write racing the read is still invalidated
+func (t *tracking) track(c *connection, key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if c.tracked[key] {
+		return
+	}
+	if len(c.tracked) >= MaxTrackedKeys {
+		// Whichever key the map gives us first, the client just reads it again
+		for old := range c.tracked {
+			t.untrack(c, old)
+			t.queue(c, old)
+			break
+		}
+	}
+	if t.keys[key] == nil {
+		t.keys[key] = make(map[*connection]bool)
+	}
+	t.keys[key][c] = true
+	c.tracked[key] = true
+}
+
+// Under lock
+func (t *tracking) untrack(c *connection, key string) {
+	delete(c.tracked, key)
+	delete(t.keys[key], c)
+	if len(t.keys[key]) == 0 {
+		delete(t.keys, key)
+	}
+}
+
+// Under lock, wakes the connection's pusher
+func (t *tracking) queue(c *connection, key string) {
+	c.invalid[key] = true
+	select {
+	case c.invalidated <- struct{}{}:
+	default:
+	}
+}
+
+// Called for every applied write
+func (t *tracking) invalidate(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for c := range t.keys[key] {
+		t.untrack(c, key)
+		t.queue(c, key)
+	}
+}
+
+// Keys tracked for any connection
+func (t *tracking) count() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.keys)
+}
+
+// Once the connection is gone
+func (t *tracking) forget(c *connection) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for key := range c.tracked {
+		t.untrack(c, key)
+	}
+}
+
+// Takes the keys waiting to be sent to the connection
+func (t *tracking) take(c *connection) []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	keys := make([]string, 0, len(c.invalid))
+	for key := range c.invalid {
+		keys = append(keys, key)
+	}
+	c.invalid = make(map[string]bool)
+	return keys
+}
+
+// Sends the connection's invalidations until it closes, as many keys to a frame as fit
+func (s *Server) pushInvalidations(c *connection) {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-c.invalidated:
+		}
+
+		keys := s.tracking.take(c)
+		for len(keys) > 0 {
+			response := &protobuf.Response{
+				Id:     proto.String(protobuf.InvalidateId),
+				Result: proto.Int32(0),
+				Status: protobuf.NewStatus(protobuf.Status_OK, ""),
+			}
+			// Room for the field tags and lengths of every key
+			size := protobuf.ChunkSize(c.maxFrameSize, protobuf.InvalidateId, nil)
+			for len(keys) > 0 && (len(response.Invalidate) == 0 || size > len(keys[0])+8) {
+				response.Invalidate = append(response.Invalidate, []byte(keys[0]))
+				size -= len(keys[0]) + 8
+				keys = keys[1:]
+			}
+
+			c.writeLock.Lock()
+			err := protobuf.WriteFrame(c.conn, response)
+			c.writeLock.Unlock()
+			if err != nil {
+				log.Printf("Error writing invalidations: %v\n", err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"keyvalue/protobuf"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerInvalidate(t *testing.T) {
+	status, server := Init(12384)
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+
+	dial := func(features []string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", "localhost:12384")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hello := protobuf.NewHello(features, protobuf.DefaultMaxFrameSize)
+		if err := protobuf.WriteFrame(conn, &protobuf.Request{Id: proto.String("hello"), Op: protobuf.Request_HELLO.Enum(), Key: []byte{}, Hello: hello}); err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		response := new(protobuf.Response)
+		if err := protobuf.ReadFrame(reader, protobuf.DefaultMaxFrameSize, response); err != nil {
+			t.Fatal(err)
+		}
+		return conn, reader
+	}
+	call := func(conn net.Conn, reader *bufio.Reader, request *protobuf.Request) *protobuf.Response {
+		if err := protobuf.WriteFrame(conn, request); err != nil {
+			t.Fatal(err)
+		}
+		response := new(protobuf.Response)
+		if err := protobuf.ReadFrame(reader, protobuf.DefaultMaxFrameSize, response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	get := &protobuf.Request{Id: proto.String("1"), Op: protobuf.Request_GET.Enum(), Key: []byte("tracked")}
+	set := &protobuf.Request{Id: proto.String("2"), Op: protobuf.Request_SET.Enum(), Key: []byte("tracked"), Value: []byte("value")}
+
+	reader, readerBuf := dial([]string{protobuf.FeatureInvalidate})
+	defer reader.Close()
+	writer, writerBuf := dial(nil)
+	defer writer.Close()
+
+	call(reader, readerBuf, get)
+	call(writer, writerBuf, set)
+	reader.SetReadDeadline(time.Now().Add(time.Second))
+	response := new(protobuf.Response)
+	if err := protobuf.ReadFrame(readerBuf, protobuf.DefaultMaxFrameSize, response); err != nil {
+		t.Fatalf("Expecting: invalidation after set, Received: %v", err)
+	}
+	if response.GetId() != protobuf.InvalidateId || len(response.GetInvalidate()) != 1 || string(response.GetInvalidate()[0]) != "tracked" {
+		t.Fatalf("Expecting: tracked invalidated, Received: %v", response)
+	}
+
+	// Only once until it is read again
+	call(writer, writerBuf, set)
+	reader.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if err := protobuf.ReadFrame(readerBuf, protobuf.DefaultMaxFrameSize, response); err == nil {
+		t.Fatalf("Second set Expecting: no invalidation, Received: %v", response)
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"keyvalue/protobuf"
+
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Admission control keeps an overloaded server answering quickly rather than
+// piling up goroutines. Past MaxConnections new connections are told the server
+// is busy and closed, past MaxInFlight requests being handled at once the rest
+// are answered busy straight away, and a client sending more than RateLimit
+// requests a second is answered busy until it slows down. Clients are told apart
+// by principal when authenticated and by address otherwise. Writes on every port
+// that can't get into pending within QueueTimeout are answered busy too. Busy
+// requests were not applied, so clients can always send them again.
+
+const MaxRateBuckets = 65536 // Clients tracked for rate limiting, idle ones are forgotten past this
+
+var (
+	errBusy      = errors.New("too many connections")
+	errQueueFull = errors.New("too many sets waiting to be applied")
+)
+
+type limits struct {
+	busy         uint64 // Requests turned away, updated atomically so must stay 64-bit aligned
+	maxConns     int
+	inflight     chan struct{} // One per request being handled, nil without MaxInFlight
+	rate         float64       // Requests a second per client, 0 for no limit
+	burst        float64
+	queueTimeout time.Duration
+	buckets      map[string]*bucket
+	bucketsLock  sync.Mutex
+}
+
+// Token bucket of one client
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newLimits(config Config) *limits {
+	l := &limits{
+		maxConns:     config.MaxConnections,
+		rate:         config.RateLimit,
+		burst:        float64(config.RateBurst),
+		queueTimeout: config.QueueTimeout,
+		buckets:      make(map[string]*bucket),
+	}
+	if config.MaxInFlight > 0 {
+		l.inflight = make(chan struct{}, config.MaxInFlight)
+	}
+	if l.burst < 1 {
+		l.burst = l.rate
+		if l.burst < 1 {
+			l.burst = 1
+		}
+	}
+	if l.queueTimeout == 0 {
+		l.queueTimeout = time.Second
+	}
+	return l
+}
+
+// Takes a slot for a request from client, which must be given back with release.
+// Returns the busy status instead if there's no room
+func (l *limits) admit(client string) *protobuf.Status {
+	if !l.allow(client) {
+		atomic.AddUint64(&l.busy, 1)
+		return protobuf.NewStatus(protobuf.Status_BUSY, fmt.Sprintf("over the rate limit of %g requests a second", l.rate))
+	}
+	if l.inflight == nil {
+		return nil
+	}
+	select {
+	case l.inflight <- struct{}{}:
+		return nil
+	default:
+		atomic.AddUint64(&l.busy, 1)
+		return protobuf.NewStatus(protobuf.Status_BUSY, fmt.Sprintf("already handling %d requests", cap(l.inflight)))
+	}
+}
+
+func (l *limits) release() {
+	if l.inflight != nil {
+		<-l.inflight
+	}
+}
+
+// Takes a token from the client's bucket, which refills at rate up to burst
+func (l *limits) allow(client string) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.bucketsLock.Lock()
+	defer l.bucketsLock.Unlock()
+	now := time.Now()
+	b, present := l.buckets[client]
+	if !present {
+		if len(l.buckets) >= MaxRateBuckets {
+			l.forgetIdle(now)
+		}
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.updated).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.updated = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Under bucketsLock. Buckets that have refilled are the same as new ones
+func (l *limits) forgetIdle(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// Writes for the listeners wait no longer than QueueTimeout for room in the queue
+// and fail with errQueueFull once it's up, see SetSequenced and deleteSequenced
+func (s *Server) limitedSet(ctx context.Context, key string, value string) (int, string, uint64, error) {
+	return s.replace(ctx, &set{Key: key, Value: value}, s.limits.queueTimeout)
+}
+
+func (s *Server) limitedDelete(ctx context.Context, key string) (int, string, uint64, error) {
+	return s.replace(ctx, &set{Key: key, Deleted: true}, s.limits.queueTimeout)
+}
+
+// Update for the Redis and memcached commands, errQueueFull if it couldn't be
+// queued within QueueTimeout
+func (s *Server) limitedUpdate(key string, update func(old string, present bool) (string, bool, error)) error {
+	return s.update(context.Background(), key, update, s.limits.queueTimeout)
+}
+
+// Rate limits apply per principal when authenticated, per address otherwise
+func clientName(p *principal, addr string) string {
+	if p != nil && p.name != anonymousName {
+		return "principal " + p.name
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
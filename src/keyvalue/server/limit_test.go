@@ -0,0 +1,205 @@
+package server
+
+import (
+	"keyvalue/protobuf"
+
+	"code.google.com/p/goprotobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimits(t *testing.T) {
+	l := newLimits(Config{RateLimit: 1, RateBurst: 2})
+	for i := 0; i < 2; i++ {
+		if busy := l.admit("client"); busy != nil {
+			t.Fatalf("Request %d within burst Expecting: admitted, Received: %v", i, busy)
+		}
+		l.release()
+	}
+	if busy := l.admit("client"); busy.GetCode() != protobuf.Status_BUSY {
+		t.Fatalf("Request past burst Expecting: busy, Received: %v", busy)
+	}
+	if busy := l.admit("other"); busy != nil {
+		t.Fatalf("Another client Expecting: admitted, Received: %v", busy)
+	}
+	l.release()
+
+	l = newLimits(Config{MaxInFlight: 1})
+	if busy := l.admit("client"); busy != nil {
+		t.Fatalf("First request Expecting: admitted, Received: %v", busy)
+	}
+	if busy := l.admit("other"); busy.GetCode() != protobuf.Status_BUSY {
+		t.Fatalf("Request past MaxInFlight Expecting: busy, Received: %v", busy)
+	}
+	l.release()
+	if busy := l.admit("other"); busy != nil {
+		t.Fatalf("Request after release Expecting: admitted, Received: %v", busy)
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	status, server := InitConfig(Config{Port: 12388, MaxConnections: 1, RateLimit: 1, RateBurst: 2})
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+
+	call := func(conn net.Conn, reader *bufio.Reader, request *protobuf.Request) protobuf.Status_Code {
+		if err := protobuf.WriteFrame(conn, request); err != nil {
+			t.Fatal(err)
+		}
+		response := new(protobuf.Response)
+		if err := protobuf.ReadFrame(reader, protobuf.DefaultMaxFrameSize, response); err != nil {
+			t.Fatal(err)
+		}
+		return response.GetStatus().GetCode()
+	}
+	hello := &protobuf.Request{Id: proto.String("hello"), Op: protobuf.Request_HELLO.Enum(), Key: []byte{}, Hello: protobuf.NewHello(nil, protobuf.DefaultMaxFrameSize)}
+	get := &protobuf.Request{Id: proto.String("1"), Op: protobuf.Request_GET.Enum(), Key: []byte("limited")}
+
+	conn, err := net.Dial("tcp", "localhost:12388")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if code := call(conn, reader, hello); code != protobuf.Status_OK {
+		t.Fatalf("Hello Expecting: OK, Received: %v", code)
+	}
+
+	// Hellos and pings don't count towards the rate limit
+	for i := 0; i < 2; i++ {
+		if code := call(conn, reader, get); code != protobuf.Status_NOT_FOUND {
+			t.Fatalf("Get %d within burst Expecting: NOT_FOUND, Received: %v", i, code)
+		}
+	}
+	if code := call(conn, reader, get); code != protobuf.Status_BUSY {
+		t.Fatalf("Get past rate limit Expecting: BUSY, Received: %v", code)
+	}
+
+	other, err := net.Dial("tcp", "localhost:12388")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if code := call(other, bufio.NewReader(other), hello); code != protobuf.Status_BUSY {
+		t.Fatalf("Connection past MaxConnections Expecting: BUSY, Received: %v", code)
+	}
+}
+
+func TestServerQueueTimeout(t *testing.T) {
+	result, server := InitConfig(Config{Port: 12395, HTTPPort: 12396, GRPCPort: 12397, RedisPort: 12398, QueueTimeout: 50 * time.Millisecond})
+	if result != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+
+	// Holds set up on an update so the queue stays full until release is closed
+	release, started := make(chan struct{}), make(chan struct{})
+	go server.Update("queue:blocked", func(old string, present bool) (string, bool, error) {
+		close(started)
+		<-release
+		return "", false, nil
+	})
+	<-started
+	defer close(release)
+	for i := uint(0); i < MaxSetsPerSec; i++ {
+		server.Set("queue:filler", "value")
+	}
+
+	if code, _ := httpDo(t, "PUT", "http://localhost:12396/keys/queue%2Fhttp", "value"); code != http.StatusServiceUnavailable {
+		t.Fatalf("HTTP PUT on a full queue Expecting: 503, Received: %d", code)
+	}
+
+	conn, err := grpc.Dial("localhost:12397", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = protobuf.NewKeyValueClient(conn).Set(context.Background(), &protobuf.SetRequest{Key: []byte("queue/grpc"), Value: []byte("value")})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("gRPC Set on a full queue Expecting: %v, Received: %v", codes.ResourceExhausted, err)
+	}
+
+	redis, err := net.Dial("tcp", "localhost:12398")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer redis.Close()
+	if _, err := redis.Write([]byte("SET queue/redis value\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(redis).ReadString('\n'); err != nil || line != "-BUSY "+errQueueFull.Error()+"\r\n" {
+		t.Fatalf("Redis SET on a full queue Expecting: -BUSY, Received: %q %v", line, err)
+	}
+}
+
+func TestServerQueueTimeoutQueued(t *testing.T) {
+	result, server := InitConfig(Config{Port: 12405, QueueTimeout: 20 * time.Millisecond})
+	if result != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+
+	// Queued in time, so failing after the timeout is up is not busy
+	err := server.limitedUpdate("queue:slow", func(old string, present bool) (string, bool, error) {
+		time.Sleep(100 * time.Millisecond)
+		return "", false, errMissing
+	})
+	if err != errMissing {
+		t.Fatalf("Update failing after QueueTimeout Expecting: %v, Received: %v", errMissing, err)
+	}
+	if busy := atomic.LoadUint64(&server.limits.busy); busy != 0 {
+		t.Fatalf("Busy Expecting: 0, Received: %d", busy)
+	}
+}
+
+func TestServerGRPCLimits(t *testing.T) {
+	file := writeACL(t, testACL)
+	defer os.RemoveAll(path.Dir(file))
+	result, server := InitConfig(Config{Port: 12406, GRPCPort: 12407, ACLFile: file, RateLimit: 1, RateBurst: 1})
+	if result != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+
+	conn, err := grpc.Dial("localhost:12407", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := protobuf.NewKeyValueClient(conn)
+	get := &protobuf.GetRequest{Key: []byte("public/limited")}
+
+	if _, err := client.Get(context.Background(), get); err != nil {
+		t.Fatalf("Anonymous get within burst Expecting: no error, Received: %v", err)
+	}
+	if _, err := client.Get(context.Background(), get); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Anonymous get past rate limit Expecting: %v, Received: %v", codes.ResourceExhausted, err)
+	}
+
+	// Limited per principal, not per address, once authenticated
+	backup := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer s3cret")
+	if _, err := client.Get(backup, get); err != nil {
+		t.Fatalf("Get as another principal Expecting: no error, Received: %v", err)
+	}
+	if _, err := client.Get(backup, get); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Get as another principal past rate limit Expecting: %v, Received: %v", codes.ResourceExhausted, err)
+	}
+	wrong := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer wrong")
+	if _, err := client.Get(wrong, get); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Get with a bad token Expecting: %v, Received: %v", codes.Unauthenticated, err)
+	}
+}
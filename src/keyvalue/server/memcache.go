@@ -0,0 +1,370 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Listener speaking the memcached text protocol for legacy memcached clients.
+// Cas tokens are the key versions from version.go. The client flags memcached
+// stores with each item are kept in memory next to the store and are lost on restart.
+
+const (
+	maxMemcacheKey = 250
+	// Expiry times larger than this are unix timestamps rather than relative seconds
+	memcacheRelativeExpiry = 60 * 60 * 24 * 30
+)
+
+var (
+	errExists      = errors.New("cas token doesn't match")
+	errNotNumeric  = errors.New("cannot increment or decrement non-numeric value")
+	errBadDataLine = errors.New("bad data chunk")
+)
+
+type memcache struct {
+	server    *Server
+	listener  net.Listener
+	flags     map[string]uint32 // Only keys with non zero flags
+	flagsLock sync.Mutex
+}
+
+func (s *Server) serveMemcache(port uint16) error {
+	listener, err := s.listen(port)
+	if err != nil {
+		return err
+	}
+	s.memcache = &memcache{
+		server:   s,
+		listener: listener,
+		flags:    make(map[string]uint32),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// Closed by Server.Shutdown
+				return
+			}
+			go s.memcache.serve(conn)
+		}
+	}()
+	log.Printf("Server accepting memcached requests on port %d\n", port)
+	return nil
+}
+
+func (m *memcache) serve(conn net.Conn) {
+	defer conn.Close()
+	if err := m.server.accept(conn, "memcache"); err != nil {
+		if err == errBusy {
+			fmt.Fprint(conn, "SERVER_ERROR too many connections\r\n")
+		}
+		return
+	}
+	defer m.server.release(conn)
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading memcached command: %v\n", err)
+			}
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			writer.WriteString("ERROR\r\n")
+			writer.Flush()
+			continue
+		}
+
+		started := time.Now()
+		if busy := m.server.limits.admit(clientName(nil, conn.RemoteAddr().String())); busy != nil {
+			// The data block of a storage command is still on its way and would be read as commands
+			fmt.Fprintf(writer, "SERVER_ERROR %s\r\n", busy.GetMessage())
+			writer.Flush()
+			return
+		}
+		open, err := m.command(reader, writer, args)
+		m.server.limits.release()
+		m.server.metrics.request("memcache", opLabel(args[0], memcacheCommands[args[0]]), time.Since(started))
+		if err != nil {
+			// Malformed data blocks leave the stream unusable
+			fmt.Fprintf(writer, "CLIENT_ERROR %v\r\n", err)
+			writer.Flush()
+			return
+		}
+		if !open {
+			writer.Flush()
+			return
+		}
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				log.Printf("Error writing data: %v\n", err)
+				return
+			}
+		}
+	}
+}
+
+// Relative seconds, a unix timestamp or zero for no expiry, negative times are already over
+func memcacheTTL(exptime int64) (time.Duration, bool) {
+	switch {
+	case exptime == 0:
+		return 0, false
+	case exptime < 0:
+		return -1, true
+	case exptime > memcacheRelativeExpiry:
+		return time.Unix(exptime, 0).Sub(time.Now()), true
+	}
+	return time.Duration(exptime) * time.Second, true
+}
+
+// Runs one command, writing its reply unless noreply was given. Returns false once
+// the connection should close and an error if the stream can't be parsed any further
+func (m *memcache) command(r *bufio.Reader, w *bufio.Writer, args []string) (bool, error) {
+	name := args[0]
+	args = args[1:]
+	noreply := len(args) > 0 && args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	reply := func(format string, a ...interface{}) {
+		if !noreply {
+			fmt.Fprintf(w, format+"\r\n", a...)
+		}
+	}
+	for _, key := range keyArgs(name, args) {
+		if len(key) > maxMemcacheKey {
+			reply("CLIENT_ERROR key longer than %d bytes", maxMemcacheKey)
+			return true, nil
+		}
+	}
+
+	switch name {
+	case "get", "gets":
+		if len(args) == 0 {
+			w.WriteString("ERROR\r\n")
+			break
+		}
+		for _, key := range args {
+			result, value := m.server.Get(key)
+			if result == -1 {
+				w.WriteString("SERVER_ERROR see the server log\r\n")
+				return true, nil
+			}
+			if result != 0 {
+				continue
+			}
+			if name == "gets" {
+				fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", key, m.getFlags(key), len(value), m.server.Version(key))
+			} else {
+				fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, m.getFlags(key), len(value))
+			}
+			w.WriteString(value)
+			w.WriteString("\r\n")
+		}
+		w.WriteString("END\r\n")
+	case "set", "add", "replace", "cas":
+		// <command> <key> <flags> <exptime> <bytes> [<cas unique>]
+		expected := 4
+		if name == "cas" {
+			expected = 5
+		}
+		if len(args) != expected {
+			w.WriteString("ERROR\r\n")
+			break
+		}
+		flags, err1 := strconv.ParseUint(args[1], 10, 32)
+		exptime, err2 := strconv.ParseInt(args[2], 10, 64)
+		length, err3 := strconv.Atoi(args[3])
+		var unique uint64
+		var err4 error
+		if name == "cas" {
+			unique, err4 = strconv.ParseUint(args[4], 10, 64)
+		}
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || length < 0 || length > MaxValueSize {
+			// The data block can't be skipped without a valid length
+			return false, errors.New("bad command line format")
+		}
+
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return false, err
+		}
+		if string(data[length:]) != "\r\n" {
+			return false, errBadDataLine
+		}
+		// Checked once the data block is read so it isn't taken for commands
+		key := args[0]
+		if len(key) > maxMemcacheKey {
+			reply("CLIENT_ERROR key longer than %d bytes", maxMemcacheKey)
+			break
+		}
+		value := string(data[:length])
+		ttl, expires := memcacheTTL(exptime)
+
+		err := m.server.limitedUpdate(key, func(old string, present bool) (string, bool, error) {
+			switch {
+			case name == "add" && present:
+				return "", false, errNotSet
+			case name == "replace" && !present:
+				return "", false, errNotSet
+			case name == "cas" && !present:
+				return "", false, errMissing
+			case name == "cas" && m.server.Version(key) != unique:
+				return "", false, errExists
+			}
+			if expires {
+				m.server.setExpiry(key, ttl)
+			} else {
+				m.server.clearExpiry(key)
+			}
+			m.setFlags(key, uint32(flags))
+			return value, false, nil
+		})
+		switch err {
+		case nil:
+			reply("STORED")
+		case errNotSet:
+			reply("NOT_STORED")
+		case errMissing:
+			reply("NOT_FOUND")
+		case errExists:
+			reply("EXISTS")
+		default:
+			reply("SERVER_ERROR %v", err)
+		}
+	case "delete":
+		if len(args) != 1 {
+			w.WriteString("ERROR\r\n")
+			break
+		}
+		existed, err := m.server.remove(args[0])
+		switch {
+		case err != nil:
+			reply("SERVER_ERROR %v", err)
+		case existed:
+			m.setFlags(args[0], 0)
+			reply("DELETED")
+		default:
+			reply("NOT_FOUND")
+		}
+	case "incr", "decr":
+		if len(args) != 2 {
+			w.WriteString("ERROR\r\n")
+			break
+		}
+		delta, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			reply("CLIENT_ERROR invalid numeric delta argument")
+			break
+		}
+		var n uint64
+		err = m.server.limitedUpdate(args[0], func(old string, present bool) (string, bool, error) {
+			if !present {
+				return "", false, errMissing
+			}
+			var err error
+			if n, err = strconv.ParseUint(old, 10, 64); err != nil {
+				return "", false, errNotNumeric
+			}
+			// Increments wrap around at 64 bits and decrements stop at zero, like memcached
+			if name == "incr" {
+				n += delta
+			} else if delta > n {
+				n = 0
+			} else {
+				n -= delta
+			}
+			return strconv.FormatUint(n, 10), false, nil
+		})
+		switch err {
+		case nil:
+			reply("%d", n)
+		case errMissing:
+			reply("NOT_FOUND")
+		case errNotNumeric:
+			reply("CLIENT_ERROR %v", err)
+		default:
+			reply("SERVER_ERROR %v", err)
+		}
+	case "touch":
+		if len(args) != 2 {
+			w.WriteString("ERROR\r\n")
+			break
+		}
+		exptime, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			reply("CLIENT_ERROR invalid exptime argument")
+			break
+		}
+		result, _ := m.server.Get(args[0])
+		if result != 0 {
+			if result == 1 {
+				reply("NOT_FOUND")
+			} else {
+				reply("SERVER_ERROR see the server log")
+			}
+			break
+		}
+		if ttl, expires := memcacheTTL(exptime); expires {
+			m.server.setExpiry(args[0], ttl)
+		} else {
+			m.server.clearExpiry(args[0])
+		}
+		reply("TOUCHED")
+	case "version":
+		w.WriteString("VERSION keyvalue\r\n")
+	case "quit":
+		return false, nil
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+	return true, nil
+}
+
+// Commands that command handles, anything else is labelled unknown in metrics
+var memcacheCommands = map[string]bool{
+	"get": true, "gets": true, "set": true, "add": true, "replace": true, "cas": true,
+	"delete": true, "incr": true, "decr": true, "touch": true, "version": true, "quit": true,
+}
+
+// The arguments of a command that are keys, to be checked against the key length limit
+func keyArgs(name string, args []string) []string {
+	switch name {
+	case "get", "gets":
+		return args
+	case "delete", "incr", "decr", "touch":
+		// Storage commands check their key after reading the data block
+		if len(args) > 0 {
+			return args[:1]
+		}
+	}
+	return nil
+}
+
+func (m *memcache) getFlags(key string) uint32 {
+	m.flagsLock.Lock()
+	defer m.flagsLock.Unlock()
+	return m.flags[key]
+}
+
+func (m *memcache) setFlags(key string, flags uint32) {
+	m.flagsLock.Lock()
+	if flags == 0 {
+		delete(m.flags, key)
+	} else {
+		m.flags[key] = flags
+	}
+	m.flagsLock.Unlock()
+}
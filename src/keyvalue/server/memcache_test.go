@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestServerMemcache(t *testing.T) {
+	status, server := InitConfig(Config{Port: 12356, MemcachePort: 12357})
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", "localhost:12357")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	send := func(command string, reply string) {
+		if _, err := conn.Write([]byte(command)); err != nil {
+			t.Fatal(err)
+		}
+		received := make([]byte, len(reply))
+		if _, err := io.ReadFull(reader, received); err != nil {
+			t.Fatalf("%q: %v", command, err)
+		}
+		if string(received) != reply {
+			t.Fatalf("%q Expecting: %q, Received: %q", command, reply, received)
+		}
+	}
+
+	send("set mc:a 5 0 5\r\nhello\r\n", "STORED\r\n")
+	send("get mc:a mc:missing\r\n", "VALUE mc:a 5 5\r\nhello\r\nEND\r\n")
+	send("add mc:a 0 0 1\r\nx\r\n", "NOT_STORED\r\n")
+	send("replace mc:missing 0 0 1\r\nx\r\n", "NOT_STORED\r\n")
+
+	// The cas token only matches until the key is written again
+	version := server.Version("mc:a")
+	send("gets mc:a\r\n", fmt.Sprintf("VALUE mc:a 5 5 %d\r\nhello\r\nEND\r\n", version))
+	send(fmt.Sprintf("cas mc:a 0 0 5 %d\r\nworld\r\n", version), "STORED\r\n")
+	send(fmt.Sprintf("cas mc:a 0 0 5 %d\r\nagain\r\n", version), "EXISTS\r\n")
+	send("cas mc:missing 0 0 1 1\r\nx\r\n", "NOT_FOUND\r\n")
+	send("get mc:a\r\n", "VALUE mc:a 0 5\r\nworld\r\nEND\r\n")
+
+	send("set mc:n 0 0 1 noreply\r\n9\r\n", "")
+	send("incr mc:n 3\r\n", "12\r\n")
+	send("decr mc:n 20\r\n", "0\r\n")
+	send("incr mc:a 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+	send("incr mc:missing 1\r\n", "NOT_FOUND\r\n")
+
+	send("touch mc:a 100\r\n", "TOUCHED\r\n")
+	send("touch mc:a -1\r\n", "TOUCHED\r\n")
+	send("get mc:a\r\n", "END\r\n")
+	send("delete mc:n\r\n", "DELETED\r\n")
+	send("delete mc:n\r\n", "NOT_FOUND\r\n")
+	send("bogus\r\n", "ERROR\r\n")
+
+	// The data block of a rejected set is skipped, not run as a command
+	long := strings.Repeat("k", maxMemcacheKey+1)
+	send("set mc:kept 0 0 1\r\nx\r\n", "STORED\r\n")
+	send("set "+long+" 0 0 14\r\ndelete mc:kept\r\n", fmt.Sprintf("CLIENT_ERROR key longer than %d bytes\r\n", maxMemcacheKey))
+	send("get mc:kept\r\n", "VALUE mc:kept 0 1\r\nx\r\nEND\r\n")
+	send("get "+long+"\r\n", fmt.Sprintf("CLIENT_ERROR key longer than %d bytes\r\n", maxMemcacheKey))
+}
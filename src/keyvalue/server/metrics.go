@@ -0,0 +1,228 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics in the Prometheus text format, served on /metrics of MetricsPort.
+// Requests are timed per protocol and operation, persistence files per kind,
+// and everything else is read from the server as it is scraped. The port has
+// no authentication of its own, only TLS when the server has it.
+
+// Upper bounds of the histogram buckets, +Inf is added when written
+var (
+	latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	sizeBuckets    = []float64{1 << 10, 1 << 14, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26, 1 << 28, 1 << 30}
+)
+
+type metrics struct {
+	lock         sync.Mutex
+	requests     map[string]*histogram // By protocol and operation labels, see request
+	persistTimes map[string]*histogram // By kind of file, delta or base
+	persistSizes map[string]*histogram
+	accepted     map[string]uint64 // Connections by protocol
+	refused      map[string]uint64
+	recovery     time.Duration
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // Per bucket, made cumulative when written
+	count   uint64
+	sum     float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:     make(map[string]*histogram),
+		persistTimes: make(map[string]*histogram),
+		persistSizes: make(map[string]*histogram),
+		accepted:     make(map[string]uint64),
+		refused:      make(map[string]uint64),
+	}
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// Under the metrics lock
+func (h *histogram) observe(value float64) {
+	h.count++
+	h.sum += value
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		h.counts[i]++
+	}
+}
+
+// Under lock, creating the histogram the first time
+func observe(histograms map[string]*histogram, labels string, buckets []float64, value float64) {
+	h, present := histograms[labels]
+	if !present {
+		h = newHistogram(buckets)
+		histograms[labels] = h
+	}
+	h.observe(value)
+}
+
+// Operations must come from a fixed set, anything a client sent is "unknown"
+func (m *metrics) request(protocol string, op string, elapsed time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	observe(m.requests, fmt.Sprintf(`protocol="%s",op="%s"`, protocol, op), latencyBuckets, elapsed.Seconds())
+}
+
+func (m *metrics) persisted(kind string, elapsed time.Duration, size int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	labels := fmt.Sprintf(`file="%s"`, kind)
+	observe(m.persistTimes, labels, latencyBuckets, elapsed.Seconds())
+	observe(m.persistSizes, labels, sizeBuckets, float64(size))
+}
+
+func (m *metrics) connection(protocol string, accepted bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if accepted {
+		m.accepted[protocol]++
+	} else {
+		m.refused[protocol]++
+	}
+}
+
+func (m *metrics) recovered(elapsed time.Duration) {
+	m.lock.Lock()
+	m.recovery = elapsed
+	m.lock.Unlock()
+}
+
+func (s *Server) serveMetrics(port uint16) error {
+	listener, err := s.listen(port)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+	})
+	s.metricsServer = &http.Server{Handler: mux}
+	go func() {
+		if err := s.metricsServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Error serving metrics: %v\n", err)
+		}
+	}()
+	log.Printf("Server serving metrics on port %d\n", port)
+	return nil
+}
+
+func (s *Server) writeMetrics(w io.Writer) {
+	m := s.metrics
+	m.lock.Lock()
+	writeHistograms(w, "keyvalue_request_duration_seconds", "Time taken to answer requests.", m.requests)
+	writeHeader(w, "keyvalue_requests_total", "counter", "Requests answered.")
+	for _, labels := range sortedKeys(m.requests) {
+		fmt.Fprintf(w, "keyvalue_requests_total{%s} %d\n", labels, m.requests[labels].count)
+	}
+	writeHistograms(w, "keyvalue_persist_duration_seconds", "Time taken to write persistence files.", m.persistTimes)
+	writeHistograms(w, "keyvalue_persist_bytes", "Size of the persistence files written.", m.persistSizes)
+	writeHeader(w, "keyvalue_connections_accepted_total", "counter", "Client connections accepted.")
+	for protocol, count := range m.accepted {
+		fmt.Fprintf(w, "keyvalue_connections_accepted_total{protocol=\"%s\"} %d\n", protocol, count)
+	}
+	writeHeader(w, "keyvalue_connections_refused_total", "counter", "Client connections refused past MaxConnections.")
+	for protocol, count := range m.refused {
+		fmt.Fprintf(w, "keyvalue_connections_refused_total{protocol=\"%s\"} %d\n", protocol, count)
+	}
+	writeHeader(w, "keyvalue_recovery_seconds", "gauge", "Time taken to recover the store at start.")
+	fmt.Fprintf(w, "keyvalue_recovery_seconds %g\n", m.recovery.Seconds())
+	m.lock.Unlock()
+
+	open := make(map[string]int)
+	s.connsLock.Lock()
+	for _, protocol := range s.conns {
+		open[protocol]++
+	}
+	s.connsLock.Unlock()
+	writeHeader(w, "keyvalue_connections", "gauge", "Client connections open, other than gRPC and HTTP.")
+	for protocol, count := range open {
+		fmt.Fprintf(w, "keyvalue_connections{protocol=\"%s\"} %d\n", protocol, count)
+	}
+
+	if s.engine == nil {
+		s.storeLock.RLock()
+		keys, memory := len(s.store)+s.evicted, s.memory
+		s.storeLock.RUnlock()
+		writeGauge(w, "keyvalue_keys", "Keys in the store.", float64(keys))
+		writeGauge(w, "keyvalue_memory_bytes", "Bytes of keys and values held in memory.", float64(memory))
+		if s.budget > 0 {
+			writeGauge(w, "keyvalue_memory_budget_bytes", "Memory budget of the map engine.", float64(s.budget))
+		}
+	}
+	hits, misses, evictions := s.CacheStats()
+	writeCounter(w, "keyvalue_cache_hits_total", "Gets answered from memory with a memory budget.", float64(hits))
+	writeCounter(w, "keyvalue_cache_misses_total", "Gets read back from the persistence files.", float64(misses))
+	writeCounter(w, "keyvalue_cache_evictions_total", "Values evicted from memory.", float64(evictions))
+
+	writeGauge(w, "keyvalue_pending_sets", "Sets queued and not yet applied.", float64(len(s.pending)))
+	writeGauge(w, "keyvalue_pending_persist_sets", "Sets applied and not yet written to a delta.", float64(len(s.pendingPersist)))
+	writeCounter(w, "keyvalue_writes_queued_total", "Writes queued since start.", float64(s.Queued()))
+	writeCounter(w, "keyvalue_writes_applied_total", "Writes applied since start.", float64(s.Applied()))
+	writeGauge(w, "keyvalue_tracked_keys", "Keys clients were told they may cache.", float64(s.tracking.count()))
+	writeCounter(w, "keyvalue_busy_total", "Requests answered busy by admission control.", float64(atomic.LoadUint64(&s.limits.busy)))
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeGauge(w io.Writer, name string, help string, value float64) {
+	writeHeader(w, name, "gauge", help)
+	fmt.Fprintf(w, "%s %g\n", name, value)
+}
+
+func writeCounter(w io.Writer, name string, help string, value float64) {
+	writeHeader(w, name, "counter", help)
+	fmt.Fprintf(w, "%s %g\n", name, value)
+}
+
+func writeHistograms(w io.Writer, name string, help string, histograms map[string]*histogram) {
+	writeHeader(w, name, "histogram", help)
+	for _, labels := range sortedKeys(histograms) {
+		h := histograms[labels]
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+}
+
+func sortedKeys(histograms map[string]*histogram) []string {
+	keys := make([]string, 0, len(histograms))
+	for key := range histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Lower case name of a known operation for labels
+func opLabel(name string, known bool) string {
+	if !known {
+		return "unknown"
+	}
+	return strings.ToLower(name)
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"keyvalue/protobuf"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 10})
+	for _, value := range []float64{0.5, 1, 5, 50} {
+		h.observe(value)
+	}
+	var out bytes.Buffer
+	writeHistograms(&out, "test", "Test.", map[string]*histogram{`op="get"`: h})
+	for _, line := range []string{
+		`test_bucket{op="get",le="1"} 2`,
+		`test_bucket{op="get",le="10"} 3`,
+		`test_bucket{op="get",le="+Inf"} 4`,
+		`test_sum{op="get"} 56.5`,
+		`test_count{op="get"} 4`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Fatalf("Expecting: %s, Received:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	status, server := InitConfig(Config{Port: 12390, MetricsPort: 12391})
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", "localhost:12390")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for _, request := range []*protobuf.Request{
+		{Id: proto.String("1"), Op: protobuf.Request_SET.Enum(), Key: []byte("metrics"), Value: []byte("value")},
+		{Id: proto.String("2"), Op: protobuf.Request_GET.Enum(), Key: []byte("metrics")},
+	} {
+		if err := protobuf.WriteFrame(conn, request); err != nil {
+			t.Fatal(err)
+		}
+		if err := protobuf.ReadFrame(reader, protobuf.DefaultMaxFrameSize, new(protobuf.Response)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Applied in the background
+	for deadline := time.Now().Add(time.Second); server.Applied() < 1 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	response, err := http.Get("http://localhost:12391/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`keyvalue_requests_total{protocol="binary",op="get"} 1`,
+		`keyvalue_requests_total{protocol="binary",op="set"} 1`,
+		`keyvalue_request_duration_seconds_count{protocol="binary",op="get"} 1`,
+		`keyvalue_connections{protocol="binary"} 1`,
+		`keyvalue_writes_applied_total 1`,
+		`# TYPE keyvalue_keys gauge`,
+		`# TYPE keyvalue_recovery_seconds gauge`,
+		fmt.Sprintf("keyvalue_memory_bytes %d", storeBytes(server)),
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Fatalf("Expecting: %s, Received:\n%s", line, body)
+		}
+	}
+}
+
+// Bytes of keys and values in store counted the long way
+func storeBytes(s *Server) int64 {
+	s.storeLock.RLock()
+	defer s.storeLock.RUnlock()
+	var bytes int64
+	for key, value := range s.store {
+		bytes += int64(len(key) + len(value))
+	}
+	return bytes
+}
+
+// Keys in store or only in index counted the long way
+func storeKeys(s *Server) int {
+	s.storeLock.RLock()
+	defer s.storeLock.RUnlock()
+	keys := len(s.store)
+	for key := range s.index {
+		if _, cached := s.store[key]; !cached {
+			keys++
+		}
+	}
+	return keys
+}
@@ -0,0 +1,613 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Listener speaking the Redis RESP protocol so redis-cli and Redis client
+// libraries can be pointed at the store. Only the commands below are supported,
+// multi-key commands like MSET apply each key in turn rather than atomically.
+// With an ACL clients log in with AUTH token or AUTH username password.
+
+const maxRedisArgs = 1 << 20
+
+// Fewest and most arguments of each command, -1 for no limit
+var redisArity = map[string][2]int{
+	"PING": {0, 1}, "QUIT": {0, 0}, "COMMAND": {0, -1},
+	"GET": {1, 1}, "SET": {2, -1}, "DEL": {1, -1}, "MGET": {1, -1}, "MSET": {2, -1},
+	"EXISTS": {1, -1}, "INCR": {1, 1}, "EXPIRE": {2, 2}, "KEYS": {1, 1}, "SCAN": {1, -1},
+	"AUTH": {1, 2},
+}
+
+var errNotInteger = errors.New("value is not an integer or out of range")
+
+type redisWriter struct {
+	*bufio.Writer
+}
+
+func (w redisWriter) simple(s string) {
+	fmt.Fprintf(w, "+%s\r\n", s)
+}
+
+func (w redisWriter) error(message string) {
+	w.errorCode("ERR", message)
+}
+
+func (w redisWriter) errorCode(code string, message string) {
+	fmt.Fprintf(w, "-%s %s\r\n", code, message)
+}
+
+func (w redisWriter) integer(n int64) {
+	fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+func (w redisWriter) bulk(value string) {
+	fmt.Fprintf(w, "$%d\r\n", len(value))
+	w.WriteString(value)
+	w.WriteString("\r\n")
+}
+
+func (w redisWriter) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w redisWriter) array(length int) {
+	fmt.Fprintf(w, "*%d\r\n", length)
+}
+
+// Error reply for a write that failed, BUSY when the write queue was full
+func (w redisWriter) updateError(err error) {
+	if err == errQueueFull {
+		w.errorCode("BUSY", err.Error())
+		return
+	}
+	w.error(err.Error())
+}
+
+// Maps a result code from Get, Set and Delete onto an error reply, returns false if there was none
+func (w redisWriter) failed(result int) bool {
+	if result == -1 {
+		w.error("server error, see the server log")
+		return true
+	}
+	return false
+}
+
+func (s *Server) serveRedis(port uint16) error {
+	listener, err := s.listen(port)
+	if err != nil {
+		return err
+	}
+	s.redisListener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// Closed by Server.Shutdown
+				return
+			}
+			go s.serveRedisConn(conn)
+		}
+	}()
+	log.Printf("Server accepting Redis requests on port %d\n", port)
+	return nil
+}
+
+func (s *Server) serveRedisConn(conn net.Conn) {
+	defer conn.Close()
+	defer func() {
+		// A bad command only costs its own connection
+		if r := recover(); r != nil {
+			log.Printf("Redis connection from %s failed: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+		}
+	}()
+	if err := s.accept(conn, "redis"); err != nil {
+		if err == errBusy {
+			fmt.Fprint(conn, "-ERR max number of clients reached\r\n")
+		}
+		return
+	}
+	defer s.release(conn)
+	reader := bufio.NewReader(conn)
+	writer := redisWriter{bufio.NewWriter(conn)}
+	p := s.anonymous()
+	for {
+		args, err := readRedisCommand(reader, int(s.maxFrameSize))
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading Redis command: %v\n", err)
+				writer.error(err.Error())
+				writer.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		started := time.Now()
+		open := true
+		if busy := s.limits.admit(clientName(p, conn.RemoteAddr().String())); busy != nil {
+			writer.errorCode("BUSY", busy.GetMessage())
+		} else {
+			open = s.redisCommand(writer, &p, args)
+			s.limits.release()
+		}
+		_, known := redisArity[strings.ToUpper(args[0])]
+		s.metrics.request("redis", opLabel(args[0], known), time.Since(started))
+		// Pipelined commands are answered together
+		if reader.Buffered() == 0 || !open {
+			if err := writer.Flush(); err != nil {
+				log.Printf("Error writing data: %v\n", err)
+				return
+			}
+		}
+		if !open {
+			return
+		}
+	}
+}
+
+// Reads either a RESP array of bulk strings or an inline command typed into telnet
+// Lines are at most limit bytes, values are sent in bulk strings up to MaxValueSize
+func readRedisCommand(r *bufio.Reader, limit int) ([]string, error) {
+	line, err := readRedisLine(r, limit)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 0 || count > maxRedisArgs {
+		return nil, fmt.Errorf("Protocol error: invalid multibulk length")
+	}
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		line, err := readRedisLine(r, limit)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("Protocol error: expected '$', got '%.1s'", line)
+		}
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 || length > MaxValueSize {
+			return nil, fmt.Errorf("Protocol error: invalid bulk length")
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args = append(args, string(data[:length]))
+	}
+	return args, nil
+}
+
+func readRedisLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > limit {
+			return "", fmt.Errorf("Protocol error: too big inline request")
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			return strings.TrimRight(string(line), "\r\n"), nil
+		}
+		if err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+}
+
+// Seconds or milliseconds given as n units, false if they overflow a duration
+func redisTTL(n int64, unit time.Duration) (time.Duration, bool) {
+	if n > math.MaxInt64/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// Runs one command and writes its reply, returns false once the connection should close.
+// AUTH changes the principal p of the connection.
+func (s *Server) redisCommand(w redisWriter, p **principal, args []string) bool {
+	name := strings.ToUpper(args[0])
+	arity, known := redisArity[name]
+	if !known {
+		w.error(fmt.Sprintf("unknown command '%.128s'", args[0]))
+		return true
+	}
+	args = args[1:]
+	if len(args) < arity[0] || (arity[1] >= 0 && len(args) > arity[1]) {
+		w.error(fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return true
+	}
+	if s.acl != nil {
+		keys, write := redisKeys(name, args)
+		for _, key := range keys {
+			// INCR hands back the value so needs read access too
+			if !(*p).can(key, write) || (name == "INCR" && !(*p).can(key, false)) {
+				w.errorCode("NOPERM", denied(*p, key, write))
+				return true
+			}
+		}
+	}
+
+	switch name {
+	case "AUTH":
+		if s.acl == nil {
+			w.error("AUTH called without any ACL configured")
+			break
+		}
+		// A single argument is a token, like the password of Redis before ACLs
+		var err error
+		var authenticated *principal
+		if len(args) == 1 {
+			authenticated, err = s.acl.authenticate("", "", args[0])
+		} else {
+			authenticated, err = s.acl.authenticate(args[0], args[1], "")
+		}
+		if err != nil {
+			w.errorCode("WRONGPASS", err.Error())
+			break
+		}
+		*p = authenticated
+		w.simple("OK")
+	case "PING":
+		if len(args) > 0 {
+			w.bulk(args[0])
+		} else {
+			w.simple("PONG")
+		}
+	case "QUIT":
+		w.simple("OK")
+		return false
+	case "COMMAND":
+		// redis-cli asks for command docs on startup, an empty reply is fine
+		w.array(0)
+	case "GET":
+		result, value := s.Get(args[0])
+		if w.failed(result) {
+			break
+		}
+		if result == 1 {
+			w.null()
+		} else {
+			w.bulk(value)
+		}
+	case "SET":
+		s.redisSet(w, args)
+	case "DEL":
+		var deleted int64
+		for _, key := range args {
+			existed, err := s.remove(key)
+			if err != nil {
+				w.updateError(err)
+				return true
+			}
+			if existed {
+				deleted++
+			}
+		}
+		w.integer(deleted)
+	case "MGET":
+		w.array(len(args))
+		for _, key := range args {
+			if result, value := s.Get(key); result == 0 {
+				w.bulk(value)
+			} else {
+				w.null()
+			}
+		}
+	case "MSET":
+		if len(args)%2 != 0 {
+			w.error("wrong number of arguments for 'mset' command")
+			break
+		}
+		for i := 0; i < len(args); i += 2 {
+			key, value := args[i], args[i+1]
+			err := s.limitedUpdate(key, func(string, bool) (string, bool, error) {
+				s.clearExpiry(key)
+				return value, false, nil
+			})
+			if err != nil {
+				w.updateError(err)
+				return true
+			}
+		}
+		w.simple("OK")
+	case "EXISTS":
+		var count int64
+		for _, key := range args {
+			result, _ := s.Get(key)
+			if w.failed(result) {
+				return true
+			}
+			if result == 0 {
+				count++
+			}
+		}
+		w.integer(count)
+	case "INCR":
+		var n int64
+		err := s.limitedUpdate(args[0], func(old string, present bool) (string, bool, error) {
+			n = 0
+			if present {
+				var err error
+				if n, err = strconv.ParseInt(old, 10, 64); err != nil {
+					return "", false, errNotInteger
+				}
+			}
+			if n == math.MaxInt64 {
+				return "", false, errors.New("increment or decrement would overflow")
+			}
+			n++
+			return strconv.FormatInt(n, 10), false, nil
+		})
+		if err != nil {
+			w.updateError(err)
+			break
+		}
+		w.integer(n)
+	case "EXPIRE":
+		seconds, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			w.error(errNotInteger.Error())
+			break
+		}
+		if seconds <= 0 {
+			// Redis deletes keys given a ttl that is already over
+			existed, err := s.remove(args[0])
+			if err != nil {
+				w.updateError(err)
+			} else if existed {
+				w.integer(1)
+			} else {
+				w.integer(0)
+			}
+			break
+		}
+		ttl, ok := redisTTL(seconds, time.Second)
+		if !ok {
+			w.error("invalid expire time in 'expire' command")
+			break
+		}
+		result := s.Expire(args[0], ttl)
+		if !w.failed(result) {
+			w.integer(int64(1 - result))
+		}
+	case "KEYS":
+		result, keys := s.Keys(globPrefix(args[0]))
+		if w.failed(result) {
+			break
+		}
+		keys = s.readable(*p, keys)
+		var matched []string
+		for _, key := range keys {
+			if globMatch(args[0], key) {
+				matched = append(matched, key)
+			}
+		}
+		w.array(len(matched))
+		for _, key := range matched {
+			w.bulk(key)
+		}
+	case "SCAN":
+		s.redisScan(w, *p, args)
+	}
+	return true
+}
+
+// SET key value [EX seconds | PX milliseconds] [NX | XX]
+func (s *Server) redisSet(w redisWriter, args []string) {
+	key, value := args[0], args[1]
+	var ttl time.Duration
+	var nx, xx bool
+	for i := 2; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); option {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				w.error("syntax error")
+				return
+			}
+			i++
+			unit := time.Second
+			if option == "PX" {
+				unit = time.Millisecond
+			}
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			var ok bool
+			if err == nil && n > 0 {
+				ttl, ok = redisTTL(n, unit)
+			}
+			if !ok {
+				w.error("invalid expire time in 'set' command")
+				return
+			}
+		default:
+			w.error("syntax error")
+			return
+		}
+	}
+	if nx && xx {
+		w.error("syntax error")
+		return
+	}
+
+	err := s.limitedUpdate(key, func(old string, present bool) (string, bool, error) {
+		if (nx && present) || (xx && !present) {
+			return "", false, errNotSet
+		}
+		// SET replaces any ttl the key had
+		if ttl > 0 {
+			s.setExpiry(key, ttl)
+		} else {
+			s.clearExpiry(key)
+		}
+		return value, false, nil
+	})
+	switch err {
+	case nil:
+		w.simple("OK")
+	case errNotSet:
+		w.null()
+	default:
+		w.updateError(err)
+	}
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count], the cursor is an offset into the sorted keys
+func (s *Server) redisScan(w redisWriter, p *principal, args []string) {
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		w.error("invalid cursor")
+		return
+	}
+	pattern, count := "*", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			w.error("syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				w.error(errNotInteger.Error())
+				return
+			}
+		default:
+			w.error("syntax error")
+			return
+		}
+	}
+
+	result, keys := s.Keys(globPrefix(pattern))
+	if w.failed(result) {
+		return
+	}
+	keys = s.readable(p, keys)
+	next := cursor + count
+	if next >= len(keys) {
+		next = 0
+	}
+	var matched []string
+	for i := cursor; i < len(keys) && i < cursor+count; i++ {
+		if globMatch(pattern, keys[i]) {
+			matched = append(matched, keys[i])
+		}
+	}
+
+	w.array(2)
+	w.bulk(strconv.Itoa(next))
+	w.array(len(matched))
+	for _, key := range matched {
+		w.bulk(key)
+	}
+}
+
+// The keys a command touches and whether it writes them, checked against the ACL
+func redisKeys(name string, args []string) ([]string, bool) {
+	switch name {
+	case "GET", "MGET", "EXISTS":
+		return args, false
+	case "SET", "INCR", "EXPIRE":
+		return args[:1], true
+	case "DEL":
+		return args, true
+	case "MSET":
+		var keys []string
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys, true
+	}
+	return nil, false
+}
+
+// Literal start of a glob pattern, used to narrow the keys that need matching
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// Redis style glob, * and ? match any bytes including '/' unlike path.Match
+func globMatch(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 || len(s) == 0 {
+				return false
+			}
+			class := pattern[1 : end+1]
+			negate := strings.HasPrefix(class, "^")
+			if negate {
+				class = class[1:]
+			}
+			matched := false
+			for i := 0; i < len(class); i++ {
+				if i+2 < len(class) && class[i+1] == '-' {
+					if class[i] <= s[0] && s[0] <= class[i+2] {
+						matched = true
+					}
+					i += 2
+				} else if class[i] == s[0] {
+					matched = true
+				}
+			}
+			if matched == negate {
+				return false
+			}
+			pattern = pattern[end+1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"*", "any/thing", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+	}
+	for _, c := range cases {
+		if globMatch(c.pattern, c.key) != c.match {
+			t.Errorf("globMatch(%s, %s) Expecting: %v", c.pattern, c.key, c.match)
+		}
+	}
+}
+
+func TestServerRedis(t *testing.T) {
+	status, server := InitConfig(Config{Port: 12353, RedisPort: 12354})
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", "localhost:12354")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Replies are compared in their raw RESP form
+	exchange := []struct {
+		command []string
+		reply   string
+	}{
+		{[]string{"PING"}, "+PONG\r\n"},
+		{[]string{"SET", "redis:a", "va\r\nlue"}, "+OK\r\n"},
+		{[]string{"GET", "redis:a"}, "$7\r\nva\r\nlue\r\n"},
+		{[]string{"SET", "redis:a", "other", "NX"}, "$-1\r\n"},
+		{[]string{"MSET", "redis:b", "1", "redis:c", "x"}, "+OK\r\n"},
+		{[]string{"MGET", "redis:b", "redis:missing"}, "*2\r\n$1\r\n1\r\n$-1\r\n"},
+		{[]string{"INCR", "redis:b"}, ":2\r\n"},
+		{[]string{"INCR", "redis:c"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"EXISTS", "redis:a", "redis:b", "redis:missing"}, ":2\r\n"},
+		{[]string{"KEYS", "redis:[ab]"}, "*2\r\n$7\r\nredis:a\r\n$7\r\nredis:b\r\n"},
+		{[]string{"SCAN", "0", "MATCH", "redis:*", "COUNT", "2"}, "*2\r\n$1\r\n2\r\n*2\r\n$7\r\nredis:a\r\n$7\r\nredis:b\r\n"},
+		{[]string{"DEL", "redis:a", "redis:missing"}, ":1\r\n"},
+		{[]string{"GET", "redis:a"}, "$-1\r\n"},
+		{[]string{"EXPIRE", "redis:b", "0"}, ":1\r\n"},
+		{[]string{"EXPIRE", "redis:c", "100"}, ":1\r\n"},
+		{[]string{"EXPIRE", "redis:missing", "100"}, ":0\r\n"},
+		{[]string{"EXPIRE", "redis:c", "9223372036854775807"}, "-ERR invalid expire time in 'expire' command\r\n"},
+		{[]string{"SET", "redis:c", "x", "EX", "9223372036854775807"}, "-ERR invalid expire time in 'set' command\r\n"},
+		{[]string{"SET", "redis:c", "x", "PX", "9223372036854775807"}, "-ERR invalid expire time in 'set' command\r\n"},
+		{[]string{"GET", "redis:b"}, "$-1\r\n"},
+		{[]string{"BOGUS"}, "-ERR unknown command 'BOGUS'\r\n"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command\r\n"},
+	}
+	for _, e := range exchange {
+		command := fmt.Sprintf("*%d\r\n", len(e.command))
+		for _, arg := range e.command {
+			command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+		}
+		if _, err := conn.Write([]byte(command)); err != nil {
+			t.Fatal(err)
+		}
+
+		reply := make([]byte, len(e.reply))
+		if _, err := io.ReadFull(reader, reply); err != nil {
+			t.Fatalf("%s: %v", strings.Join(e.command, " "), err)
+		}
+		if string(reply) != e.reply {
+			t.Fatalf("%s Expecting: %q, Received: %q", strings.Join(e.command, " "), e.reply, reply)
+		}
+	}
+
+	// Inline commands as typed into telnet
+	conn.Write([]byte("PING hello\r\n"))
+	if line, _ := reader.ReadString('\n'); line != "$5\r\n" {
+		t.Fatalf("Inline PING Expecting: $5, Received: %q", line)
+	}
+	reader.ReadString('\n')
+
+	// Malformed commands close their own connection and nothing else
+	for _, command := range []string{"*-5\r\n", strings.Repeat("x", int(server.maxFrameSize)+1) + "\r\n"} {
+		bad, err := net.Dial("tcp", "localhost:12354")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bad.Write([]byte(command))
+		line, _ := bufio.NewReader(bad).ReadString('\n')
+		bad.Close()
+		if !strings.HasPrefix(line, "-ERR Protocol error") {
+			t.Fatalf("%.10q Expecting: protocol error, Received: %q", command, line)
+		}
+	}
+	conn.Write([]byte("PING\r\n"))
+	if line, _ := reader.ReadString('\n'); line != "+PONG\r\n" {
+		t.Fatalf("PING after bad commands Expecting: +PONG, Received: %q", line)
+	}
+}
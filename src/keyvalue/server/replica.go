@@ -0,0 +1,453 @@
+package server
+
+import (
+	"keyvalue/protobuf"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A server given a leader is a replica of it. Every SyncInterval the replica asks
+// the leader for the writes after the last one it holds with SYNC requests, applies
+// them and calls Synced with the time it asked. The leader keeps a backlog of its
+// recent writes from the first SYNC on. A replica that is new, or so far behind the
+// writes it needs have left the backlog, first copies every key a page at a time
+// and then catches up on what was written while it copied.
+// Replicas send sets on to the leader with a REDIRECT status and only answer gets
+// that accept data as stale as theirs, the leader's address goes out in the hello
+// so clients can find it straight away. A leader with an ACL only answers SYNC for
+// a principal that can read every key, the replica authenticates with LeaderToken.
+
+const (
+	syncTimeout    = 10 * time.Second // Longest one exchange may take before the connection is dropped
+	syncBatchBytes = 1 << 20          // Keys and values sent in one SYNC answer, past the first write or key
+)
+
+// Bytes of keys and values the backlog holds before dropping the oldest writes
+var syncBacklogBytes = 64 << 20
+
+// Sent as the value of a SYNC request, what the replica holds
+type syncRequest struct {
+	Run      string // Of the leader the replica holds writes from, empty before it has any
+	Sequence uint64 // Last write of that run the replica holds, or the one its copy started at
+	Copying  bool   // Still copying keys, from Next on
+	Next     []byte
+}
+
+// Sent as the value of the answer
+type syncAnswer struct {
+	Run      string
+	Sequence uint64         // Of the last write in Changes, the replica starts copying from here with Copy
+	Changes  []persistedSet // Writes after the asked sequence in order, or the next page of keys when copying
+	Copy     bool           // Start copying, what the replica holds can't be caught up
+	Next     []byte         // Key the page after this one starts at
+	Done     bool           // This was the last page
+}
+
+// Writes applied since the first SYNC, oldest first
+type backlog struct {
+	lock    sync.Mutex
+	started bool
+	changes []*set
+	bytes   int
+	since   uint64 // Every write after this one is held
+	last    uint64 // Last write set applied
+}
+
+// Called by set with every write it applies
+func (b *backlog) record(applied *set) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.last = applied.sequence
+	if !b.started {
+		b.since = applied.sequence
+		return
+	}
+	// Only what a replica needs, the queued set holds on to its caller
+	b.changes = append(b.changes, &set{Key: applied.Key, Value: applied.Value, Deleted: applied.Deleted, sequence: applied.sequence})
+	b.bytes += len(applied.Key) + len(applied.Value)
+	for b.bytes > syncBacklogBytes {
+		oldest := b.changes[0]
+		b.changes[0] = nil
+		b.changes = b.changes[1:]
+		b.bytes -= len(oldest.Key) + len(oldest.Value)
+		b.since = oldest.sequence
+	}
+}
+
+// Starts recording if it wasn't already, returns the writes the backlog covers
+func (b *backlog) start() (uint64, uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.started = true
+	return b.since, b.last
+}
+
+// Writes after sequence up to about syncBatchBytes, and the sequence the replica
+// holds once it has them
+func (b *backlog) after(sequence uint64) ([]persistedSet, uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	i := sort.Search(len(b.changes), func(i int) bool { return b.changes[i].sequence > sequence })
+	var sets []persistedSet
+	bytes := 0
+	for ; i < len(b.changes) && (len(sets) == 0 || bytes < syncBatchBytes); i++ {
+		change := b.changes[i]
+		sets = append(sets, persistedSet{Key: []byte(change.Key), Value: []byte(change.Value), Deleted: change.Deleted})
+		bytes += len(change.Key) + len(change.Value)
+		sequence = change.sequence
+	}
+	if i == len(b.changes) {
+		// Writes set gave up on are never recorded, they have nothing to hold
+		sequence = b.last
+	}
+	return sets, sequence
+}
+
+// Tells a replica it holds everything its leader had at the given time
+func (s *Server) Synced(at time.Time) {
+	s.syncedLock.Lock()
+	defer s.syncedLock.Unlock()
+	if at.After(s.synced) {
+		s.synced = at
+	}
+}
+
+// Response sending the request to the leader, nil if it can be answered here
+func (s *Server) redirect(request *protobuf.Request, write bool) *protobuf.Response {
+	if s.leader == "" {
+		return nil
+	}
+
+	s.syncedLock.Lock()
+	synced := s.synced
+	s.syncedLock.Unlock()
+	bound := time.Duration(request.GetMaxStaleness()) * time.Millisecond
+	var message string
+	switch {
+	case write:
+		message = "replicas don't take writes"
+	case bound == 0:
+		message = "replicas only answer gets that accept stale data"
+	case synced.IsZero():
+		message = "replica has not synced with its leader yet"
+	case time.Since(synced) > bound:
+		message = fmt.Sprintf("replica is %v behind its leader, more than the %v allowed", time.Since(synced).Round(time.Millisecond), bound)
+	default:
+		return nil
+	}
+	response := newResponse(request, protobuf.NewStatus(protobuf.Status_REDIRECT, message))
+	response.Leader = proto.String(s.leader)
+	return response
+}
+
+// Answers SYNC with the writes the replica is missing, or the next page of keys
+// while it copies them
+func (s *Server) answerSync(request *protobuf.Request) *protobuf.Response {
+	if len(request.GetKey()) != 0 {
+		// The key is what was authorized, only the empty one covers everything
+		return newResponse(request, protobuf.NewStatus(protobuf.Status_INVALID, "sync takes an empty key"))
+	}
+	var asked syncRequest
+	if err := json.Unmarshal(request.GetValue(), &asked); err != nil {
+		return newResponse(request, protobuf.NewStatus(protobuf.Status_INVALID, fmt.Sprintf("sync takes a JSON request: %v", err)))
+	}
+
+	answer := syncAnswer{Run: s.runId}
+	since, last := s.backlog.start()
+	switch {
+	case asked.Run != s.runId || asked.Sequence < since || asked.Sequence > last:
+		// The writes made while the replica copies are replayed after
+		answer.Copy, answer.Sequence = true, last
+	case asked.Copying:
+		answer.Sequence = asked.Sequence
+		bytes := 0
+		answer.Done = true
+		err := s.scanFrom(string(asked.Next), true, func(key string, value string) bool {
+			if len(answer.Changes) > 0 && bytes >= syncBatchBytes {
+				answer.Next, answer.Done = []byte(key), false
+				return false
+			}
+			answer.Changes = append(answer.Changes, persistedSet{Key: []byte(key), Value: []byte(value)})
+			bytes += len(key) + len(value)
+			return true
+		})
+		if err != nil {
+			log.Printf("Could not read keys to sync: %v\n", err)
+			return newResponse(request, protobuf.ResultStatus(-1))
+		}
+	default:
+		answer.Changes, answer.Sequence = s.backlog.after(asked.Sequence)
+	}
+
+	data, err := json.Marshal(answer)
+	if err != nil {
+		log.Printf("Could not marshal sync answer: %v\n", err)
+		return newResponse(request, protobuf.ResultStatus(-1))
+	}
+	response := newResponse(request, protobuf.NewStatus(protobuf.Status_OK, ""))
+	response.Value = data
+	return response
+}
+
+// Calls found with every live key from start on in order, with its value if values
+// is set, until found returns false
+func (s *Server) scanFrom(start string, values bool, found func(key string, value string) bool) error {
+	if s.engine != nil {
+		return s.engine.ScanFrom(start, func(key string, value string) bool {
+			if s.expired(key) {
+				return true
+			}
+			return found(key, value)
+		})
+	}
+
+	var keys []string
+	s.storeLock.RLock()
+	for key := range s.store {
+		if key >= start {
+			keys = append(keys, key)
+		}
+	}
+	// Evicted keys are only in the index
+	for key := range s.index {
+		if _, cached := s.store[key]; !cached && key >= start {
+			keys = append(keys, key)
+		}
+	}
+	s.storeLock.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var value string
+		if values {
+			var result int
+			if result, value = s.Get(key); result == -1 {
+				return fmt.Errorf("could not read key %s", key)
+			} else if result == 1 {
+				// Deleted since
+				continue
+			}
+		} else if s.expired(key) {
+			continue
+		}
+		if !found(key, value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Where a replica is with its leader, kept across syncs
+type syncState struct {
+	run      string
+	sequence uint64
+	copying  bool
+	next     []byte
+}
+
+// Runs on replicas until shutdown, a failed sync is logged and tried again on
+// a new connection at the next tick
+func (s *Server) syncWithLeader(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	var conn net.Conn
+	var reader *bufio.Reader
+	var state syncState
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		started := time.Now()
+		var err error
+		if conn == nil {
+			conn, reader, err = s.dialLeader()
+		}
+		if err == nil {
+			err = s.syncOnce(conn, reader, &state)
+		}
+		if err == nil {
+			s.Synced(started)
+		} else {
+			log.Printf("Could not sync with leader %s: %v\n", s.leader, err)
+			if conn != nil {
+				conn.Close()
+				conn = nil
+			}
+		}
+		if !waitTick(ticker, s.stop) {
+			return
+		}
+	}
+}
+
+// Connects and says hello, over TLS when the replica serves TLS itself
+func (s *Server) dialLeader() (net.Conn, *bufio.Reader, error) {
+	dialer := &net.Dialer{Timeout: syncTimeout}
+	var conn net.Conn
+	var err error
+	if s.tls != nil {
+		// Our own certificate for leaders requiring one, and our client CA to verify them
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.leader, &tls.Config{Certificates: s.tls.Certificates, RootCAs: s.tls.ClientCAs})
+	} else {
+		conn, err = dialer.Dial("tcp", s.leader)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hello := protobuf.NewHello(nil, s.maxFrameSize)
+	if s.leaderToken != "" {
+		hello.Credentials = &protobuf.Credentials{Token: proto.String(s.leaderToken)}
+	}
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(syncTimeout))
+	response, err := s.exchangeLeader(conn, reader, &protobuf.Request{Id: proto.String("hello"), Op: protobuf.Request_HELLO.Enum(), Key: []byte{}, Hello: hello})
+	if err == nil && response.GetStatus().GetCode() != protobuf.Status_OK {
+		err = errors.New(response.GetStatus().GetMessage())
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, reader, nil
+}
+
+// Sends request and reads the response, joining the chunks of a large value. An
+// answer holds at most one write or key past syncBatchBytes, and JSON takes a
+// third more for the bytes
+func (s *Server) exchangeLeader(conn net.Conn, reader *bufio.Reader, request *protobuf.Request) (*protobuf.Response, error) {
+	if err := protobuf.WriteFrame(conn, request); err != nil {
+		return nil, err
+	}
+	limit := 2 * (syncBatchBytes + MaxValueSize)
+	var value []byte
+	for {
+		response := new(protobuf.Response)
+		if err := protobuf.ReadFrame(reader, s.maxFrameSize, response); err != nil {
+			return nil, err
+		}
+		if len(value)+len(response.GetValue()) > limit {
+			return nil, fmt.Errorf("answer larger than %d bytes", limit)
+		}
+		value = append(value, response.GetValue()...)
+		if !response.GetMore() {
+			response.Value = value
+			return response, nil
+		}
+	}
+}
+
+// Asks the leader for what we're missing until we hold everything it had when it
+// answered, returning once all of it is applied
+func (s *Server) syncOnce(conn net.Conn, reader *bufio.Reader, state *syncState) error {
+	ctx := context.Background()
+	var last uint64
+	for {
+		value, err := json.Marshal(syncRequest{Run: state.run, Sequence: state.sequence, Copying: state.copying, Next: state.next})
+		if err != nil {
+			return err
+		}
+		conn.SetDeadline(time.Now().Add(syncTimeout))
+		response, err := s.exchangeLeader(conn, reader, &protobuf.Request{Id: proto.String("sync"), Op: protobuf.Request_SYNC.Enum(), Key: []byte{}, Value: value})
+		if err != nil {
+			return err
+		}
+		if response.GetStatus().GetCode() != protobuf.Status_OK {
+			return fmt.Errorf("leader answered %v: %s", response.GetStatus().GetCode(), response.GetStatus().GetMessage())
+		}
+		var answer syncAnswer
+		if err := json.Unmarshal(response.GetValue(), &answer); err != nil {
+			return err
+		}
+
+		switch {
+		case answer.Copy:
+			log.Printf("Copying every key from leader %s\n", s.leader)
+			*state = syncState{run: answer.Run, sequence: answer.Sequence, copying: true}
+		case state.copying:
+			sequence, err := s.copyPage(state.next, answer)
+			if err != nil {
+				return err
+			}
+			if sequence != 0 {
+				last = sequence
+			}
+			state.next = answer.Next
+			state.copying = !answer.Done
+		default:
+			for _, change := range answer.Changes {
+				var result int
+				var sequence uint64
+				if change.Deleted {
+					result, _, sequence = s.deleteSequenced(ctx, string(change.Key))
+				} else {
+					result, _, sequence = s.SetSequenced(ctx, string(change.Key), string(change.Value))
+				}
+				if result == -1 {
+					return errShutdown
+				}
+				last = sequence
+			}
+			state.sequence = answer.Sequence
+			if len(answer.Changes) == 0 {
+				s.waitApplied(ctx, last)
+				return nil
+			}
+		}
+	}
+}
+
+// Queues the sets of a page of keys starting at start, and deletes of our keys in
+// the same range that the leader doesn't have. Returns the sequence of the last write
+func (s *Server) copyPage(start []byte, answer syncAnswer) (uint64, error) {
+	ctx := context.Background()
+	var last uint64
+	leader := make(map[string]bool, len(answer.Changes))
+	for _, set := range answer.Changes {
+		key, value := string(set.Key), string(set.Value)
+		leader[key] = true
+		if result, old := s.Get(key); result == 0 && old == value {
+			continue
+		}
+		result, _, sequence := s.SetSequenced(ctx, key, value)
+		if result == -1 {
+			return 0, errShutdown
+		}
+		last = sequence
+	}
+
+	var stale []string
+	err := s.scanFrom(string(start), false, func(key string, value string) bool {
+		if !answer.Done && key >= string(answer.Next) {
+			return false
+		}
+		if !leader[key] {
+			stale = append(stale, key)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range stale {
+		result, _, sequence := s.deleteSequenced(ctx, key)
+		if result == -1 {
+			return 0, errShutdown
+		}
+		last = sequence
+	}
+	return last, nil
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"keyvalue/protobuf"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplica(t *testing.T) {
+	if status, _ := InitConfig(Config{Port: 12379, HTTPPort: 12380, Leader: "localhost:12345"}); status != -1 {
+		t.Fatal("Replica with the REST gateway Expecting: -1 status")
+	}
+	status, server := InitConfig(Config{Port: 12379, Leader: "localhost:12345"})
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", "localhost:12379")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	exchange := func(request *protobuf.Request) *protobuf.Response {
+		if err := protobuf.WriteFrame(conn, request); err != nil {
+			t.Fatal(err)
+		}
+		response := new(protobuf.Response)
+		if err := protobuf.ReadFrame(reader, protobuf.DefaultMaxFrameSize, response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	hello := exchange(&protobuf.Request{Id: proto.String("hello"), Op: protobuf.Request_HELLO.Enum(), Key: []byte{}, Hello: protobuf.NewHello(nil, protobuf.DefaultMaxFrameSize)})
+	if leader := hello.GetHello().GetLeader(); leader != "localhost:12345" {
+		t.Fatalf("Hello Expecting: leader localhost:12345, Received: %q", leader)
+	}
+
+	get := func(staleness uint32) protobuf.Status_Code {
+		request := &protobuf.Request{Id: proto.String("get"), Op: protobuf.Request_GET.Enum(), Key: []byte("replica")}
+		if staleness > 0 {
+			request.MaxStaleness = proto.Uint32(staleness)
+		}
+		response := exchange(request)
+		if response.GetStatus().GetCode() == protobuf.Status_REDIRECT && response.GetLeader() != "localhost:12345" {
+			t.Fatalf("Redirect Expecting: leader localhost:12345, Received: %q", response.GetLeader())
+		}
+		return response.GetStatus().GetCode()
+	}
+	set := exchange(&protobuf.Request{Id: proto.String("set"), Op: protobuf.Request_SET.Enum(), Key: []byte("replica"), Value: []byte("v")})
+	if code := set.GetStatus().GetCode(); code != protobuf.Status_REDIRECT || set.GetLeader() != "localhost:12345" {
+		t.Fatalf("Set on replica Expecting: REDIRECT to localhost:12345, Received: %v %q", code, set.GetLeader())
+	}
+	if code := get(0); code != protobuf.Status_REDIRECT {
+		t.Fatalf("Get without staleness Expecting: REDIRECT, Received: %v", code)
+	}
+	if code := get(1000); code != protobuf.Status_REDIRECT {
+		t.Fatalf("Get before syncing Expecting: REDIRECT, Received: %v", code)
+	}
+
+	server.Synced(time.Now())
+	if code := get(1000); code != protobuf.Status_NOT_FOUND {
+		t.Fatalf("Get after syncing Expecting: NOT_FOUND, Received: %v", code)
+	}
+	// Synced never goes back in time
+	server.Synced(time.Now().Add(-time.Hour))
+	time.Sleep(20 * time.Millisecond)
+	if code := get(10); code != protobuf.Status_REDIRECT {
+		t.Fatalf("Get staler than allowed Expecting: REDIRECT, Received: %v", code)
+	}
+}
+
+func TestReplicaSync(t *testing.T) {
+	defer func(bytes int) { syncBacklogBytes = bytes }(syncBacklogBytes)
+	cases := []struct {
+		name    string
+		engine  string
+		backlog int
+	}{
+		{"backlog", EngineMap, syncBacklogBytes},
+		// Every sync falls behind the backlog and copies the keys again
+		{"copy", EngineMap, 1},
+		{"lsm", EngineLSM, syncBacklogBytes},
+	}
+	for _, c := range cases {
+		syncBacklogBytes = c.backlog
+		replicaSync(t, c.name, c.engine)
+	}
+}
+
+func replicaSync(t *testing.T, name string, engine string) {
+	status, leader := InitConfig(Config{Port: 12399, Engine: engine})
+	if status != 0 {
+		t.Fatalf("%s: Leader inited with nonzero status", name)
+	}
+	defer leader.Close()
+	leader.Set("sync:a", "1")
+	leader.Set("sync:b", "2")
+	// More than one page to copy
+	large := strings.Repeat("x", syncBatchBytes/2)
+	for i := 0; i < 3; i++ {
+		leader.Set(fmt.Sprintf("sync:large%d", i), large)
+	}
+
+	status, replica := InitConfig(Config{Port: 12400, Leader: "localhost:12399", SyncInterval: 20 * time.Millisecond})
+	if status != 0 {
+		t.Fatalf("%s: Replica inited with nonzero status", name)
+	}
+	defer replica.Close()
+	// Not on the leader, a copy deletes it
+	replica.Set("sync:stale", "x")
+
+	conn, err := net.Dial("tcp", "localhost:12400")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	get := func(key string) (protobuf.Status_Code, string) {
+		request := &protobuf.Request{Id: proto.String("get"), Op: protobuf.Request_GET.Enum(), Key: []byte(key), MaxStaleness: proto.Uint32(1000)}
+		if err := protobuf.WriteFrame(conn, request); err != nil {
+			t.Fatal(err)
+		}
+		var value []byte
+		for {
+			response := new(protobuf.Response)
+			if err := protobuf.ReadFrame(reader, protobuf.DefaultMaxFrameSize, response); err != nil {
+				t.Fatal(err)
+			}
+			value = append(value, response.GetValue()...)
+			if !response.GetMore() {
+				return response.GetStatus().GetCode(), string(value)
+			}
+		}
+	}
+	eventually := func(key string, code protobuf.Status_Code, value string) {
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if got, read := get(key); got == code && read == value {
+				return
+			}
+		}
+		got, read := get(key)
+		t.Fatalf("%s: Replica get %s Expecting: %v %.10q, Received: %v %.10q", name, key, code, value, got, read)
+	}
+
+	// The replica answers from its own copy once synced
+	eventually("sync:a", protobuf.Status_OK, "1")
+	eventually("sync:b", protobuf.Status_OK, "2")
+	eventually("sync:large2", protobuf.Status_OK, large)
+
+	leader.Set("sync:a", "3")
+	leader.Delete("sync:b")
+	eventually("sync:a", protobuf.Status_OK, "3")
+	eventually("sync:b", protobuf.Status_NOT_FOUND, "")
+	if name == "copy" {
+		eventually("sync:stale", protobuf.Status_NOT_FOUND, "")
+	}
+
+	// Gone from the leader so the next case starts afresh
+	for _, key := range []string{"sync:a", "sync:large0", "sync:large1", "sync:large2"} {
+		leader.Delete(key)
+	}
+}
@@ -1,90 +1,433 @@
 package server
 
 import (
+	"keyvalue/lsm"
 	"keyvalue/protobuf"
 
-	"code.google.com/p/goprotobuf/proto"
+	"google.golang.org/grpc"
 
-	"bufio"
-	"encoding/binary"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
-	//"net/http"
+	"net/http"
 	"os"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const LogDir string = "log/"
 const MaxSetsPerSec uint = 1 << 15
+const MaxValueSize int = 1 << 28
+
+// Returned by update functions to leave a key alone, see Update
+var (
+	errNotSet  = errors.New("condition not met")
+	errMissing = errors.New("key not found")
+)
+
+const (
+	EngineMap = "map" // Whole store in memory, persisted as base snapshots and delta logs
+	EngineLSM = "lsm" // Log-structured merge-tree on disk, for datasets larger than memory
+)
+
+type Config struct {
+	Port         uint16
+	Engine       string
+	MemoryBudget int64  // Bytes of keys and values the map engine keeps in memory, 0 for unbounded
+	MaxFrameSize uint32 // Largest message accepted on the wire, defaults to protobuf.DefaultMaxFrameSize
+	GRPCPort     uint16 // Also serve the gRPC service on this port, 0 to disable
+	HTTPPort     uint16 // Also serve the REST gateway on this port, 0 to disable
+	RedisPort    uint16 // Also speak the Redis protocol on this port, 0 to disable
+	MemcachePort uint16 // Also speak the memcached text protocol on this port, 0 to disable
+	CertFile     string // Serve TLS on every port with this certificate and key
+	KeyFile      string
+	ClientCAFile string // Require client certificates signed by this CA, needs CertFile
+	ACLFile      string // Authenticate clients and limit them to the key prefixes granted here, see acl.go
+
+	// Encrypt the persistence files with AES-GCM keys read from this file and
+	// string (usually an environment variable), see crypt.go for the format
+	EncryptionKeyFile string
+	EncryptionKey     string
+	EncryptionMigrate bool // Read unencrypted entries too, to start encrypting an existing store
+
+	Compress bool // Deflate large values in the persistence files
+
+	// Address of the leader this server is a replica of, see replica.go
+	Leader       string
+	LeaderToken  string        // Authenticates syncs with a leader that has an ACL
+	SyncInterval time.Duration // How often a replica syncs with its leader, defaults to a second
+
+	// Admission control, see limit.go. Unlimited when 0
+	MaxConnections int           // Open connections on the binary, Redis and memcached ports
+	MaxInFlight    int           // Requests handled at once on every port
+	RateLimit      float64       // Requests a second from each client
+	RateBurst      int           // Requests a client may send at once after a quiet spell, defaults to RateLimit
+	QueueTimeout   time.Duration // Longest a set waits for room in the queue before it's answered busy, defaults to a second
+
+	MetricsPort uint16 // Serve Prometheus metrics on /metrics at this port, 0 to disable. See metrics.go
+}
 
 type set struct {
-	Key   string
-	Value string
+	Key      string
+	Value    string
+	Deleted  bool
+	update   func(string, bool) (string, bool, error) // Run against the current value before applying, see Update
+	done     chan error                               // Told once the set is applied, if not nil
+	sequence uint64                                   // Numbered by queue, see version.go
+}
+
+// On disk form of a set, encoding/json base64 encodes []byte so any bytes survive
+type persistedSet struct {
+	Key        []byte
+	Value      []byte
+	Deleted    bool `json:",omitempty"`
+	Sealed     bool `json:",omitempty"` // Key and Value are encrypted, see crypt.go
+	Compressed bool `json:",omitempty"` // Value is deflated
 }
 
 type Server struct {
+	hits      uint64 // Cache counters are updated atomically so must stay 64-bit aligned
+	misses    uint64
+	evictions uint64
+
 	Port           uint16
 	listener       net.Listener
+	tls            *tls.Config // Nil unless serving TLS
+	acl            *acl        // Nil lets every client do anything
+	keys           *keyring    // Nil writes persistence files in plaintext
+	compress       bool
+	maxFrameSize   uint32
 	store          map[string]string
 	storeLock      *sync.RWMutex // Maps aren't thread safe, must lock on writes using a readers-writer lock
 	pending        chan *set     // Pending sets are sent to channel to be added
 	pendingPersist chan *set
+	engine         *lsm.DB // Replaces store and its persistence when the lsm engine is used
+	persistLock    sync.Mutex
+	expires        map[string]time.Time // Keys with a ttl, see expire.go
+	expiresLock    sync.Mutex
+	queued         uint64 // Sequence of the last write sent to pending, see version.go
+	queueLock      sync.Mutex
+	stopped        bool          // Pending is closed and takes no more writes, under queueLock
+	applied        uint64        // Sequence of the last write set is done with
+	advanced       chan struct{} // Closed and replaced whenever applied moves on
+	appliedLock    sync.Mutex
+	versions       map[string]uint64 // Sequence of the last write to each key
+	versionsLock   sync.Mutex
+	grpcServer     *grpc.Server
+	httpServer     *http.Server
+	metricsServer  *http.Server
+	metrics        *metrics
+	redisListener  net.Listener
+	memcache       *memcache
+	dedupe         *dedupe
+	tracking       *tracking // Keys clients may have cached, see invalidate.go
+	limits         *limits
+	leader         string // Empty unless a replica
+	leaderToken    string
+	synced         time.Time // When the replica last caught up with its leader
+	syncedLock     sync.Mutex
+	runId          string   // Names this start to replicas, sequences begin again on restart
+	backlog        *backlog // Recent writes for replicas, see replica.go
+
+	// Used to shut down, see shutdown.go
+	stop         chan struct{} // Closed once shutting down
+	stopPersist  chan struct{} // Closed once every set is applied
+	setDone      chan struct{} // Closed by set once pending is drained
+	persisting   sync.WaitGroup
+	conns        map[net.Conn]string // Open client connections to their protocol, all but gRPC and HTTP
+	connsDone    sync.WaitGroup
+	connsLock    sync.Mutex
+	stopping     bool // No more connections are accepted, under connsLock
+	shutdownOnce sync.Once
+	shutdownErr  error
+
+	memory int64 // Bytes of keys and values in store, under storeLock
+
+	// Only used with a memory budget, see cache.go
+	budget  int64
+	index   map[string]location
+	evicted int // Keys in index but not in store, under storeLock
+	clock   *clock
 }
 
 func Init(port uint16) (int, *Server) {
-	log.Println("Server starting")
-	//Listen to the TCP port
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		log.Printf("Port %u could not be opened: %v\n", port, err)
-		return -1, nil
-	}
+	return InitConfig(Config{Port: port})
+}
 
+func InitConfig(config Config) (int, *Server) {
+	log.Println("Server starting")
 	server := &Server{
-		Port:           port,
-		listener:       listener,
+		Port:           config.Port,
+		compress:       config.Compress,
+		maxFrameSize:   config.MaxFrameSize,
 		store:          make(map[string]string),
 		storeLock:      &sync.RWMutex{},
 		pending:        make(chan *set, MaxSetsPerSec),
 		pendingPersist: make(chan *set, MaxSetsPerSec),
+		expires:        make(map[string]time.Time),
+		versions:       make(map[string]uint64),
+		advanced:       make(chan struct{}),
+		stop:           make(chan struct{}),
+		stopPersist:    make(chan struct{}),
+		setDone:        make(chan struct{}),
+		conns:          make(map[net.Conn]string),
+		metrics:        newMetrics(),
+		dedupe:         newDedupe(),
+		tracking:       newTracking(),
+		limits:         newLimits(config),
+		leader:         config.Leader,
+		leaderToken:    config.LeaderToken,
+		runId:          strconv.FormatInt(time.Now().UnixNano(), 36),
+		backlog:        new(backlog),
+	}
+	if server.maxFrameSize == 0 {
+		server.maxFrameSize = protobuf.DefaultMaxFrameSize
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		var err error
+		if server.tls, err = loadTLS(config.CertFile, config.KeyFile, config.ClientCAFile); err != nil {
+			log.Printf("Could not load TLS certificate: %v\n", err)
+			return -1, nil
+		}
+	} else if config.ClientCAFile != "" {
+		log.Println("Client certificates can only be required when serving TLS, give a certificate and key too")
+		return -1, nil
+	}
+
+	if config.ACLFile != "" {
+		var err error
+		if server.acl, err = loadACL(config.ACLFile); err != nil {
+			log.Printf("Could not load ACL: %v\n", err)
+			return -1, nil
+		}
+		if config.MemcachePort != 0 {
+			log.Println("The memcached protocol has no authentication, it can't be served with an ACL")
+			return -1, nil
+		}
+	}
+
+	if config.Leader != "" && (config.GRPCPort != 0 || config.HTTPPort != 0 || config.RedisPort != 0 || config.MemcachePort != 0) {
+		log.Println("Replicas only speak the binary protocol, which sends writes on to the leader")
+		return -1, nil
+	}
+
+	if config.EncryptionKeyFile != "" || config.EncryptionKey != "" {
+		var err error
+		if server.keys, err = loadKeyring(config.EncryptionKeyFile, config.EncryptionKey); err != nil {
+			log.Printf("Could not load encryption key: %v\n", err)
+			return -1, nil
+		}
+		if server.keys == nil {
+			log.Println("No encryption key found in the key file or string")
+			return -1, nil
+		}
+		if config.Engine == EngineLSM {
+			log.Println("Encryption at rest is only supported by the map engine")
+			return -1, nil
+		}
+		server.keys.plaintext = config.EncryptionMigrate
+		log.Printf("Server encrypting persistence with key %x\n", server.keys.current)
+	} else if config.EncryptionMigrate {
+		log.Println("Migrating to encryption needs an encryption key")
+		return -1, nil
+	}
+	if config.Engine == EngineLSM && config.MemoryBudget > 0 {
+		log.Println("A memory budget is only supported by the map engine")
+		return -1, nil
+	}
+
+	//Listen to the TCP port
+	listener, err := server.listen(config.Port)
+	if err != nil {
+		log.Printf("Port %d could not be opened: %v\n", config.Port, err)
+		return -1, nil
+	}
+	server.listener = listener
+	if config.MemoryBudget > 0 {
+		server.budget = config.MemoryBudget
+		server.index = make(map[string]location)
+		server.clock = newClock()
 	}
 
 	os.MkdirAll(LogDir, 0777)
 
-	server.recover()
-	log.Println("Server fully recovered")
+	started := time.Now()
+	switch config.Engine {
+	case EngineLSM:
+		server.engine, err = lsm.Open(path.Join(LogDir, EngineLSM), lsm.DefaultOptions)
+		if err != nil {
+			log.Printf("Could not open lsm engine: %v\n", err)
+			listener.Close()
+			return -1, nil
+		}
+		log.Println("Server opened lsm engine")
+	case EngineMap, "":
+		if err := server.recover(); err != nil {
+			log.Printf("Could not recover, check the encryption key and persistence files: %v\n", err)
+			listener.Close()
+			return -1, nil
+		}
+		log.Println("Server fully recovered")
 
-	go server.run()
+		server.persisting.Add(2)
+		go server.persistDelta()
+		go server.persistBase()
+	default:
+		log.Printf("Unknown storage engine '%s'\n", config.Engine)
+		listener.Close()
+		return -1, nil
+	}
+
+	server.metrics.recovered(time.Since(started))
+
+	// Running before anything else can fail so Close always finds them
 	go server.set()
+	go server.expireKeys()
+	if config.Leader != "" {
+		interval := config.SyncInterval
+		if interval == 0 {
+			interval = time.Second
+		}
+		go server.syncWithLeader(interval)
+	}
+
+	if config.GRPCPort != 0 {
+		if err := server.serveGRPC(config.GRPCPort); err != nil {
+			log.Printf("gRPC port %d could not be opened: %v\n", config.GRPCPort, err)
+			server.Close()
+			return -1, nil
+		}
+	}
 
-	go server.persistDelta()
-	go server.persistBase()
+	if config.MetricsPort != 0 {
+		if err := server.serveMetrics(config.MetricsPort); err != nil {
+			log.Printf("Metrics port %d could not be opened: %v\n", config.MetricsPort, err)
+			server.Close()
+			return -1, nil
+		}
+	}
 
-	/*go func() {
-		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			fmt.Fprintf(w, "%v", server.store)
-		})
+	if config.HTTPPort != 0 {
+		if err := server.serveHTTP(config.HTTPPort); err != nil {
+			log.Printf("HTTP port %d could not be opened: %v\n", config.HTTPPort, err)
+			server.Close()
+			return -1, nil
+		}
+	}
+
+	if config.RedisPort != 0 {
+		if err := server.serveRedis(config.RedisPort); err != nil {
+			log.Printf("Redis port %d could not be opened: %v\n", config.RedisPort, err)
+			server.Close()
+			return -1, nil
+		}
+	}
 
-		log.Fatal(http.ListenAndServe(":8080", nil))
-	}()*/
+	if config.MemcachePort != 0 {
+		if err := server.serveMemcache(config.MemcachePort); err != nil {
+			log.Printf("Memcached port %d could not be opened: %v\n", config.MemcachePort, err)
+			server.Close()
+			return -1, nil
+		}
+	}
+
+	go server.run()
 
 	log.Println("Server accepting requests")
 	return 0, server
 }
 
-func (s *Server) recover() {
+// Errors reading the files are logged and recovery carries on with what it has,
+// except for files that can't be decrypted or a base that can't be read at all,
+// which fail the start rather than lose the data, see crypt.go
+func (s *Server) recover() error {
+	legacy, err := s.recoverFiles()
+	if err != nil || !legacy {
+		return err
+	}
+	// The old format was never encrypted
+	if err := s.keys.unsealed(); err != nil {
+		return err
+	}
+	// Deltas written from now on are in the new format, a new base keeps them
+	// from being mixed up with the old ones on the next start
+	log.Println("Recovered persistence files in the old format, rewriting them")
+	if err := s.writeBase(); err != nil {
+		return err
+	}
+	if s.index != nil {
+		s.storeLock.Lock()
+		s.evict()
+		s.storeLock.Unlock()
+	}
+	return nil
+}
+
+// Persistence files from before keys and values were binary safe, the base is a
+// JSON object of key to value and deltas are a JSON array of string sets
+type legacySet struct {
+	Key   string
+	Value string
+}
+
+// Loads a base in the old format into memory, with a memory budget too since
+// its values can't be read back through the index. True if it was one
+func (s *Server) recoverLegacyBase(name string) bool {
+	data, err := ioutil.ReadFile(path.Join(LogDir, name))
+	if err != nil {
+		return false
+	}
+	var store map[string]string
+	if json.Unmarshal(data, &store) != nil {
+		return false
+	}
+	for key, value := range store {
+		s.storeValue(key, value)
+		if s.index != nil {
+			// Clean once recover rewrites the base, which gives them their locations
+			s.storeLocation(key, location{})
+			s.clock.add(key)
+		}
+	}
+	return true
+}
+
+func (s *Server) recoverLegacyDelta(name string) {
+	data, err := ioutil.ReadFile(path.Join(LogDir, name))
+	if err != nil {
+		log.Printf("Error reading delta log, recovery could be paritally incorrect: %v", err)
+		return
+	}
+	var sets []legacySet
+	if err := json.Unmarshal(data, &sets); err != nil {
+		log.Printf("Error reading delta log, recovery could be paritally incorrect: %v", err)
+		return
+	}
+	for _, set := range sets {
+		s.storeValue(set.Key, set.Value)
+		if s.index != nil {
+			s.storeLocation(set.Key, location{})
+			s.clock.add(set.Key)
+		}
+	}
+}
+
+// True if the base was in the old format, then so are the deltas after it
+func (s *Server) recoverFiles() (bool, error) {
 	entries, err := ioutil.ReadDir(LogDir)
 	if err != nil {
 		log.Printf("Error reading log directory, unable to recover: %v", err)
-		return
+		return false, nil
 	}
 
 	names := make([]string, len(entries))
@@ -98,6 +441,7 @@ func (s *Server) recover() {
 
 	// Find the most recent back backup
 	var baseEpoch int64
+	legacy := false
 	for i := len(names) - 1; i >= 0; i-- {
 		name := names[i]
 		if strings.LastIndex(name, "-base") >= 0 {
@@ -109,16 +453,44 @@ func (s *Server) recover() {
 				}
 			}
 
-			data, err := ioutil.ReadFile(path.Join(LogDir, name))
-			if err != nil {
-				log.Printf("Error reading base log, unable to recover: %v", err)
-				return
-			}
+			// With a memory budget only the locations of values are loaded
+			if s.index != nil {
+				err := scanSets(name, s.keys, func(key string, loc location) {
+					s.storeLocation(key, loc)
+				})
+				if err := fatalRecovery(err); err != nil {
+					log.Printf("Error scanning base log, unable to recover: %v", err)
+					return false, err
+				}
+				if err != nil {
+					if legacy = s.recoverLegacyBase(name); !legacy {
+						log.Printf("Error scanning base log, unable to recover: %v", err)
+						return false, err
+					}
+				}
+			} else {
+				data, err := ioutil.ReadFile(path.Join(LogDir, name))
+				if err != nil {
+					log.Printf("Error reading base log, unable to recover: %v", err)
+					return false, err
+				}
 
-			err = json.Unmarshal(data, &s.store)
-			if err != nil {
-				log.Printf("Error unmarshalling base log, unable to recover: %v", err)
-				return
+				var sets []persistedSet
+				err = json.Unmarshal(data, &sets)
+				if err != nil {
+					if legacy = s.recoverLegacyBase(name); !legacy {
+						log.Printf("Error unmarshalling base log, unable to recover: %v", err)
+						return false, err
+					}
+				}
+
+				for _, set := range sets {
+					key, value, err := readSet(name, set, s.keys)
+					if err != nil {
+						return false, err
+					}
+					s.storeValue(key, value)
+				}
 			}
 
 			// Truncate the list of names so we don't have to iterate
@@ -127,7 +499,7 @@ func (s *Server) recover() {
 				names = names[i+1:]
 			} else {
 				// No further delta updates in the list
-				return
+				return legacy, nil
 			}
 
 			break
@@ -140,13 +512,34 @@ func (s *Server) recover() {
 			if len(split) == 2 {
 				epoch, err := strconv.ParseInt(split[0], 10, 64)
 				if err == nil && epoch > baseEpoch {
+					if legacy {
+						s.recoverLegacyDelta(name)
+						continue
+					}
+					if s.index != nil {
+						err := scanSets(name, s.keys, func(key string, loc location) {
+							if loc.file == "" {
+								s.dropLocation(key)
+							} else {
+								s.storeLocation(key, loc)
+							}
+						})
+						if err != nil {
+							log.Printf("Error scanning delta log, recovery could be paritally incorrect: %v", err)
+							if err := fatalRecovery(err); err != nil {
+								return false, err
+							}
+						}
+						continue
+					}
+
 					data, err := ioutil.ReadFile(path.Join(LogDir, fmt.Sprintf("%d-delta", epoch)))
 					if err != nil {
 						log.Printf("Error reading delta log, recovery could be paritally incorrect: %v", err)
 						continue
 					}
 
-					var sets []set
+					var sets []persistedSet
 					err = json.Unmarshal(data, &sets)
 					if err != nil {
 						log.Printf("Error reading delta log, recovery could be paritally incorrect: %v", err)
@@ -154,162 +547,346 @@ func (s *Server) recover() {
 					}
 
 					for _, set := range sets {
-						s.store[set.Key] = set.Value
+						key, value, err := readSet(name, set, s.keys)
+						if err != nil {
+							return false, err
+						}
+						if set.Deleted {
+							s.dropValue(key)
+						} else {
+							s.storeValue(key, value)
+						}
 					}
 				}
 			}
 		}
 	}
+	return legacy, nil
 }
 
 func (s *Server) run() {
 	for {
 		if conn, err := s.listener.Accept(); err == nil {
-			go func(s *Server, conn net.Conn) {
-				defer conn.Close()
-				log.Println("Connection established with client")
-				for {
-
-					data := make([]byte, 4)
-					_, err := conn.Read(data)
-					if err != nil {
-						log.Printf("Error reading length: %v", err)
-						return
-					}
-					length := int(binary.BigEndian.Uint32(data))
+			go s.serve(conn)
+		} else if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			// Out of file descriptors and the like, give it a moment
+			time.Sleep(10 * time.Millisecond)
+		} else {
+			// Closed by Server.Shutdown
+			return
+		}
+	}
+}
 
-					data = make([]byte, length)
-					for i := 0; i < length; {
-						//Read the data waiting on the connection and put it in the data buffer
-						n, err := conn.Read(data[i : length-i])
-						i += n
-						if err != nil {
-							log.Printf("Error reading request: %v", err)
-							return
-						}
-					}
-					//Create an struct pointer of type protobuf.Request and protobuf.Response struct
-					request := new(protobuf.Request)
-					//Convert all the data retrieved into the ProtobufTest.TestMessage struct type
-					err = proto.Unmarshal(data[:length], request)
-					if err != nil {
-						log.Printf("Error in Unmarshalling: %v\n", err)
-						return
-					}
-					response := new(protobuf.Response)
-					response.Id = request.Id
-					if request.GetType() == "get" {
-						result, value := s.Get(request.GetKey())
-						response.Result = proto.Int32(int32(result))
-						response.Value = proto.String(value)
-					} else {
-						result, value := s.Set(request.GetKey(), request.GetValue())
-						response.Result = proto.Int32(int32(result))
-						response.Value = proto.String(value)
-					}
+func (s *Server) set() {
+	defer close(s.setDone)
+	for set := range s.pending {
+		if set.update != nil {
+			result, old := s.get(set.Key)
+			if result == -1 {
+				set.done <- fmt.Errorf("could not read key %s", set.Key)
+				s.markApplied(set.sequence)
+				continue
+			}
+			// An expired key is gone, whatever is written now starts without a ttl
+			if result == 0 && s.expired(set.Key) {
+				s.clearExpiry(set.Key)
+				result, old = 1, ""
+			}
+			value, deleted, err := set.update(old, result == 0)
+			if err != nil {
+				set.done <- err
+				s.markApplied(set.sequence)
+				continue
+			}
+			set.Value, set.Deleted = value, deleted
+		}
 
-					data, err = proto.Marshal(response)
-					if err != nil {
-						log.Printf("Marshaling error: %v\n", err)
-						continue
-					}
+		err := s.apply(set)
+		if err == nil {
+			s.recordVersion(set)
+			s.backlog.record(set)
+			s.tracking.invalidate(set.Key)
+		}
+		s.markApplied(set.sequence)
+		if set.done != nil {
+			set.done <- err
+		}
+	}
+}
 
-					length = len(data)
-					lengthBytes := make([]byte, 4)
-					binary.BigEndian.PutUint32(lengthBytes, uint32(length))
-					_, err = conn.Write(lengthBytes)
-					if err != nil {
-						log.Printf("Error writing data: %v\n", err)
-						return
-					}
-					_, err = conn.Write(data)
-					if err != nil {
-						log.Printf("Error writing data: %v\n", err)
-						return
-					}
-				}
-			}(s, conn)
+func (s *Server) apply(set *set) error {
+	if s.engine != nil {
+		var err error
+		if set.Deleted {
+			err = s.engine.Delete(set.Key)
 		} else {
-			continue
+			err = s.engine.Put(set.Key, set.Value)
+		}
+		if err != nil {
+			log.Printf("Could not write key %s to lsm engine: %v\n", set.Key, err)
 		}
+		return err
 	}
+
+	s.storeLock.Lock()
+	if set.Deleted {
+		if s.dropValue(set.Key) && s.index != nil {
+			s.clock.remove(set.Key)
+		}
+		if s.index != nil {
+			s.dropLocation(set.Key)
+		}
+	} else if s.index != nil {
+		s.storeValue(set.Key, set.Value)
+
+		// The value on disk is stale until this set is persisted
+		s.dropLocation(set.Key)
+		s.clock.add(set.Key)
+		s.evict()
+	} else {
+		s.storeValue(set.Key, set.Value)
+	}
+	s.storeLock.Unlock()
+
+	s.pendingPersist <- set
+	return nil
 }
 
-func (s *Server) set() {
-	for set := range s.pending {
-		s.storeLock.Lock()
-		s.store[set.Key] = set.Value
-		s.storeLock.Unlock()
+// Under storeLock, every change to store and index goes through these to keep
+// memory and evicted right
+func (s *Server) storeValue(key string, value string) {
+	if old, present := s.store[key]; present {
+		s.memory -= int64(len(key) + len(old))
+	} else if _, indexed := s.index[key]; indexed {
+		s.evicted--
+	}
+	s.store[key] = value
+	s.memory += int64(len(key) + len(value))
+}
+
+// True if key was in store
+func (s *Server) dropValue(key string) bool {
+	old, present := s.store[key]
+	if present {
+		s.memory -= int64(len(key) + len(old))
+		delete(s.store, key)
+		if _, indexed := s.index[key]; indexed {
+			s.evicted++
+		}
+	}
+	return present
+}
 
-		s.pendingPersist <- set
+func (s *Server) storeLocation(key string, loc location) {
+	if _, indexed := s.index[key]; !indexed {
+		if _, cached := s.store[key]; !cached {
+			s.evicted++
+		}
 	}
+	s.index[key] = loc
 }
 
+func (s *Server) dropLocation(key string) {
+	if _, indexed := s.index[key]; indexed {
+		if _, cached := s.store[key]; !cached {
+			s.evicted--
+		}
+		delete(s.index, key)
+	}
+}
+
+// Deltas and bases are written under persistLock and named by the time they
+// are created, so every file named before a base is fully contained in it
 func (s *Server) persistDelta() {
+	defer s.persisting.Done()
 	ticker := time.NewTicker(time.Second)
-	for t := range ticker.C {
-		func(s *Server) {
-			length := len(s.pendingPersist)
-			if length == 0 {
-				return
-			}
+	for waitTick(ticker, s.stopPersist) {
+		s.writeDelta()
+	}
+}
 
-			buffer := make([]*set, length)
-			for i := 0; i < length; i++ {
-				buffer[i] = <-s.pendingPersist
-			}
+func (s *Server) persistBase() {
+	defer s.persisting.Done()
+	ticker := time.NewTicker(time.Minute)
+	for waitTick(ticker, s.stopPersist) {
+		s.writeBase()
+	}
+}
 
-			deltaPath := path.Join(LogDir, fmt.Sprintf("%d-delta", t.UnixNano()))
-			f, err := os.Create(deltaPath)
-			if err != nil {
-				log.Printf("Could not create file %s, failed with error: %v\n", deltaPath, err)
-				return
-			}
-			defer f.Close()
+// Waits for the next tick, false once stop is closed
+func waitTick(ticker *time.Ticker, stop chan struct{}) bool {
+	select {
+	case <-ticker.C:
+		return true
+	case <-stop:
+		ticker.Stop()
+		return false
+	}
+}
+
+// Writes the sets applied since the last delta, errors are logged and returned
+func (s *Server) writeDelta() error {
+	length := len(s.pendingPersist)
+	if length == 0 {
+		return nil
+	}
+	started := time.Now()
 
-			w := bufio.NewWriter(f)
-			defer w.Flush()
+	s.persistLock.Lock()
+	defer s.persistLock.Unlock()
 
-			data, err := json.Marshal(buffer)
-			if err != nil {
-				log.Printf("Could not marshall delta log, with error: %v\n", err)
-			}
-			w.Write(data)
-			if err != nil {
-				log.Printf("Could not write data failed, with error: %v\n", err)
+	buffer := make([]*set, length)
+	for i := 0; i < length; i++ {
+		buffer[i] = <-s.pendingPersist
+	}
+
+	name := fmt.Sprintf("%d-delta", time.Now().UnixNano())
+	f, err := createPersistence()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := newPersistWriter(name, f, s.keys, s.compress)
+	locations := make([]location, length)
+	for i, set := range buffer {
+		if set.Deleted {
+			w.tombstone(set.Key)
+		} else {
+			locations[i] = w.entry(set.Key, set.Value)
+		}
+	}
+	if err := w.finish(); err != nil {
+		log.Printf("Could not write delta log, with error: %v\n", err)
+		return err
+	}
+	if err := commitPersistence(f, name); err != nil {
+		return err
+	}
+	s.metrics.persisted("delta", time.Since(started), w.offset)
+
+	if s.index != nil {
+		s.storeLock.Lock()
+		for i, set := range buffer {
+			// Keys set again since are still dirty, their newer value is in a later delta
+			if value, present := s.store[set.Key]; present && value == set.Value && !set.Deleted {
+				s.storeLocation(set.Key, locations[i])
 			}
-		}(s)
+		}
+		s.evict()
+		s.storeLock.Unlock()
 	}
+	return nil
 }
 
-func (s *Server) persistBase() {
-	ticker := time.NewTicker(time.Minute)
-	for t := range ticker.C {
-		func(s *Server) {
-			basePath := path.Join(LogDir, fmt.Sprintf("%d-base", t.UnixNano()))
-			f, err := os.Create(basePath)
-			if err != nil {
-				log.Printf("Could not create file %s, failed with error: %v\n", basePath, err)
-				return
-			}
-			defer f.Close()
+// Writes every key to a new base and deletes the files before it, errors are
+// logged and returned
+func (s *Server) writeBase() error {
+	s.persistLock.Lock()
+	defer s.persistLock.Unlock()
 
-			w := bufio.NewWriter(f)
-			defer w.Flush()
+	started := time.Now()
+	epoch := started.UnixNano()
+	name := fmt.Sprintf("%d-base", epoch)
+	f, err := createPersistence()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-			s.storeLock.RLock()
-			data, err := json.Marshal(s.store)
+	w := newPersistWriter(name, f, s.keys, s.compress)
+	locations := make(map[string]location)
+	s.storeLock.RLock()
+	for key, value := range s.store {
+		loc := w.entry(key, value)
+		if _, clean := s.index[key]; clean {
+			locations[key] = loc
+		}
+	}
+	// Evicted keys have to be copied over from the files we are about to delete
+	for key, old := range s.index {
+		if _, cached := s.store[key]; cached {
+			continue
+		}
+		value, err := readLocation(key, old, s.keys)
+		if err != nil {
+			log.Printf("Could not read evicted key %s, with error: %v\n", key, err)
 			s.storeLock.RUnlock()
-			if err != nil {
-				log.Printf("Could not marshall delta log, with error: %v\n", err)
-			}
-			w.Write(data)
-			if err != nil {
-				log.Printf("Could not write data failed, with error: %v\n", err)
+			return err
+		}
+		locations[key] = w.entry(key, value)
+	}
+	s.storeLock.RUnlock()
+
+	if err := w.finish(); err != nil {
+		log.Printf("Could not write base log, with error: %v\n", err)
+		return err
+	}
+	if err := commitPersistence(f, name); err != nil {
+		return err
+	}
+	s.metrics.persisted("base", time.Since(started), w.offset)
+
+	if s.index != nil {
+		s.storeLock.Lock()
+		for key, loc := range locations {
+			// Keys set while we were writing are dirty again and not in the index
+			if _, clean := s.index[key]; clean {
+				s.storeLocation(key, loc)
 			}
-			go deleteOldPersistence(t.UnixNano())
-		}(s)
+		}
+		s.storeLock.Unlock()
+
+		hits, misses, evictions := s.CacheStats()
+		log.Printf("Cache hits: %d, misses: %d, evictions: %d, memory: %d/%d bytes\n", hits, misses, evictions, s.memory, s.budget)
 	}
+	deleteOldPersistence(epoch)
+	return nil
+}
+
+// Bases and deltas are written to a temporary file and only renamed once they are
+// on disk, so a crash never leaves part of one to recover. Recovery ignores these
+// since they're neither bases nor deltas, and once a crash has left one behind for
+// staleWriting deleteOldPersistence removes it
+const writingPattern = "writing-*.tmp"
+
+var staleWriting = time.Hour
+
+func createPersistence() (*os.File, error) {
+	f, err := ioutil.TempFile(LogDir, writingPattern)
+	if err != nil {
+		log.Printf("Could not create file in %s, failed with error: %v\n", LogDir, err)
+	}
+	return f, err
+}
+
+// Syncs and closes the file being written then renames it to name, a base or delta
+// only counts as durable once the directory entry pointing to it is synced too
+func commitPersistence(f *os.File, name string) error {
+	err := f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path.Join(LogDir, name))
+	}
+	if err == nil {
+		err = syncDir(LogDir)
+	}
+	if err != nil {
+		log.Printf("Could not make %s durable, failed with error: %v\n", name, err)
+	}
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
 
 func deleteOldPersistence(epoch int64) {
@@ -319,6 +896,10 @@ func deleteOldPersistence(epoch int64) {
 	}
 	for _, entry := range entries {
 		name := entry.Name()
+		if matched, _ := path.Match(writingPattern, name); matched && time.Since(entry.ModTime()) > staleWriting {
+			os.Remove(path.Join(LogDir, name))
+			continue
+		}
 		if strings.LastIndex(name, "-base") >= 0 || strings.LastIndex(name, "-delta") >= 0 {
 			split := strings.Split(name, "-")
 			if len(split) == 2 {
@@ -332,6 +913,26 @@ func deleteOldPersistence(epoch int64) {
 }
 
 func (s *Server) Get(key string) (int, string) {
+	if s.expired(key) {
+		return 1, ""
+	}
+	return s.get(key)
+}
+
+// Reads key ignoring any expiry
+func (s *Server) get(key string) (int, string) {
+	if s.engine != nil {
+		value, present, err := s.engine.Get(key)
+		if err != nil {
+			log.Printf("Could not read key %s from lsm engine: %v\n", key, err)
+			return -1, ""
+		}
+		if present {
+			return 0, value
+		}
+		return 1, ""
+	}
+
 	if s.store == nil {
 		log.Printf("Server Store is not initialized\n")
 		return -1, ""
@@ -339,21 +940,172 @@ func (s *Server) Get(key string) (int, string) {
 
 	s.storeLock.RLock()
 	value, present := s.store[key]
-	s.storeLock.RUnlock()
 	if present {
+		if s.clock != nil {
+			s.clock.reference(key)
+		}
+		s.storeLock.RUnlock()
+		atomic.AddUint64(&s.hits, 1)
 		return 0, value
 	}
-	return 1, ""
+
+	// Evicted values are read while holding the lock so persistBase can't delete the file
+	loc, onDisk := s.index[key]
+	if !onDisk {
+		s.storeLock.RUnlock()
+		return 1, ""
+	}
+	value, err := readLocation(key, loc, s.keys)
+	s.storeLock.RUnlock()
+	if err != nil {
+		log.Printf("Could not read evicted key %s from %s: %v\n", key, loc.file, err)
+		return -1, ""
+	}
+	atomic.AddUint64(&s.misses, 1)
+
+	// Bring it back into memory unless it was set while we were reading
+	s.storeLock.Lock()
+	if current, clean := s.index[key]; clean && current == loc {
+		if _, cached := s.store[key]; !cached {
+			s.storeValue(key, value)
+			s.clock.add(key)
+			s.evict()
+		}
+	}
+	s.storeLock.Unlock()
+	return 0, value
 }
 
 func (s *Server) Set(key string, value string) (int, string) {
-	status, oldValue := s.Get(key)
+	return s.SetContext(context.Background(), key, value)
+}
+
+// Gives up with -1 if ctx is done before the set could be queued
+func (s *Server) SetContext(ctx context.Context, key string, value string) (int, string) {
+	status, oldValue, _ := s.SetSequenced(ctx, key, value)
+	return status, oldValue
+}
 
-	s.pending <- &set{Key: key, Value: value}
+// Reads are never held up so this only checks ctx before reading
+func (s *Server) GetContext(ctx context.Context, key string) (int, string) {
+	if ctx.Err() != nil {
+		return -1, ""
+	}
+	return s.Get(key)
+}
 
+// Removes key, returning its old value like Set
+func (s *Server) Delete(key string) (int, string) {
+	status, oldValue, _ := s.deleteSequenced(context.Background(), key)
 	return status, oldValue
 }
 
+// Like Delete but also returns the sequence number of the write, see SetSequenced
+func (s *Server) deleteSequenced(ctx context.Context, key string) (int, string, uint64) {
+	status, oldValue, sequence, _ := s.replace(ctx, &set{Key: key, Deleted: true}, 0)
+	return status, oldValue, sequence
+}
+
+// Applies update to the current value of key in order with every other set and
+// waits for it to be applied, so reads right after see the result. update returns
+// the new value or true to delete the key, an error leaves the key untouched.
+func (s *Server) Update(key string, update func(old string, present bool) (string, bool, error)) error {
+	return s.UpdateContext(context.Background(), key, update)
+}
+
+// Like Update but gives up with ctx.Err() if ctx is done before the update is queued,
+// once queued it is always waited for
+func (s *Server) UpdateContext(ctx context.Context, key string, update func(old string, present bool) (string, bool, error)) error {
+	return s.update(ctx, key, update, 0)
+}
+
+// See queue for timeout
+func (s *Server) update(ctx context.Context, key string, update func(old string, present bool) (string, bool, error), timeout time.Duration) error {
+	done := make(chan error, 1)
+	if err := s.queue(ctx, &set{Key: key, update: update, done: done}, timeout); err != nil {
+		return err
+	}
+	return <-done
+}
+
+// Deletes key and waits for it like Update, returns whether it existed
+func (s *Server) remove(key string) (bool, error) {
+	err := s.limitedUpdate(key, func(old string, present bool) (string, bool, error) {
+		if !present {
+			return "", false, errMissing
+		}
+		s.clearExpiry(key)
+		return "", true, nil
+	})
+	if err == errMissing {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Every key starting with prefix, sorted
+func (s *Server) Keys(prefix string) (int, []string) {
+	var keys []string
+	if s.engine != nil {
+		err := s.engine.Scan(prefix, func(key string, value string) bool {
+			if !s.expired(key) {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		if err != nil {
+			log.Printf("Could not scan keys from lsm engine: %v\n", err)
+			return -1, nil
+		}
+		return 0, keys
+	}
+
+	s.storeLock.RLock()
+	for key := range s.store {
+		if strings.HasPrefix(key, prefix) && !s.expired(key) {
+			keys = append(keys, key)
+		}
+	}
+	// Evicted keys are only in the index
+	for key := range s.index {
+		if _, cached := s.store[key]; !cached && strings.HasPrefix(key, prefix) && !s.expired(key) {
+			keys = append(keys, key)
+		}
+	}
+	s.storeLock.RUnlock()
+
+	sort.Strings(keys)
+	return 0, keys
+}
+
+func (s *Server) GetBytes(key []byte) (int, []byte) {
+	result, value := s.Get(string(key))
+	return result, []byte(value)
+}
+
+func (s *Server) SetBytes(key []byte, value []byte) (int, []byte) {
+	result, old := s.Set(string(key), string(value))
+	return result, []byte(old)
+}
+
+func (s *Server) GetBytesContext(ctx context.Context, key []byte) (int, []byte) {
+	result, value := s.GetContext(ctx, string(key))
+	return result, []byte(value)
+}
+
+func (s *Server) SetBytesContext(ctx context.Context, key []byte, value []byte) (int, []byte) {
+	result, old := s.SetContext(ctx, string(key), string(value))
+	return result, []byte(old)
+}
+
+func (s *Server) DeleteBytes(key []byte) (int, []byte) {
+	result, old := s.Delete(string(key))
+	return result, []byte(old)
+}
+
+// Shuts down without waiting for clients, queued sets are still made durable
 func (s *Server) Close() {
-	s.listener.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Shutdown(ctx)
 }
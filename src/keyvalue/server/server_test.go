@@ -1,6 +1,19 @@
 package server
 
-import "testing"
+import (
+	"keyvalue/protobuf"
+
+	"code.google.com/p/goprotobuf/proto"
+	"google.golang.org/grpc"
+
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
 
 func TestServerInit(t *testing.T) {
 	status, server := Init(12345)
@@ -11,3 +24,390 @@ func TestServerInit(t *testing.T) {
 		t.Fatal("Server inited returned nil value")
 	}
 }
+
+func TestServerInitLSM(t *testing.T) {
+	status, server := InitConfig(Config{Port: 12346, Engine: EngineLSM})
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	if server == nil {
+		t.Fatal("Server inited returned nil value")
+	}
+	server.Close()
+
+	if status, _ := InitConfig(Config{Port: 12346, Engine: EngineLSM, MemoryBudget: 1 << 20}); status != -1 {
+		t.Fatalf("LSM engine with a memory budget Expecting: -1, Received: %d", status)
+	}
+}
+
+func TestServerOperations(t *testing.T) {
+	status, server := Init(12347)
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", "localhost:12347")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	requests := []*protobuf.Request{
+		// Old clients only send the type string
+		{Id: proto.String("1"), Type: proto.String("get"), Key: []byte("key")},
+		{Id: proto.String("2"), Type: proto.String("delete"), Key: []byte("key")},
+		{Id: proto.String("3"), Op: protobuf.Request_Operation(99).Enum(), Key: []byte("key")},
+	}
+	expected := []protobuf.Status_Code{
+		protobuf.Status_NOT_FOUND,
+		protobuf.Status_UNKNOWN_OPERATION,
+		protobuf.Status_UNKNOWN_OPERATION,
+	}
+	for i, request := range requests {
+		if err := protobuf.WriteFrame(conn, request); err != nil {
+			t.Fatal(err)
+		}
+		response := new(protobuf.Response)
+		if err := protobuf.ReadFrame(conn, protobuf.DefaultMaxFrameSize, response); err != nil {
+			t.Fatal(err)
+		}
+		if response.GetStatus().GetCode() != expected[i] || response.GetResult() != int32(response.GetStatus().Result()) {
+			t.Fatalf("Request %s Expecting: %v, Received: %v (result %d)", request.GetId(), expected[i], response.GetStatus().GetCode(), response.GetResult())
+		}
+	}
+}
+
+func TestServerHandshake(t *testing.T) {
+	status, server := Init(12348)
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+
+	hello := func(version uint32) *protobuf.Response {
+		conn, err := net.Dial("tcp", "localhost:12348")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		request := &protobuf.Request{
+			Id:    proto.String("hello"),
+			Op:    protobuf.Request_HELLO.Enum(),
+			Key:   []byte{},
+			Hello: &protobuf.Hello{Version: proto.Uint32(version), MaxFrameSize: proto.Uint32(1024)},
+		}
+		if err := protobuf.WriteFrame(conn, request); err != nil {
+			t.Fatal(err)
+		}
+		response := new(protobuf.Response)
+		if err := protobuf.ReadFrame(conn, protobuf.DefaultMaxFrameSize, response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	response := hello(protobuf.ProtocolVersion)
+	if response.GetStatus().GetCode() != protobuf.Status_OK || response.GetHello().GetVersion() != protobuf.ProtocolVersion {
+		t.Fatalf("Expecting: OK version %d, Received: %v version %d", protobuf.ProtocolVersion, response.GetStatus().GetCode(), response.GetHello().GetVersion())
+	}
+
+	response = hello(999)
+	if response.GetStatus().GetCode() != protobuf.Status_VERSION_MISMATCH {
+		t.Fatalf("Expecting: %v, Received: %v", protobuf.Status_VERSION_MISMATCH, response.GetStatus().GetCode())
+	}
+}
+
+func TestServerGRPC(t *testing.T) {
+	status, server := InitConfig(Config{Port: 12349, GRPCPort: 12350, MaxFrameSize: 1024})
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+
+	conn, err := grpc.Dial("localhost:12350", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := protobuf.NewKeyValueClient(conn)
+	ctx := context.Background()
+
+	response, err := client.Set(ctx, &protobuf.SetRequest{Key: []byte("grpc"), Value: []byte("value")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err = client.Get(ctx, &protobuf.GetRequest{Key: []byte("grpc")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.GetStatus().GetCode() != protobuf.Status_OK || string(response.GetValue()) != "value" {
+		t.Fatalf("Expecting: OK value, Received: %v %s", response.GetStatus().GetCode(), response.GetValue())
+	}
+
+	// Values larger than a message go through the streaming calls
+	large := bytes.Repeat([]byte("0123456789"), 500)
+	set, err := client.SetStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(large); i += 500 {
+		if err := set.Send(&protobuf.SetRequest{Key: []byte("grpc"), Value: large[i : i+500]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if response, err = set.CloseAndRecv(); err != nil {
+		t.Fatal(err)
+	}
+	if string(response.GetValue()) != "value" {
+		t.Fatalf("Expecting old value: value, Received: %s", response.GetValue())
+	}
+
+	response, err = client.Get(ctx, &protobuf.GetRequest{Key: []byte("grpc")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.GetStatus().GetCode() != protobuf.Status_TOO_LARGE {
+		t.Fatalf("Expecting: %v, Received: %v", protobuf.Status_TOO_LARGE, response.GetStatus().GetCode())
+	}
+
+	get, err := client.GetStream(ctx, &protobuf.GetRequest{Key: []byte("grpc")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value []byte
+	for {
+		response, err := get.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		value = append(value, response.GetValue()...)
+	}
+	if !bytes.Equal(value, large) {
+		t.Fatalf("Expecting %d bytes, Received: %d bytes", len(large), len(value))
+	}
+
+	// Streams without chunks or with chunks naming other keys write nothing
+	set, err = client.SetStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response, err = set.CloseAndRecv(); err != nil || response.GetStatus().GetCode() != protobuf.Status_INVALID {
+		t.Fatalf("Empty stream Expecting: %v, Received: %v %v", protobuf.Status_INVALID, response.GetStatus().GetCode(), err)
+	}
+	set, err = client.SetStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set.Send(&protobuf.SetRequest{Key: []byte("grpc:first"), Value: []byte("a")})
+	set.Send(&protobuf.SetRequest{Key: []byte("grpc:second"), Value: []byte("b")})
+	if response, err = set.CloseAndRecv(); err != nil || response.GetStatus().GetCode() != protobuf.Status_INVALID {
+		t.Fatalf("Mixed keys Expecting: %v, Received: %v %v", protobuf.Status_INVALID, response.GetStatus().GetCode(), err)
+	}
+	for _, key := range []string{"", "grpc:first", "grpc:second"} {
+		if result, _ := server.Get(key); result != 1 {
+			t.Fatalf("Key %q Expecting: not set, Received: %d", key, result)
+		}
+	}
+
+	client.Set(ctx, &protobuf.SetRequest{Key: []byte("grpc:delete"), Value: []byte("value")})
+	response, err = client.Delete(ctx, &protobuf.DeleteRequest{Key: []byte("grpc:delete")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.GetStatus().GetCode() != protobuf.Status_OK || string(response.GetValue()) != "value" {
+		t.Fatalf("Delete Expecting: OK value, Received: %v %s", response.GetStatus().GetCode(), response.GetValue())
+	}
+	response, err = client.Get(ctx, &protobuf.GetRequest{Key: []byte("grpc:delete")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.GetStatus().GetCode() != protobuf.Status_NOT_FOUND {
+		t.Fatalf("Get after delete Expecting: %v, Received: %v", protobuf.Status_NOT_FOUND, response.GetStatus().GetCode())
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	request := &protobuf.Request{Id: proto.String("late"), Key: []byte("key"), Timeout: proto.Uint32(10)}
+	ctx, cancel := requestContext(request, time.Now().Add(-time.Second))
+	defer cancel()
+	if ctx.Err() == nil {
+		t.Fatal("Context of a request received a second ago with a 10ms timeout Expecting: done")
+	}
+	if code := resultResponse(ctx, request, -1).GetStatus().GetCode(); code != protobuf.Status_DEADLINE_EXCEEDED {
+		t.Fatalf("Expecting: %v, Received: %v", protobuf.Status_DEADLINE_EXCEEDED, code)
+	}
+
+	// Without a timeout requests never expire
+	request.Timeout = nil
+	ctx, cancel = requestContext(request, time.Now().Add(-time.Hour))
+	defer cancel()
+	if ctx.Err() != nil {
+		t.Fatal("Context of a request without a timeout Expecting: not done")
+	}
+}
+
+func TestServerReadYourWrites(t *testing.T) {
+	status, server := Init(12385)
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+
+	ctx := context.Background()
+	last := uint64(0)
+	for i := 0; i < 100; i++ {
+		value := strconv.Itoa(i)
+		_, _, sequence := server.SetSequenced(ctx, "sequenced", value)
+		if sequence <= last {
+			t.Fatalf("Sequence Expecting: above %d, Received: %d", last, sequence)
+		}
+		last = sequence
+		if result, read := server.GetAfter(ctx, "sequenced", sequence); result != 0 || read != value {
+			t.Fatalf("GetAfter Expecting: %s, Received: %d %q", value, result, read)
+		}
+		if version := server.Version("sequenced"); version != sequence {
+			t.Fatalf("Version Expecting: %d, Received: %d", sequence, version)
+		}
+	}
+
+	// Sequences the server never handed out aren't waited for
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if result, _ := server.GetAfter(ctx, "sequenced", last+1000); result != 0 {
+		t.Fatalf("GetAfter unknown sequence Expecting: 0, Received: %d", result)
+	}
+}
+
+func TestServerFullQueue(t *testing.T) {
+	status, server := Init(12394)
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+
+	// Holds set up on an update until release is closed
+	release, started := make(chan struct{}), make(chan struct{})
+	go server.Update("full:blocked", func(old string, present bool) (string, bool, error) {
+		close(started)
+		<-release
+		return "", false, nil
+	})
+	<-started
+	for i := uint(0); i < MaxSetsPerSec; i++ {
+		server.Set("full:key", strconv.Itoa(int(i)))
+	}
+	waiting := make(chan int, 1)
+	go func() {
+		result, _ := server.Set("full:waiting", "value")
+		waiting <- result
+	}()
+
+	// Nothing else waits behind the set stuck on the full queue
+	returned := make(chan uint64, 1)
+	go func() {
+		returned <- server.Queued()
+	}()
+	select {
+	case queued := <-returned:
+		if queued != uint64(MaxSetsPerSec)+1 {
+			t.Fatalf("Queued Expecting: %d, Received: %d", MaxSetsPerSec+1, queued)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Queued Expecting: to return with the queue full")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if result, _ := server.SetContext(ctx, "full:late", "value"); result != -1 {
+		t.Fatalf("Set with a timeout on a full queue Expecting: -1, Received: %d", result)
+	}
+
+	close(release)
+	select {
+	case result := <-waiting:
+		if result == -1 {
+			t.Fatal("Set waiting for room Expecting: queued, Received: -1")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Set waiting for room Expecting: queued once set caught up")
+	}
+}
+
+func TestServerAbortUpload(t *testing.T) {
+	status, server := Init(12401)
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+	defer server.Close()
+	defer func(stale time.Duration) { staleUpload = stale }(staleUpload)
+	staleUpload = 50 * time.Millisecond
+
+	conn, err := net.Dial("tcp", "localhost:12401")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	exchange := func(request *protobuf.Request) *protobuf.Response {
+		if err := protobuf.WriteFrame(conn, request); err != nil {
+			t.Fatal(err)
+		}
+		response := new(protobuf.Response)
+		if err := protobuf.ReadFrame(conn, protobuf.DefaultMaxFrameSize, response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	send := func(request *protobuf.Request) {
+		if err := protobuf.WriteFrame(conn, request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chunk := func(id string, key string, value string, more bool) *protobuf.Request {
+		return &protobuf.Request{Id: proto.String(id), Op: protobuf.Request_SET.Enum(), Key: []byte(key), Value: []byte(value), More: proto.Bool(more)}
+	}
+
+	response := exchange(&protobuf.Request{Id: proto.String("hello"), Op: protobuf.Request_HELLO.Enum(), Key: []byte{}, Hello: protobuf.NewHello(nil, protobuf.DefaultMaxFrameSize)})
+	features := protobuf.Negotiate([]string{protobuf.FeatureAbort}, response.GetHello().GetFeatures())
+	if !features[protobuf.FeatureAbort] {
+		t.Fatal("Expecting: abort offered in the handshake")
+	}
+
+	// An aborted upload is forgotten, the id starts a new set
+	send(chunk("1", "aborted", "head", true))
+	send(&protobuf.Request{Id: proto.String("1"), Op: protobuf.Request_SET.Enum(), Key: []byte{}, Abort: proto.Bool(true)})
+	if response := exchange(chunk("1", "aborted", "tail", false)); response.GetResult() == -1 {
+		t.Fatalf("Set after abort Expecting: success, Received: %v", response.GetStatus().GetCode())
+	}
+	if result, value := server.Get("aborted"); result != 0 || value != "tail" {
+		t.Fatalf("Get after abort Expecting: tail, Received: %d %s", result, value)
+	}
+
+	// An upload that goes quiet is rejected when its last chunk turns up
+	send(chunk("2", "stale", "head", true))
+	time.Sleep(2 * staleUpload)
+	if response := exchange(&protobuf.Request{Id: proto.String("ping"), Op: protobuf.Request_PING.Enum(), Key: []byte{}}); response.GetStatus().GetCode() != protobuf.Status_OK {
+		t.Fatalf("Ping Expecting: OK, Received: %v", response.GetStatus().GetCode())
+	}
+	if response := exchange(chunk("2", "stale", "tail", false)); response.GetStatus().GetCode() != protobuf.Status_DEADLINE_EXCEEDED {
+		t.Fatalf("Stale upload Expecting: %v, Received: %v", protobuf.Status_DEADLINE_EXCEEDED, response.GetStatus().GetCode())
+	}
+	if result, _ := server.Get("stale"); result != 1 {
+		t.Fatalf("Get of stale upload Expecting: 1, Received: %d", result)
+	}
+
+	// The first chunk pins the key, an upload switching keys is rejected whole
+	send(chunk("3", "pinned", "head", true))
+	send(chunk("3", "switched", "middle", true))
+	if response := exchange(chunk("3", "pinned", "tail", false)); response.GetStatus().GetCode() != protobuf.Status_INVALID {
+		t.Fatalf("Upload switching keys Expecting: %v, Received: %v", protobuf.Status_INVALID, response.GetStatus().GetCode())
+	}
+	for _, key := range []string{"pinned", "switched"} {
+		if result, _ := server.Get(key); result != 1 {
+			t.Fatalf("Get of %s Expecting: 1, Received: %d", key, result)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Shutting down stops every listener, lets each connection finish the requests
+// it already sent, applies every queued set and writes a final base, so the next
+// start recovers all of it from one file. Connections still open once the
+// context is done are closed under their clients.
+
+var errShutdown = errors.New("server is shutting down")
+
+// Registers a connection so shutdown waits for it. Fails once shutting down, or
+// with errBusy while there are MaxConnections already
+func (s *Server) accept(conn net.Conn, protocol string) error {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	if s.stopping {
+		return errShutdown
+	}
+	if s.limits.maxConns > 0 && len(s.conns) >= s.limits.maxConns {
+		s.metrics.connection(protocol, false)
+		return errBusy
+	}
+	s.conns[conn] = protocol
+	s.connsDone.Add(1)
+	s.metrics.connection(protocol, true)
+	return nil
+}
+
+func (s *Server) release(conn net.Conn) {
+	s.connsLock.Lock()
+	delete(s.conns, conn)
+	s.connsLock.Unlock()
+	s.connsDone.Done()
+}
+
+// Returns once everything applied is durable, or the error that stopped it
+// from being. Only the first call does anything, later ones return its result
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		s.shutdownErr = s.shutdown(ctx)
+	})
+	return s.shutdownErr
+}
+
+func (s *Server) shutdown(ctx context.Context) error {
+	log.Println("Server shutting down")
+	close(s.stop)
+	s.listener.Close()
+	if s.redisListener != nil {
+		s.redisListener.Close()
+	}
+	if s.memcache != nil {
+		s.memcache.listener.Close()
+	}
+	for _, server := range []*http.Server{s.httpServer, s.metricsServer} {
+		if server != nil {
+			if err := server.Shutdown(ctx); err != nil {
+				server.Close()
+			}
+		}
+	}
+	if s.grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			s.grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			s.grpcServer.Stop()
+		}
+	}
+
+	// Reads fail once what the client already sent is handled, which ends the connection
+	s.connsLock.Lock()
+	s.stopping = true
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.connsLock.Unlock()
+	drained := make(chan struct{})
+	go func() {
+		s.connsDone.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		s.connsLock.Lock()
+		log.Printf("Closing %d connections still busy\n", len(s.conns))
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.connsLock.Unlock()
+		<-drained
+	}
+
+	// Nothing can queue a set any more, set applies the rest and stops
+	s.queueLock.Lock()
+	s.stopped = true
+	close(s.pending)
+	s.queueLock.Unlock()
+	<-s.setDone
+
+	if s.engine != nil {
+		if err := s.engine.Close(); err != nil {
+			log.Printf("Could not close lsm engine: %v\n", err)
+			return err
+		}
+		log.Println("Server shut down")
+		return nil
+	}
+
+	// Persisting carries on until now since set may wait on pendingPersist
+	close(s.stopPersist)
+	s.persisting.Wait()
+	if err := s.writeDelta(); err != nil {
+		return err
+	}
+	if err := s.writeBase(); err != nil {
+		return err
+	}
+	log.Println("Server shut down")
+	return nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"keyvalue/protobuf"
+
+	"code.google.com/p/goprotobuf/proto"
+
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerShutdown(t *testing.T) {
+	status, server := Init(12387)
+	if status != 0 {
+		t.Fatal("Server inited with nonzero status")
+	}
+
+	// Sets are answered once queued, shutdown applies and persists all of them
+	for i := 0; i < 1000; i++ {
+		server.Set("shutdown-"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	// A request already sent is answered before the connection is closed
+	conn, err := net.Dial("tcp", "localhost:12387")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := &protobuf.Request{Id: proto.String("1"), Op: protobuf.Request_SET.Enum(), Key: []byte("shutdown-conn"), Value: []byte("sent")}
+	if err := protobuf.WriteFrame(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	response := new(protobuf.Response)
+	if err := protobuf.ReadFrame(reader, protobuf.DefaultMaxFrameSize, response); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown Expecting: no error, Received: %v", err)
+	}
+	if err := protobuf.ReadFrame(reader, protobuf.DefaultMaxFrameSize, response); err == nil {
+		t.Fatal("Connection after shutdown Expecting: closed")
+	}
+	if result, _ := server.Set("shutdown-late", "late"); result != -1 {
+		t.Fatalf("Set after shutdown Expecting: -1, Received: %d", result)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Second shutdown Expecting: no error, Received: %v", err)
+	}
+
+	// The final base is renamed into place, and a file cut short by a crash is ignored
+	writingPath := path.Join(LogDir, strings.Replace(writingPattern, "*", "crashed", 1))
+	if err := ioutil.WriteFile(writingPath, []byte(`[{"Key":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(writingPath)
+
+	status, server = Init(12387)
+	if status != 0 {
+		t.Fatal("Restarted server inited with nonzero status")
+	}
+	defer server.Close()
+	for i := 0; i < 1000; i++ {
+		if result, value := server.Get("shutdown-" + strconv.Itoa(i)); result != 0 || value != strconv.Itoa(i) {
+			t.Fatalf("Get after restart Expecting: %d, Received: %d %q", i, result, value)
+		}
+	}
+	if result, value := server.Get("shutdown-conn"); result != 0 || value != "sent" {
+		t.Fatalf("Get of set sent on the connection Expecting: sent, Received: %d %q", result, value)
+	}
+
+	// Left behind by a crash long enough ago, so the next base deletes it
+	stale := time.Now().Add(-2 * staleWriting)
+	if err := os.Chtimes(writingPath, stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.writeBase(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(writingPath); !os.IsNotExist(err) {
+		t.Fatalf("Stale file being written Expecting: deleted, Received: %v", err)
+	}
+}
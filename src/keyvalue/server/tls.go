@@ -0,0 +1,43 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// Loads the server certificate, when a client CA is given clients must present
+// a certificate signed by it (mutual TLS)
+func loadTLS(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if clientCAFile != "" {
+		data, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates found in " + clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// Every listener goes through here so they all get TLS when it's configured
+func (s *Server) listen(port uint16) (net.Listener, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil || s.tls == nil {
+		return listener, err
+	}
+	return tls.NewListener(listener, s.tls), nil
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Every write takes the next sequence number as it is queued and set applies
+// them in that order. The number of the latest write to each key is its version,
+// which memcached hands out as cas tokens. Clients asking for read-your-writes
+// hand back the highest number they've seen and their gets wait until it is
+// applied, see GetAfter. Sequences only live in memory, keys not written since
+// the server started are version 0.
+
+// Numbers the set and sends it to set. Fails with ctx.Err() if ctx is done first,
+// errShutdown if the server is shutting down and errQueueFull, counted as busy,
+// if there's no room in pending within timeout, 0 waits as long as ctx. queueLock
+// is never held waiting for room in pending, so Queued and queuers with a ctx that
+// is done never wait behind a full queue
+func (s *Server) queue(ctx context.Context, set *set, timeout time.Duration) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		// Taken before trying so a set taken in between still wakes us
+		s.appliedLock.Lock()
+		advanced := s.advanced
+		s.appliedLock.Unlock()
+
+		s.queueLock.Lock()
+		if s.stopped {
+			s.queueLock.Unlock()
+			return errShutdown
+		}
+		set.sequence = s.queued + 1
+		select {
+		case s.pending <- set:
+			s.queued++
+			s.queueLock.Unlock()
+			return nil
+		default:
+		}
+		s.queueLock.Unlock()
+
+		// Every set taken from pending is marked applied, which makes room
+		select {
+		case <-advanced:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-expired:
+			atomic.AddUint64(&s.limits.busy, 1)
+			return errQueueFull
+		}
+	}
+}
+
+// Queues set once the value it replaces is read, see queue for timeout. Returns
+// the result code and old value of a get and the sequence number of the write
+func (s *Server) replace(ctx context.Context, set *set, timeout time.Duration) (int, string, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, "", 0, err
+	}
+	status, oldValue := s.Get(set.Key)
+
+	// Sent even if the key wasn't found, it may still be waiting in pending
+	s.clearExpiry(set.Key)
+	if err := s.queue(ctx, set, timeout); err != nil {
+		return -1, "", 0, err
+	}
+	return status, oldValue, set.sequence, nil
+}
+
+// Must only be called from set, which applies writes one at a time
+func (s *Server) recordVersion(set *set) {
+	s.versionsLock.Lock()
+	if set.Deleted {
+		delete(s.versions, set.Key)
+	} else {
+		s.versions[set.Key] = set.sequence
+	}
+	s.versionsLock.Unlock()
+}
+
+// Called by set once a write is done with, applied or not
+func (s *Server) markApplied(sequence uint64) {
+	s.appliedLock.Lock()
+	s.applied = sequence
+	close(s.advanced)
+	s.advanced = make(chan struct{})
+	s.appliedLock.Unlock()
+}
+
+func (s *Server) Version(key string) uint64 {
+	s.versionsLock.Lock()
+	defer s.versionsLock.Unlock()
+	return s.versions[key]
+}
+
+// Sequence of the last write set is done with, every write numbered up to it is
+// visible to gets
+func (s *Server) Applied() uint64 {
+	s.appliedLock.Lock()
+	defer s.appliedLock.Unlock()
+	return s.applied
+}
+
+// Sequence of the last write queued
+func (s *Server) Queued() uint64 {
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+	return s.queued
+}
+
+// Waits until every write up to sequence is applied, false if ctx is done first.
+// Numbers never handed out here, say from before a restart or from another
+// server, aren't waited for
+func (s *Server) waitApplied(ctx context.Context, sequence uint64) bool {
+	if sequence > s.Queued() {
+		return true
+	}
+	for {
+		s.appliedLock.Lock()
+		applied, advanced := s.applied, s.advanced
+		s.appliedLock.Unlock()
+		if applied >= sequence {
+			return true
+		}
+		select {
+		case <-advanced:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Like SetContext but also returns the sequence number of the write, which
+// GetAfter takes to read it back. 0 if it wasn't queued
+func (s *Server) SetSequenced(ctx context.Context, key string, value string) (int, string, uint64) {
+	status, oldValue, sequence, _ := s.replace(ctx, &set{Key: key, Value: value}, 0)
+	return status, oldValue, sequence
+}
+
+// Reads key once every write up to sequence is applied, so a client passing the
+// highest sequence it was given sees its own writes and never goes back in time
+func (s *Server) GetAfter(ctx context.Context, key string, sequence uint64) (int, string) {
+	if !s.waitApplied(ctx, sequence) {
+		return -1, ""
+	}
+	return s.GetContext(ctx, key)
+}
@@ -1,7 +1,28 @@
 package keyvalue
 
+import (
+	"context"
+)
+
+// Keys and values are arbitrary bytes, the string methods are a convenience
+// for text and behave exactly like their []byte counterparts.
+//
+// Get and Set return 0 when the key exists along with its value (the old value
+// for Set), 1 when it doesn't exist and -1 on any error.
 type Service interface {
 	Get(key string) (int, string)
 	Set(key string, value string) (int, string)
+	GetBytes(key []byte) (int, []byte)
+	SetBytes(key []byte, value []byte) (int, []byte)
 	Close()
 }
+
+// Service whose calls give up with -1 once ctx is cancelled or its deadline
+// passes. A set given up on may still be applied if it already reached the server.
+type ContextService interface {
+	Service
+	GetContext(ctx context.Context, key string) (int, string)
+	SetContext(ctx context.Context, key string, value string) (int, string)
+	GetBytesContext(ctx context.Context, key []byte) (int, []byte)
+	SetBytesContext(ctx context.Context, key []byte, value []byte) (int, []byte)
+}